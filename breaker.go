@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// Returned for operations on a node whose circuit breaker is open; see
+// circuitBreaker.
+var ErrCircuitOpen = errors.New("The OBM has failed repeatedly; not trying it again yet.")
+
+// How runOnNode retries failed operations, and when it stops trying an OBM
+// for a while (see circuitBreaker).
+type RetryPolicy struct {
+	// The number of times to try an idempotent operation (see
+	// idempotentOps) before giving up, and how long to wait before the
+	// first retry. The wait doubles after each attempt.
+	Attempts int
+	Backoff  time.Duration
+
+	// The number of consecutive failed operations after which a node's
+	// circuit breaker opens, and how long it stays open before letting an
+	// operation through to see if the OBM has recovered. A threshold of
+	// zero disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// Get the policy used unless configured otherwise.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:         3,
+		Backoff:          500 * time.Millisecond,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// Operations (as named in calls to runOnNode) which may safely be retried if
+// they fail: doing them twice has the same effect as doing them once.
+var idempotentOps = map[string]bool{
+	"power_status":   true,
+	"power_on":       true,
+	"power_off":      true,
+	"get_bootdev":    true,
+	"set_bootdev":    true,
+	"read_sensors":   true,
+	"read_sel":       true,
+	"read_inventory": true,
+}
+
+// Report whether `err`, returned by an operation called with `ctx`, indicates
+// that the OBM itself is misbehaving, as opposed to e.g. the operation being
+// invalid or the caller giving up. Only such failures are retried, or count
+// towards opening a circuit breaker.
+func isOBMFailure(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	switch err {
+	case driver.ErrInvalidBootdev, driver.ErrInvalidBootMode, driver.ErrInvalidIdentify,
+		driver.ErrInvalidSysRq, driver.ErrNotSupported, driver.ErrConsoleNotConnected, driver.ErrOBMStopped:
+		return false
+	default:
+		return true
+	}
+}
+
+// The possible states of a circuit breaker.
+type BreakerState string
+
+const (
+	// Operations are let through as normal.
+	BreakerClosed BreakerState = "closed"
+
+	// Operations fail immediately with ErrCircuitOpen.
+	BreakerOpen BreakerState = "open"
+
+	// The cooldown has passed; one operation is let through, and decides
+	// whether the breaker closes or opens again. Others fail immediately
+	// with ErrCircuitOpen while it is in progress.
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// The state of a node's circuit breaker, as reported by the node inspection
+// endpoint.
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+
+	// The number of operations that have failed since the last success.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// When the breaker last opened; nil if it never has.
+	OpenedAt *time.Time `json:"opened_at"`
+
+	// The error returned by the most recent failed operation, if any.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Stops us from hammering an OBM which keeps failing. After
+// RetryPolicy.BreakerThreshold consecutive failures, the breaker opens, and
+// operations fail fast for RetryPolicy.BreakerCooldown. After that, one
+// operation is let through: if it succeeds, the breaker closes again, and if
+// not, it re-opens.
+//
+// This complements health checks (see Node.CheckOBM), which only notice
+// OBMs that are entirely unreachable, and only as often as they run.
+type circuitBreaker struct {
+	lock   sync.Mutex
+	status BreakerStatus
+
+	// Whether the operation let through while half open is still in
+	// progress.
+	probing bool
+}
+
+func (b *circuitBreaker) Status() BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ret := b.status
+	if ret.State == "" {
+		ret.State = BreakerClosed
+	}
+	return ret
+}
+
+// Check whether an operation may go ahead under `policy`, returning
+// ErrCircuitOpen if not. `probe` is true if the operation is the one let
+// through to test a half open breaker; it must be passed on to record.
+func (b *circuitBreaker) allow(policy RetryPolicy, now time.Time) (probe bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.status.State {
+	case BreakerOpen:
+		if now.Sub(*b.status.OpenedAt) < policy.BreakerCooldown {
+			return false, ErrCircuitOpen
+		}
+		b.status.State = BreakerHalfOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+	default:
+		return false, nil
+	}
+	b.probing = true
+	return true, nil
+}
+
+// Record the outcome of an operation which allow let through. `ctx` is the
+// context the operation was called with, and `probe` is as returned by allow.
+//
+// If the probe fails for a reason which isn't the OBM's fault (see
+// isOBMFailure), the breaker stays half open, and the next operation becomes
+// the probe.
+func (b *circuitBreaker) record(ctx context.Context, policy RetryPolicy, now time.Time, probe bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if probe {
+		b.probing = false
+	}
+	log := logging.FromContext(ctx)
+	if err == nil {
+		if b.status.State == BreakerHalfOpen {
+			log.Info("OBM has recovered; closing circuit breaker.")
+		}
+		b.status.State = BreakerClosed
+		b.status.ConsecutiveFailures = 0
+		return
+	}
+	if !isOBMFailure(ctx, err) {
+		return
+	}
+	b.status.ConsecutiveFailures++
+	b.status.LastError = err.Error()
+	if policy.BreakerThreshold <= 0 {
+		return
+	}
+	if b.status.State == BreakerHalfOpen || b.status.ConsecutiveFailures >= policy.BreakerThreshold {
+		if b.status.State != BreakerHalfOpen {
+			log.Warn("OBM keeps failing; opening circuit breaker.",
+				"failures", b.status.ConsecutiveFailures, "cooldown", policy.BreakerCooldown)
+		}
+		b.status.State = BreakerOpen
+		b.status.OpenedAt = &now
+	}
+}
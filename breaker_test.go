@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Register a mock node, and return it.
+func breakerTestNode(t *testing.T, label string) (*Daemon, *Node) {
+	daemon := newDaemon()
+	err := daemon.SetNode(context.Background(), label,
+		[]byte(`{"type": "ipmi", "info": {"addr": "`+label+`"}}`))
+	if err != nil {
+		t.Fatal("SetNode:", err)
+	}
+	node, err := daemon.state.GetNode(label)
+	if err != nil {
+		t.Fatal("GetNode:", err)
+	}
+	return daemon, node
+}
+
+// Returns an operation which fails the first `failures` times it is called,
+// with `err`, and a pointer to the number of times it has been called.
+func flakyOp(failures int, err error) (func(context.Context, *Node) error, *int) {
+	calls := 0
+	return func(context.Context, *Node) error {
+		calls++
+		if calls <= failures {
+			return err
+		}
+		return nil
+	}, &calls
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	daemon, node := breakerTestNode(t, "retry-node")
+	flaky := errors.New("flaky")
+
+	cases := []struct {
+		op        string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   error
+	}{
+		// Idempotent operations are retried:
+		{"power_status", 2, flaky, 3, nil},
+		{"set_bootdev", 5, flaky, 3, flaky},
+		// Others aren't:
+		{"power_cycle", 1, flaky, 1, flaky},
+		// Nor are errors that aren't the OBM's fault:
+		{"power_status", 1, driver.ErrNotSupported, 1, driver.ErrNotSupported},
+	}
+	for _, c := range cases {
+		f, calls := flakyOp(c.failures, c.err)
+		err := daemon.runOnNode(ctx, node, c.op, f)
+		if err != c.wantErr || *calls != c.wantCalls {
+			t.Fatalf("%s failing %d times with %v: wanted %d calls and error %v, "+
+				"but got %d calls and error %v",
+				c.op, c.failures, c.err, c.wantCalls, c.wantErr, *calls, err)
+		}
+	}
+}
+
+// The node's lock is released while waiting to retry, so other operations on
+// the node aren't held up.
+func TestRetryReleasesLock(t *testing.T) {
+	daemon, node := breakerTestNode(t, "retry-lock-node")
+	daemon.policy.Backoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	failed := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- daemon.runOnNode(ctx, node, "power_status", func(context.Context, *Node) error {
+			close(failed)
+			return errors.New("flaky")
+		})
+	}()
+	<-failed
+	other, calls := flakyOp(0, nil)
+	if err := daemon.runOnNode(context.Background(), node, "power_cycle", other); err != nil || *calls != 1 {
+		t.Fatalf("Operation during backoff: got error %v after %d calls", err, *calls)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("Retried operation succeeded.")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	daemon, node := breakerTestNode(t, "breaker-node")
+	daemon.policy.BreakerThreshold = 2
+	daemon.policy.BreakerCooldown = time.Hour
+	requireState := func(state BreakerState, failures int) {
+		info, err := daemon.GetNodeInfo(ctx, "breaker-node")
+		if err != nil {
+			t.Fatal("GetNodeInfo:", err)
+		}
+		if info.CircuitBreaker.State != state || info.CircuitBreaker.ConsecutiveFailures != failures {
+			t.Fatalf("Wanted breaker state %s with %d failures, but got %+v",
+				state, failures, info.CircuitBreaker)
+		}
+	}
+	fail, _ := flakyOp(1000, errors.New("broken"))
+	succeed, calls := flakyOp(0, nil)
+
+	requireState(BreakerClosed, 0)
+	daemon.runOnNode(ctx, node, "power_cycle", fail)
+	requireState(BreakerClosed, 1)
+	daemon.runOnNode(ctx, node, "power_cycle", fail)
+	requireState(BreakerOpen, 2)
+
+	// While open, operations fail without touching the OBM:
+	if err := daemon.runOnNode(ctx, node, "power_cycle", succeed); err != ErrCircuitOpen || *calls != 0 {
+		t.Fatalf("Wanted %v without calling the operation, but got %v after %d calls",
+			ErrCircuitOpen, err, *calls)
+	}
+	if status := statusForError(ErrCircuitOpen); status != http.StatusServiceUnavailable {
+		t.Fatalf("Wanted status %d for an open breaker, but got %d",
+			http.StatusServiceUnavailable, status)
+	}
+
+	// After the cooldown, a failed trial re-opens it...
+	daemon.policy.BreakerCooldown = 0
+	daemon.runOnNode(ctx, node, "power_cycle", fail)
+	requireState(BreakerOpen, 3)
+
+	// ...and a successful one closes it.
+	if err := daemon.runOnNode(ctx, node, "power_cycle", succeed); err != nil || *calls != 1 {
+		t.Fatalf("Trial operation: got error %v after %d calls", err, *calls)
+	}
+	requireState(BreakerClosed, 0)
+}
+
+// While a half open breaker's trial operation is in progress, other
+// operations are still rejected.
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	ctx := context.Background()
+	daemon, node := breakerTestNode(t, "half-open-node")
+	daemon.policy.BreakerThreshold = 1
+	fail, _ := flakyOp(1000, errors.New("broken"))
+	daemon.runOnNode(ctx, node, "power_cycle", fail)
+	daemon.policy.BreakerCooldown = 0
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	trialDone := make(chan error)
+	go func() {
+		trialDone <- daemon.runOnNode(ctx, node, "power_cycle", func(context.Context, *Node) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = daemon.runOnNode(ctx, node, "power_cycle", func(context.Context, *Node) error {
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != ErrCircuitOpen {
+			t.Fatalf("Operation %d during the trial: wanted %v but got %v", i, ErrCircuitOpen, err)
+		}
+	}
+	if state := node.breaker.Status().State; state != BreakerHalfOpen {
+		t.Fatalf("Wanted breaker state %s during the trial, but got %s", BreakerHalfOpen, state)
+	}
+
+	close(release)
+	if err := <-trialDone; err != nil {
+		t.Fatal("Trial operation:", err)
+	}
+	if state := node.breaker.Status().State; state != BreakerClosed {
+		t.Fatalf("Wanted breaker state %s after the trial, but got %s", BreakerClosed, state)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A power action which can be applied to many nodes at once; see BulkPower.
+type PowerAction string
+
+const (
+	PowerOn    PowerAction = "power_on"
+	PowerOff   PowerAction = "power_off"
+	PowerCycle PowerAction = "power_cycle"
+)
+
+// Limits on the concurrency of bulk operations.
+const (
+	defaultBulkConcurrency = 10
+	maxBulkConcurrency     = 100
+)
+
+var ErrInvalidBulkRequest = errors.New("Invalid bulk request.")
+
+// The outcome of a bulk power operation on one node.
+type BulkPowerResult struct {
+	Node string `json:"node"`
+
+	// The http status the equivalent single-node request would have
+	// returned.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report whether `a` is a known power action.
+func (a PowerAction) valid() bool {
+	switch a {
+	case PowerOn, PowerOff, PowerCycle:
+		return true
+	default:
+		return false
+	}
+}
+
+// Check that `args` is well-formed, returning ErrInvalidBulkRequest or
+// ErrInvalidSelector if not.
+func (args *BulkPowerArgs) validate() error {
+	if (args.Nodes == nil) == (args.Selector == nil) || !args.Action.valid() ||
+		args.Concurrency < 1 || args.Concurrency > maxBulkConcurrency || args.StaggerMs < 0 {
+		return ErrInvalidBulkRequest
+	}
+	if args.Selector != nil {
+		if _, err := ParseSelector(*args.Selector); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]bool, len(args.Nodes))
+	for _, label := range args.Nodes {
+		if seen[label] {
+			return ErrInvalidBulkRequest
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+// Carry out the bulk power operation described by `args`, returning the
+// result for each node: in the order given, or sorted by label if `args` has
+// a selector. The selector is resolved when this is called.
+func (d *Daemon) RunBulkPower(ctx context.Context, args *BulkPowerArgs) ([]BulkPowerResult, error) {
+	if err := args.validate(); err != nil {
+		return nil, err
+	}
+	labels := args.Nodes
+	if args.Selector != nil {
+		// Already checked by validate:
+		sel, _ := ParseSelector(*args.Selector)
+		labels = []string{}
+		for _, entry := range d.ListNodes(ctx, sel) {
+			labels = append(labels, entry.Label)
+		}
+	}
+	errs := d.bulkPower(ctx, labels, args)
+	results := make([]BulkPowerResult, len(labels))
+	for i, label := range labels {
+		results[i] = BulkPowerResult{
+			Node:   label,
+			Status: statusForError(errs[i]),
+		}
+		if errs[i] != nil {
+			results[i].Error = errs[i].Error()
+		}
+	}
+	return results, nil
+}
+
+// Apply `action` to `node`, publishing an event with the result. `force` is as
+// for PowerCycleNode, and is ignored for other actions.
+func (d *Daemon) powerAction(ctx context.Context, node *Node, action PowerAction, force bool) error {
+	err := d.runOnNode(ctx, node, string(action), func(ctx context.Context, n *Node) error {
+		invalidatePowerStatus(n)
+		switch action {
+		case PowerOn:
+			return n.OBM.PowerOn(ctx)
+		case PowerOff:
+			return n.OBM.PowerOff(ctx)
+		default:
+			return n.OBM.PowerCycle(ctx, force)
+		}
+	})
+	kv := []interface{}{"action", action}
+	if action == PowerCycle {
+		kv = append(kv, "force", force)
+	}
+	if err == nil {
+		kv = append(kv, "result", "ok")
+	} else {
+		kv = append(kv, "result", "error", "error", err.Error())
+	}
+	d.publish(ctx, EventPowerAction, node.Label, kv...)
+	return err
+}
+
+// Apply args.Action to each of the nodes in `labels`, returning one error per
+// node, in the same order (nil for success). `args` must already have been
+// checked by validate; its nodes and selector are ignored in favour of
+// `labels`, which must not contain duplicates.
+//
+// At most args.Concurrency nodes are operated on at once, and successive
+// operations are started at least args.StaggerMs apart, so that powering on a
+// rack doesn't trip its breakers. If `ctx` is canceled, no further operations
+// are started, and the nodes which were skipped get ctx.Err().
+func (d *Daemon) bulkPower(ctx context.Context, labels []string, args *BulkPowerArgs) []error {
+	stagger := time.Duration(args.StaggerMs) * time.Millisecond
+	results := make([]error, len(labels))
+	nodes := make([]*Node, len(labels))
+	d.Lock()
+	for i, label := range labels {
+		nodes[i], results[i] = d.state.GetNode(label)
+	}
+	d.Unlock()
+
+	sem := make(chan struct{}, args.Concurrency)
+	var wg sync.WaitGroup
+	started := false
+	for i, node := range nodes {
+		if results[i] != nil {
+			continue
+		}
+		if started && stagger > 0 {
+			select {
+			case <-time.After(stagger):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			results[i] = ctx.Err()
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = ctx.Err()
+			continue
+		}
+		started = true
+		wg.Add(1)
+		go func(i int, node *Node) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = d.powerAction(ctx, node, args.Action, args.Force)
+		}(i, node)
+	}
+	wg.Wait()
+	return results
+}
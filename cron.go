@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCron = errors.New("Invalid cron expression.")
+
+// A parsed cron expression. See ParseCron.
+type CronExpr struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day of month/week fields started with "*" (e.g. "*" or
+	// "*/2"). This matters because if neither does, a day matches if
+	// *either* does; otherwise it must match both, as in Vixie cron.
+	domStar, dowStar bool
+}
+
+// The range of values and names for each field of a cron expression.
+type cronField struct {
+	min, max int
+	names    []string // names[i] is an alias for min+i.
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: []string{
+		"jan", "feb", "mar", "apr", "may", "jun",
+		"jul", "aug", "sep", "oct", "nov", "dec",
+	}}
+	// 7 is also Sunday, as in most crons.
+	cronDow = cronField{min: 0, max: 7, names: []string{
+		"sun", "mon", "tue", "wed", "thu", "fri", "sat",
+	}}
+)
+
+// Shorthands for common expressions.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a standard five-field cron expression:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field is a comma-separated list of `*`, values, or ranges `a-b`, each
+// optionally followed by a step `/n`. Months and days of the week may be given
+// by their three-letter English names. The macros @yearly, @monthly, @weekly,
+// @daily and @hourly are also accepted.
+func ParseCron(s string) (*CronExpr, error) {
+	s = strings.TrimSpace(s)
+	if expanded, ok := cronMacros[strings.ToLower(s)]; ok {
+		s = expanded
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, ErrInvalidCron
+	}
+	var (
+		expr CronExpr
+		err  error
+	)
+	if expr.minute, _, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if expr.hour, _, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if expr.dom, expr.domStar, err = cronDom.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if expr.month, _, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if expr.dow, expr.dowStar, err = cronDow.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if expr.dow&(1<<7) != 0 {
+		expr.dow |= 1
+	}
+	return &expr, nil
+}
+
+// Parse one field, returning the set of values as a bitmask, and whether the
+// field starts with "*".
+func (f cronField) parse(s string) (bits uint64, star bool, err error) {
+	for _, part := range strings.Split(s, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, false, ErrInvalidCron
+			}
+		}
+		var lo, hi int
+		switch {
+		case rangePart == "*":
+			lo, hi = f.min, f.max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, false, err
+			}
+			if hi, err = f.value(bounds[1]); err != nil {
+				return 0, false, err
+			}
+			if hi < lo {
+				return 0, false, ErrInvalidCron
+			}
+		default:
+			if lo, err = f.value(rangePart); err != nil {
+				return 0, false, err
+			}
+			hi = lo
+			if step != 1 {
+				// "5/10" means "5-max/10".
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, strings.HasPrefix(s, "*"), nil
+}
+
+// Parse a single value in the field, which may be a number or a name.
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, ErrInvalidCron
+	}
+	return v, nil
+}
+
+// Report whether the expression matches the day of `t`.
+func (e *CronExpr) matchesDay(t time.Time) bool {
+	dom := e.dom&(1<<uint(t.Day())) != 0
+	dow := e.dow&(1<<uint(t.Weekday())) != 0
+	if e.domStar || e.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Get the first time strictly after `t` which matches the expression, in
+// t's location. Returns the zero time if there is none within five years
+// (e.g. for "0 0 31 2 *").
+func (e *CronExpr) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case e.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !e.matchesDay(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case e.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case e.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"foo * * * *",
+		"* * * * someday",
+		"@fortnightly",
+	} {
+		if _, err := ParseCron(expr); err != ErrInvalidCron {
+			t.Errorf("ParseCron(%q): wanted ErrInvalidCron but got %v", expr, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday.
+	start := time.Date(2024, time.January, 3, 10, 30, 15, 0, time.UTC)
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 3, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 3, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 1, 4, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 18 * * fri", time.Date(2024, 1, 5, 18, 0, 0, 0, time.UTC)},
+		{"0 7 * * MON", time.Date(2024, 1, 8, 7, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * sat,sun", time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"30 9 1,15 * *", time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month and day of week are or-ed together:
+		{"0 0 20 * thu", time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)},
+		// ...unless either starts with "*", in which case both must
+		// match: this is the first odd-numbered Monday, not Jan 5.
+		{"0 0 */2 * 1", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * */2", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, v := range cases {
+		expr, err := ParseCron(v.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", v.expr, err)
+		}
+		if actual := expr.Next(start); !actual.Equal(v.expected) {
+			t.Errorf("%q: wanted %v but got %v", v.expr, v.expected, actual)
+		}
+	}
+}
@@ -1,37 +1,130 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"io"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
 	"github.com/CCI-MOC/obmd/token"
 )
 
 var (
-	ErrNodeExists = errors.New("Node already exists.")
-	ErrNoSuchNode = errors.New("No such node.")
+	ErrNodeExists   = errors.New("Node already exists.")
+	ErrNoSuchNode   = errors.New("No such node.")
+	ErrShuttingDown = errors.New("Shutting down.")
 )
 
 type Daemon struct {
 	sync.Mutex
 	state *State
 	funcs chan func()
+
+	// Set by BeginShutdown. This is protected by its own lock, so that
+	// readiness checks don't wait behind slow OBM operations.
+	shutdownLock sync.Mutex
+	shuttingDown bool
+
+	// Signaled when schedules are added, changed or removed; see
+	// RunScheduler.
+	schedulesChanged chan struct{}
+
+	// Sequence jobs, running and finished, by ID; see StartSequence.
+	// jobsWG tracks the running ones.
+	jobs   map[string]*Job
+	jobsWG sync.WaitGroup
+
+	// Publishes events about nodes; see publish.
+	events *eventBus
+
+	// Running webhooks, by ID; see CreateWebhook.
+	webhooks map[string]*webhook
+
+	// How operations on nodes are retried; see runOnNode.
+	policy RetryPolicy
+
+	// How old a cached power status may be and still be returned by
+	// GetNodePowerStatus. Zero disables the cache.
+	maxPowerStatusAge time.Duration
 }
 
-func NewDaemon(state *State) *Daemon {
-	return &Daemon{
-		state: state,
+func NewDaemon(state *State, policy RetryPolicy, maxPowerStatusAge time.Duration) *Daemon {
+	d := &Daemon{
+		state:             state,
+		policy:            policy,
+		maxPowerStatusAge: maxPowerStatusAge,
+		schedulesChanged:  make(chan struct{}, 1),
+		jobs:              make(map[string]*Job),
+		events:            newEventBus(),
+		webhooks:          make(map[string]*webhook),
+	}
+	// An offline State is only used for one-shot commands, which
+	// shouldn't deliver events to anyone:
+	if !state.offline {
+		for id, spec := range state.webhooks {
+			d.startWebhook(id, *spec)
+		}
 	}
+	return d
 }
 
-func (d *Daemon) DeleteNode(label string) error {
+// Check whether the daemon is ready to serve requests, returning nil if so
+// and an error describing the problem otherwise.
+func (d *Daemon) Ready() error {
+	d.shutdownLock.Lock()
+	shuttingDown := d.shuttingDown
+	d.shutdownLock.Unlock()
+	if shuttingDown {
+		return ErrShuttingDown
+	}
+	return d.state.Ready()
+}
+
+// Mark the daemon as shutting down, so it no longer reports itself as ready.
+// Requests are still served as normal.
+func (d *Daemon) BeginShutdown() {
+	d.shutdownLock.Lock()
+	defer d.shutdownLock.Unlock()
+	d.shuttingDown = true
+}
+
+// Abort any running jobs, stop all webhooks, and stop all OBMs. The daemon
+// must not be used after this is called.
+func (d *Daemon) Close() error {
+	d.Lock()
+	for _, job := range d.jobs {
+		job.cancel()
+	}
+	d.Unlock()
+	d.jobsWG.Wait()
+
 	d.Lock()
 	defer d.Unlock()
-	return d.state.DeleteNode(label)
+	for _, w := range d.webhooks {
+		w.stop()
+	}
+	return d.state.Close()
+}
+
+func (d *Daemon) DeleteNode(ctx context.Context, label string) error {
+	d.Lock()
+	defer d.Unlock()
+	_, exists := d.state.nodes[label]
+	if err := d.state.DeleteNode(label); err != nil {
+		return err
+	}
+	if exists {
+		logging.FromContext(ctx).Info("Deleted node.", "node", label)
+		d.publish(ctx, EventNodeDeleted, label)
+	}
+	return nil
 }
 
-func (d *Daemon) SetNode(label string, info []byte) error {
+func (d *Daemon) SetNode(ctx context.Context, label string, info []byte) error {
 	d.Lock()
 	defer d.Unlock()
 
@@ -42,13 +135,126 @@ func (d *Daemon) SetNode(label string, info []byte) error {
 		return ErrNodeExists
 	}
 	// Create the node.
-	_, err = d.state.NewNode(label, info)
+	node, err := d.state.NewNode(label, info)
+	if err == nil {
+		logging.FromContext(ctx).Info("Registered node.",
+			"node", label, "type", node.Type)
+		d.publish(ctx, EventNodeRegistered, label, "type", node.Type)
+	}
 
 	d.state.check()
 	return err
 }
 
-func (d *Daemon) GetNodeToken(label string) (token.Token, error) {
+// Set the metadata key `key` to `value` on the node with the given label.
+// Returns ErrInvalidMetadata if the key or value is malformed.
+func (d *Daemon) SetNodeMetadata(ctx context.Context, label, key, value string) error {
+	if !validMetadataKey(key) || !validMetadataValue(value) {
+		return ErrInvalidMetadata
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.state.SetNodeMetadata(label, key, value)
+}
+
+// Remove the metadata key `key` from the node with the given label.
+func (d *Daemon) RemoveNodeMetadata(ctx context.Context, label, key string) error {
+	if !validMetadataKey(key) {
+		return ErrInvalidMetadata
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.state.RemoveNodeMetadata(label, key)
+}
+
+// Get information about the nodes whose metadata match `sel`, sorted by
+// label.
+func (d *Daemon) ListNodes(ctx context.Context, sel Selector) []NodeListEntry {
+	d.Lock()
+	defer d.Unlock()
+	entries := []NodeListEntry{}
+	for label, node := range d.state.nodes {
+		if sel.Matches(node.Metadata) {
+			entries = append(entries, NodeListEntry{
+				Label:    label,
+				NodeInfo: node.Info(),
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Label < entries[j].Label
+	})
+	return entries
+}
+
+// Clear the node's system event log.
+func (d *Daemon) ClearNodeSEL(ctx context.Context, label string) error {
+	d.Lock()
+	node, err := d.state.GetNode(label)
+	d.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.runOnNode(ctx, node, "clear_sel", func(ctx context.Context, n *Node) error {
+		obm, ok := n.OBM.(driver.SELReader)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return obm.ClearSEL(ctx)
+	})
+}
+
+// Get the node's hardware inventory, and the time at which it was read from
+// the OBM. If `refresh` is false and the inventory is cached in the database,
+// the cached copy is returned, and `cached` is true. Otherwise, it is read from
+// the OBM, and the cache is updated.
+func (d *Daemon) GetNodeInventory(ctx context.Context, label string, refresh bool) (inv driver.Inventory, readAt time.Time, cached bool, err error) {
+	d.Lock()
+	node, err := d.state.GetNode(label)
+	if err == nil && !refresh {
+		inv, readAt, cached, err = d.state.CachedInventory(label)
+	}
+	d.Unlock()
+	if err != nil || cached {
+		return
+	}
+	err = d.runOnNode(ctx, node, "read_inventory", func(ctx context.Context, n *Node) (err error) {
+		obm, ok := n.OBM.(driver.InventoryReader)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		inv, err = obm.ReadInventory(ctx)
+		return
+	})
+	if err != nil {
+		return
+	}
+	// The cache only has a resolution of one second; truncate this so we
+	// report the same time whether or not we hit the cache.
+	readAt = time.Unix(time.Now().Unix(), 0)
+	d.Lock()
+	defer d.Unlock()
+	if current, _ := d.state.GetNode(label); current != node {
+		// The node was deleted (and maybe re-created) while we
+		// were reading; don't cache the stale inventory.
+		return
+	}
+	err = d.state.CacheInventory(label, inv, readAt)
+	return
+}
+
+// Get information about a node, for the node inspection endpoint.
+func (d *Daemon) GetNodeInfo(ctx context.Context, label string) (info NodeInfo, err error) {
+	d.Lock()
+	defer d.Unlock()
+	node, err := d.state.GetNode(label)
+	if err != nil {
+		return
+	}
+	return node.Info(), nil
+}
+
+func (d *Daemon) GetNodeToken(ctx context.Context, label string) (token.Token, error) {
 	d.Lock()
 	defer d.Unlock()
 	node, err := d.state.GetNode(label)
@@ -59,17 +265,26 @@ func (d *Daemon) GetNodeToken(label string) (token.Token, error) {
 	if err != nil {
 		return token.Token{}, err
 	}
+	tokensIssued.Inc()
+	logging.FromContext(ctx).Info("Issued new token.", "node", label)
+	d.publish(ctx, EventTokenIssued, label)
 	return tok, nil
 }
 
-func (d *Daemon) InvalidateNodeToken(label string) error {
+func (d *Daemon) InvalidateNodeToken(ctx context.Context, label string) error {
 	d.Lock()
 	defer d.Unlock()
 	node, err := d.state.GetNode(label)
 	if err != nil {
 		return err
 	}
-	return node.ClearToken()
+	if err = node.ClearToken(); err != nil {
+		return err
+	}
+	tokensRevoked.Inc()
+	logging.FromContext(ctx).Info("Invalidated token.", "node", label)
+	d.publish(ctx, EventTokenRevoked, label)
+	return nil
 }
 
 // Get the node with the specified label, and check that `tok` is valid for it.
@@ -85,61 +300,214 @@ func (d *Daemon) getNodeWithToken(label string, tok *token.Token) (*Node, error)
 	return node, nil
 }
 
-func (d *Daemon) usingNodeWithToken(label string, tok *token.Token,
-	f func(*Node) error) error {
+// Call `f` on the node with the specified label, after checking that `tok` is
+// valid for it. See runOnNode.
+func (d *Daemon) usingNodeWithToken(ctx context.Context, label string, tok *token.Token,
+	op string, f func(context.Context, *Node) error) error {
 	d.Lock()
-	defer d.Unlock()
 	node, err := d.getNodeWithToken(label, tok)
+	d.Unlock()
 	if err != nil {
 		return err
 	}
-	return f(node)
+	return d.runOnNode(ctx, node, op, f)
 }
 
-func (d *Daemon) DialNodeConsole(label string, tok *token.Token) (io.ReadCloser, error) {
-	d.Lock()
-	defer d.Unlock()
-	node, err := d.getNodeWithToken(label, tok)
+// Call `f` on `node`, after checking that its OBM is not known to be down and
+// its circuit breaker is not open. `f` should do the actual work of talking to
+// the OBM; `op` names the operation for metrics and logging. The context
+// passed to `f` logs the node's label. If `op` is idempotent (see
+// idempotentOps), `f` is retried with backoff if it fails, according to the
+// daemon's RetryPolicy.
+//
+// This must be called *without* holding the daemon's lock, so that slow
+// operations on one node don't hold up everything else. Instead, it holds the
+// node's lock while calling `f` (but not while waiting to retry), so
+// operations on the same node don't overlap.
+func (d *Daemon) runOnNode(ctx context.Context, node *Node, op string, f func(context.Context, *Node) error) error {
+	if err := node.CheckOBM(op); err != nil {
+		return err
+	}
+	probe, err := node.breaker.allow(d.policy, time.Now())
 	if err != nil {
-		return nil, err
+		return err
+	}
+	attempts := 1
+	if idempotentOps[op] && d.policy.Attempts > 1 {
+		attempts = d.policy.Attempts
+	}
+	logCtx := logging.With(ctx, "node", node.Label)
+	delay := d.policy.Backoff
+retry:
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			logging.FromContext(logCtx).Info("Retrying OBM operation.",
+				"operation", op, "attempt", attempt, "delay", delay)
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-ctx.Done():
+				break retry
+			}
+		}
+		err = func() error {
+			node.opLock.Lock()
+			defer node.opLock.Unlock()
+			return observeDriverOp(ctx, node, op, func(ctx context.Context) error {
+				return f(ctx, node)
+			})
+		}()
+		if !isOBMFailure(ctx, err) {
+			break
+		}
+	}
+	node.breaker.record(logCtx, d.policy, time.Now(), probe, err)
+	return err
+}
+
+func (d *Daemon) DialNodeConsole(ctx context.Context, label string, tok *token.Token) (conn io.ReadCloser, err error) {
+	err = d.usingNodeWithToken(ctx, label, tok, "dial_console", func(ctx context.Context, n *Node) (err error) {
+		conn, err = n.OBM.DialConsole(ctx)
+		return
+	})
+	if err != nil {
+		return
 	}
-	return node.OBM.DialConsole()
+	d.publish(ctx, EventConsoleConnected, label)
+	conn = &consoleConn{
+		ReadCloser: conn,
+		onClose: func() {
+			d.publish(ctx, EventConsoleDisconnected, label)
+		},
+	}
+	return
 }
 
-func (d *Daemon) PowerOnNode(label string, tok *token.Token) error {
-	return d.usingNodeWithToken(label, tok, func(n *Node) error {
-		return n.OBM.PowerOn()
+func (d *Daemon) SendNodeConsoleBreak(ctx context.Context, label string, tok *token.Token, sysrq string) error {
+	if !driver.ValidSysRq(sysrq) {
+		return driver.ErrInvalidSysRq
+	}
+	return d.usingNodeWithToken(ctx, label, tok, "console_break", func(ctx context.Context, n *Node) error {
+		obm, ok := n.OBM.(driver.ConsoleBreaker)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return obm.SendBreak(ctx, sysrq)
 	})
 }
 
-func (d *Daemon) PowerOffNode(label string, tok *token.Token) error {
-	return d.usingNodeWithToken(label, tok, func(n *Node) error {
-		return n.OBM.PowerOff()
+func (d *Daemon) SendNodeDiagInterrupt(ctx context.Context, label string, tok *token.Token) error {
+	return d.usingNodeWithToken(ctx, label, tok, "diag_interrupt", func(ctx context.Context, n *Node) error {
+		obm, ok := n.OBM.(driver.DiagInterrupter)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return obm.SendDiagInterrupt(ctx)
 	})
 }
 
-func (d *Daemon) PowerCycleNode(label string, force bool, tok *token.Token) error {
-	return d.usingNodeWithToken(label, tok, func(n *Node) error {
-		return n.OBM.PowerCycle(force)
+func (d *Daemon) IdentifyNode(ctx context.Context, label string, state driver.IdentifyState,
+	duration time.Duration, tok *token.Token) error {
+	return d.usingNodeWithToken(ctx, label, tok, "identify", func(ctx context.Context, n *Node) error {
+		obm, ok := n.OBM.(driver.Identifier)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return obm.Identify(ctx, state, duration)
 	})
 }
 
-func (d *Daemon) SetNodeBootDev(label string, dev string, tok *token.Token) error {
+func (d *Daemon) PowerOnNode(ctx context.Context, label string, tok *token.Token) error {
+	return d.powerActionWithToken(ctx, label, tok, PowerOn, false)
+}
+
+func (d *Daemon) PowerOffNode(ctx context.Context, label string, tok *token.Token) error {
+	return d.powerActionWithToken(ctx, label, tok, PowerOff, false)
+}
+
+func (d *Daemon) PowerCycleNode(ctx context.Context, label string, force bool, tok *token.Token) error {
+	return d.powerActionWithToken(ctx, label, tok, PowerCycle, force)
+}
+
+// Like powerAction, but looks up the node by label, checking that `tok` is
+// valid for it.
+func (d *Daemon) powerActionWithToken(ctx context.Context, label string, tok *token.Token,
+	action PowerAction, force bool) error {
 	d.Lock()
-	defer d.Unlock()
 	node, err := d.getNodeWithToken(label, tok)
+	d.Unlock()
 	if err != nil {
 		return err
 	}
-	return node.OBM.SetBootdev(dev)
+	return d.powerAction(ctx, node, action, force)
+}
+
+func (d *Daemon) SetNodeBootDev(ctx context.Context, label string, dev driver.Bootdev, tok *token.Token) error {
+	return d.usingNodeWithToken(ctx, label, tok, "set_bootdev", func(ctx context.Context, n *Node) error {
+		return n.OBM.SetBootdev(ctx, dev)
+	})
+}
+
+func (d *Daemon) GetNodeBootDev(ctx context.Context, label string, tok *token.Token) (dev driver.Bootdev, err error) {
+	err = d.usingNodeWithToken(ctx, label, tok, "get_bootdev", func(ctx context.Context, n *Node) (err error) {
+		dev, err = n.OBM.GetBootdev(ctx)
+		return
+	})
+	return
 }
 
-func (d *Daemon) GetNodePowerStatus(label string, tok *token.Token) (string, error) {
+func (d *Daemon) GetNodeCapabilities(ctx context.Context, label string, tok *token.Token) (driver.Capabilities, error) {
 	d.Lock()
 	defer d.Unlock()
 	node, err := d.getNodeWithToken(label, tok)
 	if err != nil {
-		return "", err
+		return driver.Capabilities{}, err
 	}
-	return node.OBM.GetPowerStatus()
+	return node.OBM.Capabilities(), nil
+}
+
+func (d *Daemon) GetNodeSensors(ctx context.Context, label string, tok *token.Token) (sensors []driver.Sensor, err error) {
+	err = d.usingNodeWithToken(ctx, label, tok, "read_sensors", func(ctx context.Context, n *Node) (err error) {
+		obm, ok := n.OBM.(driver.SensorReader)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		sensors, err = obm.ReadSensors(ctx)
+		return
+	})
+	return
+}
+
+func (d *Daemon) GetNodeSEL(ctx context.Context, label string, tok *token.Token) (entries []driver.SELEntry, err error) {
+	err = d.usingNodeWithToken(ctx, label, tok, "read_sel", func(ctx context.Context, n *Node) (err error) {
+		obm, ok := n.OBM.(driver.SELReader)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		entries, err = obm.ReadSEL(ctx)
+		return
+	})
+	return
+}
+
+// Get the node's power status. If `refresh` is false and a recent enough
+// status is cached (see Daemon.maxPowerStatusAge), that is returned, and `cached` is
+// true. Otherwise, it is read from the OBM.
+func (d *Daemon) GetNodePowerStatus(ctx context.Context, label string, tok *token.Token, refresh bool) (status driver.PowerStatus, cached bool, err error) {
+	d.Lock()
+	node, err := d.getNodeWithToken(label, tok)
+	d.Unlock()
+	if err != nil {
+		return
+	}
+	if !refresh {
+		if status, cached = cachedPowerStatus(node, d.maxPowerStatusAge); cached {
+			return
+		}
+	}
+	err = d.runOnNode(ctx, node, "power_status", func(ctx context.Context, n *Node) (err error) {
+		status, err = readPowerStatus(ctx, n)
+		return
+	})
+	return
 }
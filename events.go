@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// The types of events published by the daemon.
+const (
+	EventNodeRegistered      = "node.registered"
+	EventNodeDeleted         = "node.deleted"
+	EventTokenIssued         = "token.issued"
+	EventTokenRevoked        = "token.revoked"
+	EventPowerAction         = "power.action"
+	EventPowerChanged        = "power.changed"
+	EventHealthChanged       = "health.changed"
+	EventConsoleConnected    = "console.connected"
+	EventConsoleDisconnected = "console.disconnected"
+)
+
+// How often to check whether nodes' health has changed; see RunHealthWatcher.
+// This is a variable so tests can shorten it.
+var healthWatchInterval = 5 * time.Second
+
+// Something that happened to a node, for reporting to webhooks etc.
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Node string    `json:"node,omitempty"`
+
+	// Details, depending on the type of the event.
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// A subscription to an eventBus.
+type subscription struct {
+	ch     chan Event
+	filter func(Event) bool
+
+	// If true, the subscription ends (i.e. the channel is closed) rather
+	// than missing an event.
+	endOnDrop bool
+}
+
+// Distributes events to subscribers. Publishing never blocks: if a
+// subscriber's buffer is full, it misses the event, or its subscription ends
+// (see subscribe).
+type eventBus struct {
+	lock sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*subscription]struct{})}
+}
+
+// Subscribe to the events for which `filter` returns true, buffering up to
+// `size` of them. If the buffer is full when an event is published, the
+// subscriber misses it, unless `endOnDrop` is true, in which case the
+// subscription ends instead, so that the subscriber can tell it has missed
+// something. Call the returned function to unsubscribe. Either way, the
+// channel is closed once the subscription has ended.
+func (b *eventBus) subscribe(size int, endOnDrop bool, filter func(Event) bool) (<-chan Event, func()) {
+	sub := &subscription{
+		ch:        make(chan Event, size),
+		filter:    filter,
+		endOnDrop: endOnDrop,
+	}
+	b.lock.Lock()
+	b.subs[sub] = struct{}{}
+	b.lock.Unlock()
+	return sub.ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.end(sub)
+	}
+}
+
+// End `sub`, if it hasn't already ended. Must be called with the lock held.
+func (b *eventBus) end(sub *subscription) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Report whether any subscriber is interested in `ev`, i.e. whether it is
+// worth generating.
+func (b *eventBus) wanted(ev Event) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for sub := range b.subs {
+		if sub.filter(ev) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send `ev` to each interested subscriber. Returns the number of subscribers
+// which missed it because their buffers were full, including those whose
+// subscriptions ended as a result.
+func (b *eventBus) publish(ev Event) (dropped int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for sub := range b.subs {
+		if !sub.filter(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			dropped++
+			if sub.endOnDrop {
+				b.end(sub)
+			}
+		}
+	}
+	return dropped
+}
+
+// Publish an event of type `typ` about the node `label`. `kv` are alternating
+// keys and values, for the event's data.
+func (d *Daemon) publish(ctx context.Context, typ, label string, kv ...interface{}) {
+	id, err := newID()
+	if err != nil {
+		logging.FromContext(ctx).Error("Generating event ID.", "err", err)
+		return
+	}
+	ev := Event{
+		ID:   id,
+		Type: typ,
+		Time: time.Now().UTC(),
+		Node: label,
+	}
+	if len(kv) > 0 {
+		ev.Data = make(map[string]interface{}, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			key, _ := kv[i].(string)
+			ev.Data[key] = kv[i+1]
+		}
+	}
+	if dropped := d.events.publish(ev); dropped > 0 {
+		logging.FromContext(ctx).Warn("Event subscribers are falling behind; dropped event.",
+			"event", typ, "subscribers", dropped)
+	}
+}
+
+// Wraps a console connection, publishing an event when it is closed.
+type consoleConn struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (c *consoleConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.ReadCloser.Close()
+}
+
+// Publish events when nodes' health changes, until `ctx` is canceled. Health
+// is tracked by the OBMs themselves (see coordinator.Server.Health); this just
+// checks on it every healthWatchInterval.
+func (d *Daemon) RunHealthWatcher(ctx context.Context) {
+	last := make(map[*Node]driver.HealthState)
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+	for {
+		d.checkHealthChanges(ctx, last)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Compare each node's health to that recorded in `last`, publishing events
+// for any which have changed, and update `last`.
+func (d *Daemon) checkHealthChanges(ctx context.Context, last map[*Node]driver.HealthState) {
+	type change struct {
+		label    string
+		old, new driver.HealthState
+		err      string
+	}
+	var changes []change
+	d.Lock()
+	current := make(map[*Node]bool, len(d.state.nodes))
+	for label, node := range d.state.nodes {
+		current[node] = true
+		health := node.Info().Health
+		if health == nil {
+			continue
+		}
+		old, seen := last[node]
+		last[node] = health.State
+		if seen && old != health.State {
+			changes = append(changes, change{label, old, health.State, health.LastError})
+		}
+	}
+	for node := range last {
+		if !current[node] {
+			delete(last, node)
+		}
+	}
+	d.Unlock()
+	for _, c := range changes {
+		d.publish(ctx, EventHealthChanged, c.label,
+			"state", c.new, "previous_state", c.old, "last_error", c.err)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// The version of the export format written by this version of obmd. Bump this
+// whenever the format changes incompatibly.
+const exportVersion = 1
+
+// Parameters for deriving encryption keys from passphrases.
+const (
+	exportKDF        = "pbkdf2-sha256"
+	exportCipher     = "aes-256-gcm"
+	exportIterations = 600000
+	exportSaltLen    = 16
+
+	// Upper bound on the iteration count we'll accept in a document,
+	// so a malicious one can't tie up the server.
+	maxExportIterations = 10000000
+)
+
+var (
+	ErrInvalidExport = errors.New("Invalid export document.")
+	ErrBadPassphrase = errors.New("Could not decrypt connection info; wrong or missing passphrase.")
+)
+
+// A dump of all of the nodes known to obmd, as produced by Daemon.Export.
+type Export struct {
+	Version int `json:"version"`
+
+	// Set if connection info is encrypted; nil otherwise.
+	Encryption *ExportEncryption `json:"encryption,omitempty"`
+
+	Nodes []ExportedNode `json:"nodes"`
+}
+
+// Describes how the connection info in an Export is encrypted: with a key
+// derived from a passphrase using PBKDF2.
+type ExportEncryption struct {
+	Cipher     string `json:"cipher"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+}
+
+// A single node in an Export. Exactly one of ObmInfo and EncryptedObmInfo is
+// set, depending on whether the export is encrypted.
+type ExportedNode struct {
+	Label string `json:"label"`
+
+	// The node's connection info, as passed when registering it.
+	ObmInfo json.RawMessage `json:"obm_info,omitempty"`
+
+	// The encrypted connection info: a nonce followed by the ciphertext.
+	// The node's label is used as additional authenticated data, so
+	// entries can't be swapped between nodes.
+	EncryptedObmInfo []byte `json:"encrypted_obm_info,omitempty"`
+
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Summary of the changes made by Daemon.Import.
+type ImportResult struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+// Get the AEAD for the encryption parameters `enc`, keyed by `passphrase`.
+func (enc *ExportEncryption) aead(passphrase string) (cipher.AEAD, error) {
+	if enc.Cipher != exportCipher || enc.KDF != exportKDF ||
+		enc.Iterations < 1 || enc.Iterations > maxExportIterations {
+		return nil, ErrInvalidExport
+	}
+	if passphrase == "" {
+		return nil, ErrBadPassphrase
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, enc.Salt, enc.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Dump all nodes, sorted by label. If `passphrase` is non-empty, the nodes'
+// connection info (which includes OBM credentials) is encrypted with it.
+//
+// Console tokens are not included; obmd doesn't persist them, so imported
+// nodes get fresh ones, as they would after a restart.
+func (d *Daemon) Export(ctx context.Context, passphrase string) (*Export, error) {
+	doc := &Export{
+		Version: exportVersion,
+		Nodes:   []ExportedNode{},
+	}
+	var aead cipher.AEAD
+	if passphrase != "" {
+		doc.Encryption = &ExportEncryption{
+			Cipher:     exportCipher,
+			KDF:        exportKDF,
+			Iterations: exportIterations,
+			Salt:       make([]byte, exportSaltLen),
+		}
+		if _, err := rand.Read(doc.Encryption.Salt); err != nil {
+			return nil, err
+		}
+		var err error
+		if aead, err = doc.Encryption.aead(passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for label, node := range d.state.nodes {
+		entry := ExportedNode{
+			Label:    label,
+			Metadata: make(map[string]string, len(node.Metadata)),
+		}
+		for k, v := range node.Metadata {
+			entry.Metadata[k] = v
+		}
+		if aead == nil {
+			entry.ObmInfo = append(json.RawMessage(nil), node.ConnInfo...)
+		} else {
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			entry.EncryptedObmInfo = aead.Seal(nonce, nonce, node.ConnInfo, []byte(label))
+		}
+		doc.Nodes = append(doc.Nodes, entry)
+	}
+	sort.Slice(doc.Nodes, func(i, j int) bool {
+		return doc.Nodes[i].Label < doc.Nodes[j].Label
+	})
+	logging.FromContext(ctx).Info("Exported nodes.",
+		"count", len(doc.Nodes), "encrypted", aead != nil)
+	return doc, nil
+}
+
+// Load the nodes from `doc`, as produced by Export. `passphrase` is needed
+// only if the document is encrypted.
+//
+// Importing is idempotent: nodes which don't exist are created, nodes whose
+// connection info differs are replaced (which invalidates their tokens), and
+// nodes whose metadata differs get the document's metadata. Nodes which
+// aren't in the document are left alone.
+//
+// The whole document is checked before anything is changed, returning
+// ErrInvalidExport or ErrBadPassphrase if there is a problem. The changes are
+// then saved in a single transaction, so if a database error interrupts the
+// import, nothing is changed.
+func (d *Daemon) Import(ctx context.Context, doc *Export, passphrase string) (ImportResult, error) {
+	var result ImportResult
+	if doc.Version != exportVersion {
+		return ImportResult{}, ErrInvalidExport
+	}
+	var aead cipher.AEAD
+	if doc.Encryption != nil {
+		var err error
+		if aead, err = doc.Encryption.aead(passphrase); err != nil {
+			return ImportResult{}, err
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	// Decrypt and validate everything, and work out what needs to change,
+	// before changing anything:
+	imports := make([]nodeImport, 0, len(doc.Nodes))
+	var created, replaced []*Node
+	seen := make(map[string]bool, len(doc.Nodes))
+	for _, entry := range doc.Nodes {
+		if entry.Label == "" || seen[entry.Label] {
+			return ImportResult{}, ErrInvalidExport
+		}
+		seen[entry.Label] = true
+		for k, v := range entry.Metadata {
+			if !validMetadataKey(k) || !validMetadataValue(v) {
+				return ImportResult{}, ErrInvalidExport
+			}
+		}
+		var info []byte
+		switch {
+		case aead == nil && entry.ObmInfo != nil && entry.EncryptedObmInfo == nil:
+			info = entry.ObmInfo
+		case aead != nil && entry.ObmInfo == nil && len(entry.EncryptedObmInfo) >= aead.NonceSize():
+			nonce := entry.EncryptedObmInfo[:aead.NonceSize()]
+			ciphertext := entry.EncryptedObmInfo[aead.NonceSize():]
+			var err error
+			if info, err = aead.Open(nil, nonce, ciphertext, []byte(entry.Label)); err != nil {
+				return ImportResult{}, ErrBadPassphrase
+			}
+		default:
+			return ImportResult{}, ErrInvalidExport
+		}
+		imp := nodeImport{label: entry.Label, metadata: entry.Metadata}
+		if imp.metadata == nil {
+			imp.metadata = map[string]string{}
+		}
+
+		old, err := d.state.GetNode(entry.Label)
+		if err != nil && err != ErrNoSuchNode {
+			return ImportResult{}, err
+		}
+		switch {
+		case old == nil || !sameJSON(old.ConnInfo, info):
+			// The same check as registering the node normally:
+			if imp.node, err = NewNode(d.state.driver, entry.Label, info); err != nil {
+				return ImportResult{}, ErrInvalidExport
+			}
+			if old == nil {
+				created = append(created, imp.node)
+				result.Created++
+			} else {
+				replaced = append(replaced, imp.node)
+				result.Updated++
+			}
+		case !sameMetadata(old.Metadata, imp.metadata):
+			result.Updated++
+		default:
+			result.Unchanged++
+			continue
+		}
+		imports = append(imports, imp)
+	}
+
+	if err := d.state.ImportNodes(imports); err != nil {
+		return ImportResult{}, err
+	}
+	// Replacing a node is deleting it and registering a new one, so
+	// subscribers are told as much; in particular, this ends streams
+	// opened with the old node's token.
+	for _, node := range replaced {
+		d.publish(ctx, EventNodeDeleted, node.Label)
+		d.publish(ctx, EventNodeRegistered, node.Label, "type", node.Type)
+	}
+	for _, node := range created {
+		d.publish(ctx, EventNodeRegistered, node.Label, "type", node.Type)
+	}
+	d.state.check()
+	logging.FromContext(ctx).Info("Imported nodes.",
+		"created", result.Created,
+		"updated", result.Updated,
+		"unchanged", result.Unchanged)
+	return result, nil
+}
+
+// Report whether `a` and `b` are the same JSON, ignoring insignificant
+// whitespace.
+func sameJSON(a, b []byte) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func sameMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
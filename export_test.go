@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/mock"
+	"github.com/CCI-MOC/obmd/token"
+)
+
+// Register some nodes on a fresh daemon, for export.
+func exportTestDaemon(t *testing.T) *Daemon {
+	ctx := context.Background()
+	daemon := newDaemon()
+	for _, label := range []string{"node-1", "node-2"} {
+		info := []byte(`{"type": "ipmi", "info": {"addr": "` + label + `"}}`)
+		if err := daemon.SetNode(ctx, label, info); err != nil {
+			t.Fatal("SetNode:", err)
+		}
+	}
+	if err := daemon.SetNodeMetadata(ctx, "node-1", "rack", "r1"); err != nil {
+		t.Fatal("SetNodeMetadata:", err)
+	}
+	return daemon
+}
+
+// Round-trip a document through JSON, as the CLI and http API do.
+func reencode(t *testing.T, doc *Export) *Export {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal("Encoding export:", err)
+	}
+	var ret Export
+	if err = json.Unmarshal(data, &ret); err != nil {
+		t.Fatal("Decoding export:", err)
+	}
+	return &ret
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	for _, passphrase := range []string{"", "hunter2"} {
+		doc, err := exportTestDaemon(t).Export(ctx, passphrase)
+		if err != nil {
+			t.Fatal("Export:", err)
+		}
+		doc = reencode(t, doc)
+		if (doc.Encryption != nil) != (passphrase != "") || len(doc.Nodes) != 2 {
+			t.Fatalf("Unexpected export: %+v", doc)
+		}
+
+		dest := newDaemon()
+		if passphrase != "" {
+			_, err = dest.Import(ctx, doc, "wrong")
+			if err != ErrBadPassphrase {
+				t.Fatalf("Import with wrong passphrase: wanted %v but got %v",
+					ErrBadPassphrase, err)
+			}
+		}
+		result, err := dest.Import(ctx, doc, passphrase)
+		if err != nil {
+			t.Fatal("Import:", err)
+		}
+		if result != (ImportResult{Created: 2}) {
+			t.Fatalf("Unexpected import result: %+v", result)
+		}
+		info, err := dest.GetNodeInfo(ctx, "node-1")
+		if err != nil {
+			t.Fatal("GetNodeInfo:", err)
+		}
+		if info.Metadata["rack"] != "r1" {
+			t.Fatalf("Metadata not imported: %v", info.Metadata)
+		}
+
+		// Importing again changes nothing:
+		result, err = dest.Import(ctx, doc, passphrase)
+		if err != nil || result != (ImportResult{Unchanged: 2}) {
+			t.Fatalf("Re-import: got %+v, %v", result, err)
+		}
+
+		// ...except where the destination differs:
+		if err = dest.RemoveNodeMetadata(ctx, "node-1", "rack"); err != nil {
+			t.Fatal("RemoveNodeMetadata:", err)
+		}
+		// If any entry is invalid, none of them are applied:
+		bad := reencode(t, doc)
+		bad.Nodes[1].Label = ""
+		if _, err = dest.Import(ctx, bad, passphrase); err != ErrInvalidExport {
+			t.Fatalf("Import with a bad entry: wanted %v but got %v", ErrInvalidExport, err)
+		}
+		if info, err = dest.GetNodeInfo(ctx, "node-1"); err != nil || info.Metadata["rack"] != "" {
+			t.Fatalf("Metadata changed by failed import: %v (error %v)", info.Metadata, err)
+		}
+
+		result, err = dest.Import(ctx, doc, passphrase)
+		if err != nil || result != (ImportResult{Updated: 1, Unchanged: 1}) {
+			t.Fatalf("Re-import after change: got %+v, %v", result, err)
+		}
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	ctx := context.Background()
+	source := exportTestDaemon(t)
+	plain, err := source.Export(ctx, "")
+	if err != nil {
+		t.Fatal("Export:", err)
+	}
+	encrypted, err := source.Export(ctx, "hunter2")
+	if err != nil {
+		t.Fatal("Export:", err)
+	}
+
+	cases := []struct {
+		name     string
+		doc      *Export
+		modify   func(*Export)
+		expected error
+	}{
+		{"bad version", plain, func(doc *Export) { doc.Version = 99 }, ErrInvalidExport},
+		{"duplicate label", plain, func(doc *Export) { doc.Nodes[1].Label = "node-1" }, ErrInvalidExport},
+		{"bad metadata", plain, func(doc *Export) {
+			doc.Nodes[0].Metadata = map[string]string{"bad.": "x"}
+		}, ErrInvalidExport},
+		{"bad obm info", plain, func(doc *Export) {
+			doc.Nodes[1].ObmInfo = json.RawMessage(`{"type": "no-such-driver"}`)
+		}, ErrInvalidExport},
+		{"swapped ciphertext", encrypted, func(doc *Export) {
+			doc.Nodes[0].Label, doc.Nodes[1].Label = doc.Nodes[1].Label, doc.Nodes[0].Label
+		}, ErrBadPassphrase},
+	}
+	for _, v := range cases {
+		doc := reencode(t, v.doc)
+		v.modify(doc)
+		dest := newDaemon()
+		_, err := dest.Import(ctx, doc, "hunter2")
+		if err != v.expected {
+			t.Fatalf("%s: wanted %v but got %v", v.name, v.expected, err)
+		}
+		// Nothing should have been imported:
+		if nodes := dest.ListNodes(ctx, Selector{}); len(nodes) != 0 {
+			t.Fatalf("%s: nodes were imported anyway: %v", v.name, nodes)
+		}
+	}
+}
+
+// Replacing a node on import is reported as deleting it and registering a new
+// one, which ends streams opened with the old node's token.
+func TestImportReplaces(t *testing.T) {
+	ctx := context.Background()
+	doc, err := exportTestDaemon(t).Export(ctx, "")
+	if err != nil {
+		t.Fatal("Export:", err)
+	}
+	dest := newDaemon()
+	if err = dest.SetNode(ctx, "node-1", []byte(`{"type": "ipmi", "info": {"addr": "elsewhere"}}`)); err != nil {
+		t.Fatal("SetNode:", err)
+	}
+	tok, err := dest.GetNodeToken(ctx, "node-1")
+	if err != nil {
+		t.Fatal("GetNodeToken:", err)
+	}
+	stream, unsubscribe, err := dest.SubscribeNodeEventsWithToken(ctx, "node-1", &tok)
+	if err != nil {
+		t.Fatal("SubscribeNodeEventsWithToken:", err)
+	}
+	defer unsubscribe()
+
+	result, err := dest.Import(ctx, doc, "")
+	if err != nil || result != (ImportResult{Created: 1, Updated: 1}) {
+		t.Fatalf("Import: got %+v, %v", result, err)
+	}
+	for _, typ := range []string{EventNodeDeleted, EventNodeRegistered} {
+		if ev := <-stream; ev.Type != typ {
+			t.Fatalf("Wanted a %s event, but got %+v", typ, ev)
+		}
+	}
+	if err = dest.PowerOnNode(ctx, "node-1", &tok); err != token.ErrInvalidToken {
+		t.Fatalf("PowerOnNode with the old token: wanted %v but got %v", token.ErrInvalidToken, err)
+	}
+}
+
+// Importing into an offline State (as -import does) saves the nodes without
+// starting their OBMs.
+func TestImportOffline(t *testing.T) {
+	ctx := context.Background()
+	doc, err := exportTestDaemon(t).Export(ctx, "")
+	if err != nil {
+		t.Fatal("Export:", err)
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	errpanic(migrateSchema(ctx, db, "sqlite3"))
+	registry := driver.Registry{"ipmi": mock.Driver}
+	state, err := NewOfflineState(db, registry)
+	if err != nil {
+		t.Fatal("NewOfflineState:", err)
+	}
+	daemon := NewDaemon(state, testRetryPolicy(), time.Minute)
+	if _, err = daemon.Import(ctx, doc, ""); err != nil {
+		t.Fatal("Import:", err)
+	}
+	for label, node := range state.nodes {
+		if node.ObmCancel != nil {
+			t.Fatalf("OBM for %s was started.", label)
+		}
+	}
+	if err = daemon.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	state, err = NewState(db, registry)
+	if err != nil {
+		t.Fatal("NewState:", err)
+	}
+	defer state.Close()
+	if len(state.nodes) != 2 {
+		t.Fatalf("Wanted 2 nodes after import, but got %v", state.nodes)
+	}
+}
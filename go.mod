@@ -1,9 +1,26 @@
 module github.com/CCI-MOC/obmd
 
+go 1.24.0
+
 require (
 	github.com/caarlos0/env v3.5.0+incompatible
 	github.com/gorilla/mux v1.6.2
 	github.com/kr/pty v1.1.3
 	github.com/lib/pq v1.0.0
 	github.com/mattn/go-sqlite3 v1.9.0
+	github.com/prometheus/client_golang v1.23.2
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/gorilla/context v1.1.2 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.67.5 // indirect
+	github.com/prometheus/procfs v0.19.2 // indirect
+	go.yaml.in/yaml/v2 v2.4.3 // indirect
+	golang.org/x/sys v0.41.0 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
 )
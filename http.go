@@ -2,15 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/CCI-MOC/obmd/adminauth"
 	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
 	"github.com/CCI-MOC/obmd/token"
 )
 
@@ -19,11 +23,67 @@ type PowerCycleArgs struct {
 	Force bool `json:"force"`
 }
 
+// request body for the console break call. The body is optional.
+type ConsoleBreakArgs struct {
+	// The magic SysRq command key to send after the BREAK, if any.
+	SysRq string `json:"sysrq"`
+}
+
 // request body for the set bootdev call
 type SetBootdevArgs struct {
 	Dev string `json:"bootdev"`
+
+	// Defaults to true if omitted, for compatibility with clients that
+	// predate this field.
+	Persistent *bool           `json:"persistent"`
+	Mode       driver.BootMode `json:"mode"`
+}
+
+// request body for the identify call
+type IdentifyArgs struct {
+	State driver.IdentifyState `json:"state"`
+
+	// How long to leave the LED on, in seconds, if State is "on".
+	Duration int `json:"duration"`
+}
+
+// Response body for successful get bootdev requests.
+type BootdevResp struct {
+	Dev        string          `json:"bootdev"`
+	Persistent bool            `json:"persistent"`
+	Mode       driver.BootMode `json:"mode,omitempty"`
+}
+
+// Response body for successful sensor reading requests.
+type SensorsResp struct {
+	Sensors []driver.Sensor `json:"sensors"`
 }
 
+// Response body for successful event log requests.
+type SELResp struct {
+	Entries []driver.SELEntry `json:"entries"`
+
+	// The total number of entries in the log, of which Entries is a
+	// page.
+	Total int `json:"total"`
+}
+
+// Response body for successful inventory requests.
+type InventoryResp struct {
+	Inventory driver.Inventory `json:"inventory"`
+	ReadAt    time.Time        `json:"read_at"`
+	Cached    bool             `json:"cached"`
+}
+
+// Returned by pageParams for malformed pagination parameters.
+var errBadPageParams = errors.New("Invalid offset or limit.")
+
+// Default and maximum number of items returned by paginated requests.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
 // Connection info for an OBM.
 type ConnInfo struct {
 	// The name of the driver to use:
@@ -33,6 +93,62 @@ type ConnInfo struct {
 	Info []byte
 }
 
+// Request body for setting a metadata key.
+type MetadataArgs struct {
+	Value string `json:"value"`
+}
+
+// Response body for successful node list requests.
+type NodesResp struct {
+	Nodes []NodeListEntry `json:"nodes"`
+}
+
+// Request body for bulk power operations. Exactly one of Nodes and Selector
+// must be supplied.
+type BulkPowerArgs struct {
+	Nodes       []string    `json:"nodes,omitempty"`
+	Selector    *string     `json:"selector,omitempty"`
+	Action      PowerAction `json:"action"`
+	Force       bool        `json:"force"`
+	Concurrency int         `json:"concurrency"`
+	StaggerMs   int         `json:"stagger_ms"`
+}
+
+// Response body for bulk power operations.
+type BulkPowerResp struct {
+	Results []BulkPowerResult `json:"results"`
+}
+
+// Response body for schedule list requests.
+type SchedulesResp struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+// Response body for schedule history requests.
+type ScheduleRunsResp struct {
+	Runs []ScheduleRun `json:"runs"`
+}
+
+// Response body for sequence list requests.
+type SequencesResp struct {
+	Sequences []Sequence `json:"sequences"`
+}
+
+// Response body for job list requests.
+type JobsResp struct {
+	Jobs []Job `json:"jobs"`
+}
+
+// Response body for webhook list requests.
+type WebhooksResp struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// Response body for webhook delivery log requests.
+type WebhookDeliveriesResp struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
 // Response body for successful new token requests.
 type TokenResp struct {
 	Token token.Token `json:"token"`
@@ -40,7 +156,36 @@ type TokenResp struct {
 
 // Response body for successful node power status requests.
 type PowerResp struct {
-	Resp string `json:"power_status"`
+	Resp   driver.PowerState `json:"power_status"`
+	Raw    string            `json:"raw_status"`
+	ReadAt time.Time         `json:"read_at"`
+	Cached bool              `json:"cached"`
+}
+
+// Get the http status corresponding to an error returned by a Daemon method.
+func statusForError(err error) int {
+	switch err {
+	case nil:
+		return http.StatusOK
+	case ErrNoSuchNode, ErrNoSuchSchedule, ErrNoSuchSequence, ErrNoSuchJob,
+		ErrNoSuchWebhook, driver.ErrOBMStopped:
+		return http.StatusNotFound
+	case token.ErrInvalidToken:
+		return http.StatusUnauthorized
+	case driver.ErrInvalidBootdev, driver.ErrInvalidBootMode, driver.ErrInvalidIdentify,
+		driver.ErrInvalidSysRq, ErrInvalidMetadata, ErrInvalidSelector, ErrInvalidBulkRequest,
+		ErrInvalidExport, ErrBadPassphrase, ErrInvalidSchedule, ErrInvalidSequence,
+		ErrInvalidWebhook:
+		return http.StatusBadRequest
+	case driver.ErrNotSupported:
+		return http.StatusNotImplemented
+	case driver.ErrConsoleNotConnected, ErrJobFinished:
+		return http.StatusConflict
+	case driver.ErrOBMDown, ErrCircuitOpen:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
 func makeHandler(config *Config, daemon *Daemon) http.Handler {
@@ -50,19 +195,12 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 
 	// Handle the errors returned by Daemon methods, reporting the correct http status.
 	// This calls w.WriteHeader, so headers must be set before calling this method.
-	relayError := func(w http.ResponseWriter, context string, err error) {
-		switch err {
-		case nil:
-			w.WriteHeader(http.StatusOK)
-		case ErrNoSuchNode:
-			w.WriteHeader(http.StatusNotFound)
-		case token.ErrInvalidToken:
-			w.WriteHeader(http.StatusUnauthorized)
-		case driver.ErrInvalidBootdev:
-			w.WriteHeader(http.StatusBadRequest)
-		default:
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Unexpected error returned (%s): %v\n", context, err)
+	relayError := func(w http.ResponseWriter, req *http.Request, context string, err error) {
+		status := statusForError(err)
+		w.WriteHeader(status)
+		if status == http.StatusInternalServerError {
+			logging.FromContext(req.Context()).Error("Unexpected error returned.",
+				"context", context, "err", err)
 		}
 	}
 
@@ -72,11 +210,65 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 		return mux.Vars(req)["node_id"]
 	}
 
+	// Parse the "offset" and "limit" query parameters of a paginated request,
+	// returning an error if either is malformed. Missing parameters take on
+	// default values.
+	pageParams := func(req *http.Request) (offset, limit int, err error) {
+		offset, limit = 0, defaultPageLimit
+		query := req.URL.Query()
+		if v := query.Get("offset"); v != "" {
+			offset, err = strconv.Atoi(v)
+			if err != nil || offset < 0 {
+				return 0, 0, errBadPageParams
+			}
+		}
+		if v := query.Get("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxPageLimit {
+				return 0, 0, errBadPageParams
+			}
+		}
+		return offset, limit, nil
+	}
+
+	// ------ Unauthenticated requests ------
+
+	// Liveness check; if we can answer at all, we're alive.
+	r.Methods("GET").Path("/healthz").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok\n"))
+		})
+
+	// Readiness check.
+	r.Methods("GET").Path("/readyz").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if err := daemon.Ready(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, err)
+				return
+			}
+			w.Write([]byte("ok\n"))
+		})
+
 	// ------ Admin-only requests ------
 
 	// Router for admin-only requests.
 	adminR := adminauth.AdminRouter(config.AdminToken, r)
 
+	// The metrics include node labels and the health of their OBMs, so
+	// they require the admin token unless configured otherwise.
+	metricsR := adminR
+	if config.PublicMetrics {
+		metricsR = r
+	}
+	metricsR.Methods("GET").Path("/metrics").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			daemon.updateHealthMetrics()
+			metricsHandler.ServeHTTP(w, req)
+		})
+
 	// Register a new node, or update the information in an existing one.
 	adminR.Methods("PUT").Path("/node/{node_id}").
 		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -86,19 +278,350 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 				return
 			}
 
-			relayError(w, "daemon.SetNode()", daemon.SetNode(nodeId(req), info))
+			relayError(w, req, "daemon.SetNode()", daemon.SetNode(req.Context(), nodeId(req), info))
+		})
+
+	adminR.Methods("GET").Path("/node/{node_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			info, err := daemon.GetNodeInfo(req.Context(), nodeId(req))
+			if err != nil {
+				relayError(w, req, "daemon.GetNodeInfo()", err)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(&info)
+			}
+		})
+
+	// List nodes, optionally filtered by a metadata selector.
+	adminR.Methods("GET").Path("/nodes").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			sel, err := ParseSelector(req.URL.Query().Get("selector"))
+			if err != nil {
+				relayError(w, req, "ParseSelector()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&NodesResp{
+				Nodes: daemon.ListNodes(req.Context(), sel),
+			})
+		})
+
+	// Apply a power action to many nodes at once.
+	adminR.Methods("POST").Path("/nodes/power").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			args := BulkPowerArgs{Concurrency: defaultBulkConcurrency}
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			results, err := daemon.RunBulkPower(req.Context(), &args)
+			if err != nil {
+				relayError(w, req, "daemon.RunBulkPower()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&BulkPowerResp{Results: results})
+		})
+
+	// Fetch the schedule_id out of a request's captured variables.
+	scheduleId := func(req *http.Request) string {
+		return mux.Vars(req)["schedule_id"]
+	}
+
+	// Decode a ScheduleSpec from a request body.
+	decodeScheduleSpec := func(req *http.Request) (ScheduleSpec, error) {
+		spec := ScheduleSpec{
+			BulkPowerArgs: BulkPowerArgs{Concurrency: defaultBulkConcurrency},
+		}
+		err := json.NewDecoder(req.Body).Decode(&spec)
+		return spec, err
+	}
+
+	// Write a schedule (or an error) as the response.
+	relaySchedule := func(w http.ResponseWriter, req *http.Request, context string, sched Schedule, err error) {
+		if err != nil {
+			relayError(w, req, context, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&sched)
+	}
+
+	adminR.Methods("POST").Path("/schedules").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			spec, err := decodeScheduleSpec(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			sched, err := daemon.CreateSchedule(req.Context(), spec)
+			relaySchedule(w, req, "daemon.CreateSchedule()", sched, err)
+		})
+
+	adminR.Methods("GET").Path("/schedules").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&SchedulesResp{
+				Schedules: daemon.ListSchedules(req.Context()),
+			})
+		})
+
+	adminR.Methods("GET").Path("/schedule/{schedule_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			sched, err := daemon.GetSchedule(req.Context(), scheduleId(req))
+			relaySchedule(w, req, "daemon.GetSchedule()", sched, err)
+		})
+
+	adminR.Methods("PUT").Path("/schedule/{schedule_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			spec, err := decodeScheduleSpec(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			sched, err := daemon.UpdateSchedule(req.Context(), scheduleId(req), spec)
+			relaySchedule(w, req, "daemon.UpdateSchedule()", sched, err)
+		})
+
+	adminR.Methods("DELETE").Path("/schedule/{schedule_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := daemon.DeleteSchedule(req.Context(), scheduleId(req))
+			relayError(w, req, "daemon.DeleteSchedule()", err)
+		})
+
+	adminR.Methods("GET").Path("/schedule/{schedule_id}/runs").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			offset, limit, err := pageParams(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			runs, err := daemon.GetScheduleRuns(req.Context(), scheduleId(req), offset, limit)
+			if err != nil {
+				relayError(w, req, "daemon.GetScheduleRuns()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ScheduleRunsResp{Runs: runs})
+		})
+
+	// Fetch the sequence name out of a request's captured variables.
+	sequenceName := func(req *http.Request) string {
+		return mux.Vars(req)["sequence"]
+	}
+
+	// Write a job (or an error) as the response.
+	relayJob := func(w http.ResponseWriter, req *http.Request, context string, job Job, err error) {
+		if err != nil {
+			relayError(w, req, context, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&job)
+	}
+
+	adminR.Methods("GET").Path("/sequences").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&SequencesResp{
+				Sequences: daemon.ListSequences(req.Context()),
+			})
+		})
+
+	// Create or replace a sequence.
+	adminR.Methods("PUT").Path("/sequence/{sequence}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var seq Sequence
+			err := json.NewDecoder(req.Body).Decode(&seq)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			seq.Name = sequenceName(req)
+			relayError(w, req, "daemon.SetSequence()", daemon.SetSequence(req.Context(), seq))
+		})
+
+	adminR.Methods("GET").Path("/sequence/{sequence}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			seq, err := daemon.GetSequence(req.Context(), sequenceName(req))
+			if err != nil {
+				relayError(w, req, "daemon.GetSequence()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&seq)
+		})
+
+	adminR.Methods("DELETE").Path("/sequence/{sequence}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := daemon.DeleteSequence(req.Context(), sequenceName(req))
+			relayError(w, req, "daemon.DeleteSequence()", err)
+		})
+
+	adminR.Methods("POST").Path("/sequence/{sequence}/run").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			job, err := daemon.StartSequence(req.Context(), sequenceName(req))
+			relayJob(w, req, "daemon.StartSequence()", job, err)
+		})
+
+	adminR.Methods("GET").Path("/jobs").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&JobsResp{
+				Jobs: daemon.ListJobs(req.Context()),
+			})
+		})
+
+	adminR.Methods("GET").Path("/job/{job_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			job, err := daemon.GetJob(req.Context(), mux.Vars(req)["job_id"])
+			relayJob(w, req, "daemon.GetJob()", job, err)
+		})
+
+	// Abort a running job.
+	adminR.Methods("DELETE").Path("/job/{job_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := daemon.CancelJob(req.Context(), mux.Vars(req)["job_id"])
+			relayError(w, req, "daemon.CancelJob()", err)
+		})
+
+	// Fetch the webhook_id out of a request's captured variables.
+	webhookId := func(req *http.Request) string {
+		return mux.Vars(req)["webhook_id"]
+	}
+
+	adminR.Methods("POST").Path("/webhooks").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var spec WebhookSpec
+			err := json.NewDecoder(req.Body).Decode(&spec)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			hook, err := daemon.CreateWebhook(req.Context(), spec)
+			if err != nil {
+				relayError(w, req, "daemon.CreateWebhook()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&hook)
+		})
+
+	adminR.Methods("GET").Path("/webhooks").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&WebhooksResp{
+				Webhooks: daemon.ListWebhooks(req.Context()),
+			})
+		})
+
+	adminR.Methods("GET").Path("/webhook/{webhook_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			hook, err := daemon.GetWebhook(req.Context(), webhookId(req))
+			if err != nil {
+				relayError(w, req, "daemon.GetWebhook()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&hook)
+		})
+
+	adminR.Methods("DELETE").Path("/webhook/{webhook_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := daemon.DeleteWebhook(req.Context(), webhookId(req))
+			relayError(w, req, "daemon.DeleteWebhook()", err)
+		})
+
+	adminR.Methods("GET").Path("/webhook/{webhook_id}/deliveries").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			deliveries, err := daemon.GetWebhookDeliveries(req.Context(), webhookId(req))
+			if err != nil {
+				relayError(w, req, "daemon.GetWebhookDeliveries()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&WebhookDeliveriesResp{Deliveries: deliveries})
+		})
+
+	// Dump all nodes, for loading into another obmd with /import.
+	adminR.Methods("GET").Path("/export").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			doc, err := daemon.Export(req.Context(), config.ExportPassphrase)
+			if err != nil {
+				relayError(w, req, "daemon.Export()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(doc)
+		})
+
+	adminR.Methods("POST").Path("/import").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var doc Export
+			err := json.NewDecoder(req.Body).Decode(&doc)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			result, err := daemon.Import(req.Context(), &doc, config.ExportPassphrase)
+			if err != nil {
+				relayError(w, req, "daemon.Import()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&result)
+		})
+
+	adminR.Methods("PUT").Path("/node/{node_id}/metadata/{key}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args MetadataArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = daemon.SetNodeMetadata(req.Context(), nodeId(req), mux.Vars(req)["key"], args.Value)
+			relayError(w, req, "daemon.SetNodeMetadata()", err)
+		})
+
+	adminR.Methods("DELETE").Path("/node/{node_id}/metadata/{key}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := daemon.RemoveNodeMetadata(req.Context(), nodeId(req), mux.Vars(req)["key"])
+			relayError(w, req, "daemon.RemoveNodeMetadata()", err)
 		})
 
 	adminR.Methods("DELETE").Path("/node/{node_id}").
 		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			relayError(w, "daemon.DeleteNode()", daemon.DeleteNode(nodeId(req)))
+			relayError(w, req, "daemon.DeleteNode()", daemon.DeleteNode(req.Context(), nodeId(req)))
+		})
+
+	adminR.Methods("DELETE").Path("/node/{node_id}/sel").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			relayError(w, req, "daemon.ClearNodeSEL()", daemon.ClearNodeSEL(req.Context(), nodeId(req)))
+		})
+
+	adminR.Methods("GET").Path("/node/{node_id}/inventory").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			refresh := req.URL.Query().Get("refresh") == "true"
+			inv, readAt, cached, err := daemon.GetNodeInventory(req.Context(), nodeId(req), refresh)
+			if err != nil {
+				relayError(w, req, "daemon.GetNodeInventory()", err)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(&InventoryResp{
+					Inventory: inv,
+					ReadAt:    readAt,
+					Cached:    cached,
+				})
+			}
 		})
 
 	adminR.Methods("POST").Path("/node/{node_id}/token").
 		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			tok, err := daemon.GetNodeToken(nodeId(req))
+			tok, err := daemon.GetNodeToken(req.Context(), nodeId(req))
 			if err != nil {
-				relayError(w, "daemon.GetNodeToken()", err)
+				relayError(w, req, "daemon.GetNodeToken()", err)
 			} else {
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(&TokenResp{
@@ -107,10 +630,74 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 			}
 		})
 
+	// Write events to the client as server-sent events, until the client
+	// goes away, the subscription ends, or `last` returns true for an
+	// event.
+	streamEvents := func(w http.ResponseWriter, req *http.Request, events <-chan Event, last func(Event) bool) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flush := func() {
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		flush()
+		keepalive := time.NewTicker(streamKeepaliveInterval)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-keepalive.C:
+				w.Write([]byte(": keepalive\n\n"))
+				flush()
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(&ev)
+				if err != nil {
+					logging.FromContext(req.Context()).Error("Encoding event.", "err", err)
+					return
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+				flush()
+				if last(ev) {
+					return
+				}
+			}
+		}
+	}
+
+	adminR.Methods("GET").Path("/events").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			events, unsubscribe, err := daemon.SubscribeEvents(req.Context(), "")
+			if err != nil {
+				relayError(w, req, "daemon.SubscribeEvents()", err)
+				return
+			}
+			defer unsubscribe()
+			streamEvents(w, req, events, func(Event) bool { return false })
+		})
+
+	adminR.Methods("GET").Path("/node/{node_id}/events").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			events, unsubscribe, err := daemon.SubscribeEvents(req.Context(), nodeId(req))
+			if err != nil {
+				relayError(w, req, "daemon.SubscribeEvents()", err)
+				return
+			}
+			defer unsubscribe()
+			streamEvents(w, req, events, func(ev Event) bool {
+				return ev.Type == EventNodeDeleted
+			})
+		})
+
 	adminR.Methods("DELETE").Path("/node/{node_id}/token").
 		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			err := daemon.InvalidateNodeToken(nodeId(req))
-			relayError(w, "daemon.InvalidateNodeToken()", err)
+			err := daemon.InvalidateNodeToken(req.Context(), nodeId(req))
+			relayError(w, req, "daemon.InvalidateNodeToken()", err)
 		})
 
 	// ------ "Regular user" requests ------
@@ -122,7 +709,7 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 			var tok token.Token
 			err := (&tok).UnmarshalText([]byte(req.URL.Query().Get("token")))
 			if err != nil {
-				relayError(w, "getToken()", err)
+				relayError(w, req, "getToken()", err)
 				return
 			}
 			handler(w, req, &tok)
@@ -131,9 +718,9 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 
 	r.Methods("GET").Path("/node/{node_id}/console").
 		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
-			conn, err := daemon.DialNodeConsole(nodeId(req), tok)
+			conn, err := daemon.DialNodeConsole(req.Context(), nodeId(req), tok)
 			if err != nil {
-				relayError(w, "daemon.DialNodeConsole()", err)
+				relayError(w, req, "daemon.DialNodeConsole()", err)
 			} else {
 				go func() {
 					// Close the obm connection if the client closes the http
@@ -145,6 +732,9 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 					conn.Close()
 				}()
 
+				consoleSessions.Add(1)
+				defer consoleSessions.Add(-1)
+
 				w.Header().Set("Content-Type", "application/octet-stream")
 
 				// Copy stream to the client. Unfortunately we can't just use
@@ -157,6 +747,7 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 					n, err = conn.Read(buf[:])
 					if n != 0 {
 						_, err = w.Write(buf[:n])
+						consoleBytes.Add(float64(n))
 					}
 					if flusher, ok := w.(http.Flusher); ok {
 						flusher.Flush()
@@ -164,11 +755,36 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 				}
 
 				if err != io.EOF {
-					log.Println("Error reading from console:", err)
+					logging.FromContext(req.Context()).Warn("Error reading from console.",
+						"node", nodeId(req), "err", err)
 				}
 			}
 		}))
 
+	// Like the admin version above, but ends when the token is invalidated.
+	r.Methods("GET").Path("/node/{node_id}/events").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			events, unsubscribe, err := daemon.SubscribeNodeEventsWithToken(req.Context(), nodeId(req), tok)
+			if err != nil {
+				relayError(w, req, "daemon.SubscribeNodeEventsWithToken()", err)
+				return
+			}
+			defer unsubscribe()
+			streamEvents(w, req, events, endsTokenStream)
+		}))
+
+	r.Methods("POST").Path("/node/{node_id}/console/break").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			var args ConsoleBreakArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = daemon.SendNodeConsoleBreak(req.Context(), nodeId(req), tok, args.SysRq)
+			relayError(w, req, "daemon.SendNodeConsoleBreak()", err)
+		}))
+
 	r.Methods("POST").Path("/node/{node_id}/power_cycle").
 		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
 			var args PowerCycleArgs
@@ -177,18 +793,37 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			err = daemon.PowerCycleNode(nodeId(req), args.Force, tok)
-			relayError(w, "daemon.PowerCycleNode()", err)
+			err = daemon.PowerCycleNode(req.Context(), nodeId(req), args.Force, tok)
+			relayError(w, req, "daemon.PowerCycleNode()", err)
+		}))
+
+	r.Methods("POST").Path("/node/{node_id}/diag_interrupt").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			err := daemon.SendNodeDiagInterrupt(req.Context(), nodeId(req), tok)
+			relayError(w, req, "daemon.SendNodeDiagInterrupt()", err)
+		}))
+
+	r.Methods("PUT").Path("/node/{node_id}/identify").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			var args IdentifyArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			duration := time.Duration(args.Duration) * time.Second
+			err = daemon.IdentifyNode(req.Context(), nodeId(req), args.State, duration, tok)
+			relayError(w, req, "daemon.IdentifyNode()", err)
 		}))
 
 	r.Methods("POST").Path("/node/{node_id}/power_on").
 		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
-			relayError(w, "daemon.PowerOn()", daemon.PowerOnNode(nodeId(req), tok))
+			relayError(w, req, "daemon.PowerOn()", daemon.PowerOnNode(req.Context(), nodeId(req), tok))
 		}))
 
 	r.Methods("POST").Path("/node/{node_id}/power_off").
 		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
-			relayError(w, "daemon.PowerOff()", daemon.PowerOffNode(nodeId(req), tok))
+			relayError(w, req, "daemon.PowerOff()", daemon.PowerOffNode(req.Context(), nodeId(req), tok))
 		}))
 
 	r.Methods("PUT").Path("/node/{node_id}/boot_device").
@@ -199,21 +834,96 @@ func makeHandler(config *Config, daemon *Daemon) http.Handler {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			err = daemon.SetNodeBootDev(nodeId(req), args.Dev, tok)
-			relayError(w, "daemon.SetNodeBootDev()", err)
+			dev := driver.Bootdev{
+				Dev:        args.Dev,
+				Persistent: args.Persistent == nil || *args.Persistent,
+				Mode:       args.Mode,
+			}
+			err = daemon.SetNodeBootDev(req.Context(), nodeId(req), dev, tok)
+			relayError(w, req, "daemon.SetNodeBootDev()", err)
+		}))
+
+	r.Methods("GET").Path("/node/{node_id}/boot_device").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			dev, err := daemon.GetNodeBootDev(req.Context(), nodeId(req), tok)
+			if err != nil {
+				relayError(w, req, "daemon.GetNodeBootDev()", err)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(&BootdevResp{
+					Dev:        dev.Dev,
+					Persistent: dev.Persistent,
+					Mode:       dev.Mode,
+				})
+			}
+		}))
+
+	r.Methods("GET").Path("/node/{node_id}/capabilities").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			caps, err := daemon.GetNodeCapabilities(req.Context(), nodeId(req), tok)
+			if err != nil {
+				relayError(w, req, "daemon.GetNodeCapabilities()", err)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(&caps)
+			}
+		}))
+
+	r.Methods("GET").Path("/node/{node_id}/sensors").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			sensors, err := daemon.GetNodeSensors(req.Context(), nodeId(req), tok)
+			if err != nil {
+				relayError(w, req, "daemon.GetNodeSensors()", err)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(&SensorsResp{
+					Sensors: sensors,
+				})
+			}
+		}))
+
+	r.Methods("GET").Path("/node/{node_id}/sel").
+		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
+			offset, limit, err := pageParams(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			entries, err := daemon.GetNodeSEL(req.Context(), nodeId(req), tok)
+			if err != nil {
+				relayError(w, req, "daemon.GetNodeSEL()", err)
+				return
+			}
+			resp := SELResp{
+				Entries: []driver.SELEntry{},
+				Total:   len(entries),
+			}
+			if offset < len(entries) {
+				end := offset + limit
+				if end > len(entries) {
+					end = len(entries)
+				}
+				resp.Entries = entries[offset:end]
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&resp)
 		}))
 
 	r.Methods("GET").Path("/node/{node_id}/power_status").
 		Handler(withToken(func(w http.ResponseWriter, req *http.Request, tok *token.Token) {
-			status, err := daemon.GetNodePowerStatus(nodeId(req), tok)
+			refresh := req.URL.Query().Get("refresh") == "true"
+			status, cached, err := daemon.GetNodePowerStatus(req.Context(), nodeId(req), tok, refresh)
 			if err != nil {
-				relayError(w, "daemon.GetNodePowerStatus()", err)
+				relayError(w, req, "daemon.GetNodePowerStatus()", err)
 			} else {
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(&PowerResp{
-					Resp: status,
+					Resp:   status.State,
+					Raw:    status.Raw,
+					ReadAt: status.Time,
+					Cached: cached,
 				})
 			}
 		}))
-	return r
+	return logRequests(instrumentHandler(r))
 }
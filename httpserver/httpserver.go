@@ -4,10 +4,12 @@
 package httpserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 )
 
 // Config captures the http server related configuration from the environment.
@@ -16,6 +18,10 @@ type Config struct {
 	Insecure   bool   `env:"INSECURE" envDefault:"false"`
 	TLSCert    string `env:"TLS_CERT"`
 	TLSKey     string `env:"TLS_KEY"`
+
+	// How long to wait for active requests to finish when shutting down,
+	// before closing their connections.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"10s"`
 }
 
 // Validate the config, returning an error describing any problems which occur.
@@ -74,14 +80,37 @@ func (config *Config) Validate() error {
 // if the handler is nil, http.DefaultServeMux is used. If Run returns, the error
 // will be non-nil.
 func Run(config *Config, handler http.Handler) error {
-	if config.TLSKey == "" {
-		return http.ListenAndServe(config.ListenAddr, handler)
-	} else {
-		return http.ListenAndServeTLS(
-			config.ListenAddr,
-			config.TLSCert,
-			config.TLSKey,
-			handler,
-		)
+	return RunContext(context.Background(), config, handler)
+}
+
+// Like Run, but shut the server down gracefully when ctx is done: the server
+// stops accepting new connections, and waits up to config.ShutdownTimeout for
+// active requests to finish before closing their connections. Returns nil if
+// the server was shut down this way.
+func RunContext(ctx context.Context, config *Config, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: handler,
 	}
+	errs := make(chan error, 1)
+	go func() {
+		if config.TLSKey == "" {
+			errs <- srv.ListenAndServe()
+		} else {
+			errs <- srv.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		}
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// Some requests are still going (most likely console streams);
+		// cut them off.
+		return srv.Close()
+	}
+	return nil
 }
@@ -0,0 +1,26 @@
+package driver
+
+// The firmware interface to use when booting from a device.
+type BootMode string
+
+const (
+	// Leave the choice of boot mode to the driver/OBM.
+	BootModeDefault BootMode = ""
+
+	BootModeLegacy BootMode = "legacy"
+	BootModeUEFI   BootMode = "uefi"
+)
+
+// A node's boot device setting.
+type Bootdev struct {
+	// The boot device. Valid values are driver-dependent, but "none"
+	// always means that the node will use its default boot order.
+	Dev string
+
+	// Whether the setting applies to all future boots (true), or only the
+	// next one (false).
+	Persistent bool
+
+	// The boot mode to use with the device.
+	Mode BootMode
+}
@@ -0,0 +1,37 @@
+package driver
+
+// The operations supported by an OBM. Clients use this to avoid making calls
+// that are bound to fail.
+type Capabilities struct {
+	// Boot devices accepted by OBM.SetBootdev.
+	BootDevices []string `json:"boot_devices"`
+
+	// Boot modes accepted by OBM.SetBootdev, other than
+	// BootModeDefault (which is always accepted).
+	BootModes []BootMode `json:"boot_modes"`
+
+	// Whether the OBM provides a serial console.
+	Console bool `json:"console"`
+
+	// Whether OBM.PowerCycle(false) gives the operating system a chance
+	// to shut down cleanly, rather than behaving like a forced reboot.
+	SoftPowerCycle bool `json:"soft_power_cycle"`
+
+	// Whether the OBM implements SensorReader.
+	Sensors bool `json:"sensors"`
+
+	// Whether the OBM implements SELReader.
+	SEL bool `json:"sel"`
+
+	// Whether the OBM implements InventoryReader.
+	Inventory bool `json:"inventory"`
+
+	// Whether the OBM implements ConsoleBreaker.
+	ConsoleBreak bool `json:"console_break"`
+
+	// Whether the OBM implements DiagInterrupter.
+	DiagInterrupt bool `json:"diag_interrupt"`
+
+	// Whether the OBM implements Identifier.
+	Identify bool `json:"identify"`
+}
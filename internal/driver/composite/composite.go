@@ -0,0 +1,201 @@
+// Package composite implements a driver for nodes whose power and console
+// are managed by different OBMs, e.g. a switched PDU and a serial console
+// server.
+//
+// The info is JSON like:
+//
+//	{
+//	    "power": {"type": powerType, "info": powerInfo},
+//	    "console": {"type": consoleType, "info": consoleInfo}
+//	}
+//
+// where each of "power" and "console" is itself valid info for the registry
+// the driver was created with (see New). Power operations go to the "power"
+// OBM; the console, serial BREAKs and the boot device go to the "console"
+// OBM. Other optional operations (sensors, the SEL, etc.) are not supported.
+package composite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+type compositeDriver struct {
+	drivers driver.Driver
+}
+
+// Get a composite driver, which gets its sub-OBMs from `drivers`, typically
+// a driver.Registry. The registry may include the composite driver itself.
+func New(drivers driver.Driver) driver.Driver {
+	return compositeDriver{drivers: drivers}
+}
+
+type compositeInfo struct {
+	Power   json.RawMessage `json:"power"`
+	Console json.RawMessage `json:"console"`
+}
+
+func (d compositeDriver) GetOBM(info []byte) (driver.OBM, error) {
+	var ci compositeInfo
+	if err := json.Unmarshal(info, &ci); err != nil {
+		return nil, err
+	}
+	if ci.Power == nil || ci.Console == nil {
+		return nil, errors.New("Composite OBM info needs both \"power\" and \"console\".")
+	}
+	power, err := d.drivers.GetOBM(ci.Power)
+	if err != nil {
+		return nil, err
+	}
+	console, err := d.drivers.GetOBM(ci.Console)
+	if err != nil {
+		return nil, err
+	}
+	ret := &obm{power: power, console: console}
+	_, powerHealth := power.(driver.HealthMonitor)
+	_, consoleHealth := console.(driver.HealthMonitor)
+	if powerHealth || consoleHealth {
+		// Only report health if something is checking it; see
+		// monitoredOBM.
+		return monitoredOBM{ret}, nil
+	}
+	return ret, nil
+}
+
+type obm struct {
+	power   driver.OBM
+	console driver.OBM
+}
+
+// Serves both sub-OBMs, returning once they have both stopped.
+func (o *obm) Serve(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, sub := range []driver.OBM{o.power, o.console} {
+		wg.Add(1)
+		go func(sub driver.OBM) {
+			defer wg.Done()
+			sub.Serve(ctx)
+		}(sub)
+	}
+	wg.Wait()
+}
+
+func (o *obm) DialConsole(ctx context.Context) (io.ReadCloser, error) {
+	return o.console.DialConsole(ctx)
+}
+
+func (o *obm) DropConsole() error {
+	return o.console.DropConsole()
+}
+
+func (o *obm) SendBreak(ctx context.Context, sysrq string) error {
+	breaker, ok := o.console.(driver.ConsoleBreaker)
+	if !ok {
+		return driver.ErrNotSupported
+	}
+	return breaker.SendBreak(ctx, sysrq)
+}
+
+func (o *obm) PowerOn(ctx context.Context) error {
+	return o.power.PowerOn(ctx)
+}
+
+func (o *obm) PowerOff(ctx context.Context) error {
+	return o.power.PowerOff(ctx)
+}
+
+func (o *obm) PowerCycle(ctx context.Context, force bool) error {
+	return o.power.PowerCycle(ctx, force)
+}
+
+func (o *obm) GetPowerStatus(ctx context.Context) (driver.PowerStatus, error) {
+	return o.power.GetPowerStatus(ctx)
+}
+
+func (o *obm) SetBootdev(ctx context.Context, dev driver.Bootdev) error {
+	return o.console.SetBootdev(ctx, dev)
+}
+
+func (o *obm) GetBootdev(ctx context.Context) (driver.Bootdev, error) {
+	return o.console.GetBootdev(ctx)
+}
+
+// Each capability comes from the sub-OBM which handles the operation.
+func (o *obm) Capabilities() driver.Capabilities {
+	power := o.power.Capabilities()
+	console := o.console.Capabilities()
+	_, canBreak := o.console.(driver.ConsoleBreaker)
+	return driver.Capabilities{
+		BootDevices:    console.BootDevices,
+		BootModes:      console.BootModes,
+		Console:        console.Console,
+		ConsoleBreak:   console.ConsoleBreak && canBreak,
+		SoftPowerCycle: power.SoftPowerCycle,
+	}
+}
+
+// A composite OBM at least one of whose sub-OBMs runs health checks.
+type monitoredOBM struct {
+	*obm
+}
+
+// Reports the health of whichever sub-OBM is worse off, so that the node is
+// reported as down if either of them is. The power status comes from the power
+// OBM's checks, if any.
+func (o monitoredOBM) Health() driver.Health {
+	var (
+		ret         *driver.Health
+		powerStatus *driver.PowerStatus
+	)
+	for _, sub := range []driver.OBM{o.power, o.console} {
+		monitor, ok := sub.(driver.HealthMonitor)
+		if !ok {
+			continue
+		}
+		health := monitor.Health()
+		if sub == o.power {
+			powerStatus = health.PowerStatus
+		}
+		if ret == nil || healthRank[health.State] > healthRank[ret.State] {
+			ret = &health
+		}
+	}
+	ret.PowerStatus = powerStatus
+	return *ret
+}
+
+// How bad each health state is.
+var healthRank = map[driver.HealthState]int{
+	driver.HealthUp:      0,
+	driver.HealthUnknown: 1,
+	driver.HealthDown:    2,
+}
+
+// Operations which go to the console OBM; everything else goes to the power
+// OBM (or isn't supported).
+var consoleOps = map[string]bool{
+	"dial_console":  true,
+	"console_break": true,
+	"set_bootdev":   true,
+	"get_bootdev":   true,
+}
+
+// Reports the health of the sub-OBM which handles `op`, so that e.g. power
+// operations still work while the console is down. If that sub-OBM isn't
+// health checked, its health is unknown.
+func (o monitoredOBM) HealthFor(op string) driver.Health {
+	sub := o.power
+	if consoleOps[op] {
+		sub = o.console
+	}
+	monitor, ok := sub.(driver.HealthMonitor)
+	if !ok {
+		return driver.Health{State: driver.HealthUnknown}
+	}
+	return monitor.Health()
+}
@@ -0,0 +1,160 @@
+package composite
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
+	"github.com/CCI-MOC/obmd/internal/driver/dummy"
+	"github.com/CCI-MOC/obmd/internal/driver/mock"
+)
+
+// Get a registry with the composite driver, and mock and dummy drivers to
+// build composites from. The mock OBMs are health checked with `health`.
+func newRegistry(health coordinator.HealthConfig) driver.Registry {
+	registry := driver.Registry{
+		"mock":  mock.New(health),
+		"dummy": dummy.Driver,
+	}
+	registry["composite"] = New(registry)
+	return registry
+}
+
+// Get an OBM from the registry, and serve it until the returned function is
+// called.
+func startOBM(t *testing.T, registry driver.Registry, info string) (driver.OBM, func()) {
+	obm, err := registry.GetOBM([]byte(info))
+	if err != nil {
+		t.Fatal("GetOBM:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		obm.Serve(ctx)
+		close(done)
+	}()
+	return obm, func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestComposite(t *testing.T) {
+	ctx := context.Background()
+	obm, stop := startOBM(t, newRegistry(coordinator.DefaultHealthConfig()), `{
+		"type": "composite",
+		"info": {
+			"power": {"type": "mock", "info": {"addr": "composite-pdu"}},
+			"console": {"type": "mock", "info": {"addr": "composite-serial"}}
+		}
+	}`)
+	defer stop()
+
+	// The mock driver records both power actions and boot device changes
+	// by address, so we can see which sub-OBM got each operation:
+	if err := obm.PowerOn(ctx); err != nil {
+		t.Fatal("PowerOn:", err)
+	}
+	if err := obm.SetBootdev(ctx, driver.Bootdev{Dev: "A"}); err != nil {
+		t.Fatal("SetBootdev:", err)
+	}
+	if action := mock.LastPowerActions["composite-pdu"]; action != mock.On {
+		t.Fatalf("Wanted last action on the power OBM to be %q, but got %q", mock.On, action)
+	}
+	if action := mock.LastPowerActions["composite-serial"]; action != mock.BootDevA {
+		t.Fatalf("Wanted last action on the console OBM to be %q, but got %q",
+			mock.BootDevA, action)
+	}
+	status, err := obm.GetPowerStatus(ctx)
+	if err != nil || status.State != driver.PowerOn {
+		t.Fatalf("GetPowerStatus: got %+v (error %v)", status, err)
+	}
+
+	conn, err := obm.DialConsole(ctx)
+	if err != nil {
+		t.Fatal("DialConsole:", err)
+	}
+	if _, err = bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal("Reading console:", err)
+	}
+	before := mock.NumBreaks["composite-serial"]
+	if err = obm.(driver.ConsoleBreaker).SendBreak(ctx, ""); err != nil {
+		t.Fatal("SendBreak:", err)
+	}
+	if mock.NumBreaks["composite-serial"] != before+1 {
+		t.Fatal("BREAK was not sent to the console OBM.")
+	}
+	conn.Close()
+
+	caps := obm.Capabilities()
+	if !caps.Console || !caps.ConsoleBreak || len(caps.BootDevices) != 2 || caps.Sensors {
+		t.Fatalf("Unexpected capabilities: %+v", caps)
+	}
+}
+
+// The dummy driver doesn't support BREAKs, so neither does a composite OBM
+// using it for the console.
+func TestCompositeNoBreak(t *testing.T) {
+	obm, stop := startOBM(t, newRegistry(coordinator.DefaultHealthConfig()), `{
+		"type": "composite",
+		"info": {
+			"power": {"type": "mock", "info": {"addr": "composite-pdu-2"}},
+			"console": {"type": "dummy", "info": {"addr": "localhost:1"}}
+		}
+	}`)
+	defer stop()
+	if obm.Capabilities().ConsoleBreak {
+		t.Fatal("Composite OBM claims to support BREAKs.")
+	}
+	if err := obm.(driver.ConsoleBreaker).SendBreak(context.Background(), ""); err != driver.ErrNotSupported {
+		t.Fatalf("SendBreak: wanted %v but got %v", driver.ErrNotSupported, err)
+	}
+	if _, ok := obm.(driver.HealthMonitor); !ok {
+		t.Fatal("Composite OBM doesn't report the mock OBM's health.")
+	}
+}
+
+func TestCompositeHealth(t *testing.T) {
+	health := coordinator.HealthConfig{Interval: 10 * time.Millisecond, FailureThreshold: 2}
+	obm, stop := startOBM(t, newRegistry(health), `{
+		"type": "composite",
+		"info": {
+			"power": {"type": "mock", "info": {"addr": "composite-pdu-3"}},
+			"console": {"type": "mock", "info": {"addr": "composite-serial-3", "unreachable": true}}
+		}
+	}`)
+	defer stop()
+	monitor := obm.(driver.OpHealthMonitor)
+	for i := 0; monitor.Health().State != driver.HealthDown; i++ {
+		if i == 100 {
+			t.Fatalf("Composite OBM never went down: %+v", monitor.Health())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Only operations on the console OBM are affected:
+	if health := monitor.HealthFor("set_bootdev"); health.State != driver.HealthDown {
+		t.Fatalf("Wanted the console OBM to be down, but got %+v", health)
+	}
+	if health := monitor.HealthFor("power_on"); health.State == driver.HealthDown {
+		t.Fatalf("Wanted the power OBM not to be down, but got %+v", health)
+	}
+}
+
+func TestCompositeBadInfo(t *testing.T) {
+	registry := newRegistry(coordinator.DefaultHealthConfig())
+	for _, info := range []string{
+		`{"type": "composite", "info": {"power": {"type": "mock", "info": {}}}}`,
+		`{"type": "composite", "info": {
+			"power": {"type": "mock", "info": {}},
+			"console": {"type": "nonexistent", "info": {}}
+		}}`,
+		`{"type": "composite", "info": []}`,
+	} {
+		if _, err := registry.GetOBM([]byte(info)); err == nil {
+			t.Fatalf("GetOBM accepted %s", info)
+		}
+	}
+}
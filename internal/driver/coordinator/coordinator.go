@@ -4,33 +4,89 @@ package coordinator
 import (
 	"context"
 	"io"
-	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
 )
 
 // A proc is a live "process" managing a console connection.
 type Proc interface {
 	// Shutdown disconnects the console session managed by this Proc.
 	// If the session is already disconnected, this is a no-op.
-	Shutdown() error
+	Shutdown(ctx context.Context) error
 
 	// Reader returns an io.Reader that reads from the console.
 	Reader() io.Reader
 }
 
+// A Proc which can send a serial BREAK over the console. This is optional;
+// Server.SendBreak returns driver.ErrNotSupported for Procs which don't
+// implement it.
+type BreakSender interface {
+	Proc
+
+	// SendBreak sends a serial BREAK to the node, followed by `sysrq`
+	// if it is not empty. `sysrq` has been checked with
+	// driver.ValidSysRq.
+	SendBreak(ctx context.Context, sysrq string) error
+}
+
 // A "primitive" OBM, from which the coordinator can build a driver.OBM.
 type OBM interface {
 	// Connect to the console, returning the managing Proc and an
 	// error, if any.
-	Dial() (Proc, error)
+	Dial(ctx context.Context) (Proc, error)
+}
+
+// An OBM which can be health checked. This is optional; if the OBM passed to
+// NewServer implements Pinger, the Server will call Ping periodically, and
+// report the results via its Health method.
+type Pinger interface {
+	OBM
+
+	// Check whether the OBM is reachable, by reading its power status.
+	Ping(ctx context.Context) (driver.PowerStatus, error)
+}
+
+// How a Server health checks its OBM, if the OBM implements Pinger.
+type HealthConfig struct {
+	// How often to check. Zero disables health checks.
+	Interval time.Duration
+
+	// The number of consecutive failed checks after which the OBM is
+	// considered down.
+	FailureThreshold int
+}
+
+// The health check settings used by drivers which aren't given any: check
+// every minute, and consider the OBM down after three failures.
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		Interval:         time.Minute,
+		FailureThreshold: 3,
+	}
 }
 
 // A request to connect to the console. If the request succeeds, the connection
 // is sent on `conn`. Otherwise, an error is sent on `err`.
 type consoleReq struct {
+	ctx  context.Context
 	err  chan error
 	conn chan io.ReadCloser
 }
 
+// A request to send a BREAK over the console. The result is sent on `err`,
+// which must be buffered, so the server doesn't block if the requester has
+// given up.
+type breakReq struct {
+	ctx   context.Context
+	sysrq string
+	err   chan error
+}
+
 // A connection to a console.
 type consoleConn struct {
 	drop    chan struct{}
@@ -64,11 +120,31 @@ type Server struct {
 	// Requests to connect to the console.
 	dialConsole chan consoleReq
 
+	// Requests to send a BREAK over the console.
+	sendBreak chan breakReq
+
 	// Requests to run a function atomically within the server.
 	funcs chan func()
+
+	// Closed when Serve returns, so that requests made after that fail
+	// rather than blocking forever.
+	done chan struct{}
+
+	healthInterval  time.Duration
+	healthThreshold int
+
+	// Results of health checks. Unlike the rest of the server's state,
+	// this is protected by a lock rather than owned by the Serve
+	// goroutine, so that Health doesn't have to wait for a running
+	// operation to finish.
+	healthLock sync.Mutex
+	health     driver.Health
 }
 
 func (s *Server) Serve(ctx context.Context) {
+	defer close(s.done)
+	logger := logging.FromContext(ctx)
+
 	conn := &consoleConn{
 		// This won't get used until we over-write `conn` with a
 		// new connection, but we still need it to be non-nil to
@@ -81,16 +157,30 @@ func (s *Server) Serve(ctx context.Context) {
 		err  error
 	)
 
+	// Fires when it's time for the next health check. If the OBM can't
+	// be health checked, healthCheck stays nil, and we never receive
+	// from it.
+	var (
+		healthTimer *time.Timer
+		healthCheck <-chan time.Time
+	)
+	pinger, canPing := s.obm.(Pinger)
+	if canPing && s.healthInterval > 0 {
+		// Spread the first check out over the interval, so that we
+		// don't check every OBM at once on startup.
+		healthTimer = time.NewTimer(time.Duration(rand.Int63n(int64(s.healthInterval))))
+		defer healthTimer.Stop()
+		healthCheck = healthTimer.C
+	}
+
 	stopProcess := func() {
 		if proc == nil {
 			return
 		}
-		if err := proc.Shutdown(); err != nil {
-			log.Println(
-				"Error shutting down obm connection:",
-				err, "continuing, but this could potentially",
-				"cause problems.",
-			)
+		if err := proc.Shutdown(ctx); err != nil {
+			logger.Warn("Error shutting down obm connection; continuing, "+
+				"but this could potentially cause problems.",
+				"err", err)
 		}
 		proc = nil
 	}
@@ -106,9 +196,21 @@ func (s *Server) Serve(ctx context.Context) {
 			stopProcess()
 		case fn := <-s.funcs:
 			fn()
+		case <-healthCheck:
+			status, err := pinger.Ping(ctx)
+			s.recordHealth(ctx, status, err)
+			healthTimer.Reset(s.healthInterval)
+		case req := <-s.sendBreak:
+			if proc == nil {
+				req.err <- driver.ErrConsoleNotConnected
+			} else if breaker, ok := proc.(BreakSender); ok {
+				req.err <- breaker.SendBreak(req.ctx, req.sysrq)
+			} else {
+				req.err <- driver.ErrNotSupported
+			}
 		case req := <-s.dialConsole:
 			stopProcess()
-			proc, err = s.obm.Dial()
+			proc, err = s.obm.Dial(req.ctx)
 			if err != nil {
 				req.err <- err
 				continue
@@ -125,29 +227,86 @@ func (s *Server) Serve(ctx context.Context) {
 	}
 }
 
-// Create a Server for the given OBM.
-func NewServer(obm OBM) *Server {
+// Create a Server for the given OBM, health checking it according to
+// `health`.
+func NewServer(obm OBM, health HealthConfig) *Server {
 	return &Server{
 		obm:         obm,
 		dropConsole: make(chan struct{}),
 		dialConsole: make(chan consoleReq),
+		sendBreak:   make(chan breakReq),
 		funcs:       make(chan func()),
+		done:        make(chan struct{}),
+
+		healthInterval:  health.Interval,
+		healthThreshold: health.FailureThreshold,
+		health: driver.Health{
+			State: driver.HealthUnknown,
+		},
+	}
+}
+
+// Record the result of a health check, logging changes in the OBM's state.
+func (s *Server) recordHealth(ctx context.Context, status driver.PowerStatus, err error) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	now := time.Now()
+	oldState := s.health.State
+	if err == nil {
+		s.health.State = driver.HealthUp
+		s.health.LastSuccess = now
+		s.health.ConsecutiveFailures = 0
+		s.health.PowerStatus = &status
+	} else {
+		s.health.LastFailure = now
+		s.health.LastError = err.Error()
+		s.health.ConsecutiveFailures++
+		if s.health.ConsecutiveFailures >= s.healthThreshold {
+			s.health.State = driver.HealthDown
+		}
+		logging.FromContext(ctx).Debug("Health check failed.",
+			"err", err,
+			"consecutive_failures", s.health.ConsecutiveFailures)
 	}
+	switch {
+	case s.health.State == oldState:
+	case s.health.State == driver.HealthDown:
+		logging.FromContext(ctx).Warn("OBM is down.", "err", err)
+	case oldState == driver.HealthDown:
+		logging.FromContext(ctx).Info("OBM is back up.")
+	}
+}
+
+// Report the results of health checks. See driver.HealthMonitor. If the OBM
+// doesn't implement Pinger, the state is always driver.HealthUnknown.
+func (s *Server) Health() driver.Health {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	return s.health
 }
 
 // Disconnect the current console session. See driver.OBM.DropConsole.
 func (s *Server) DropConsole() error {
-	s.dropConsole <- struct{}{}
+	select {
+	case s.dropConsole <- struct{}{}:
+	case <-s.done:
+		// Serve has already shut down the console.
+	}
 	return nil
 }
 
 // Connect to the console. This see driver.OBM.DialConsole
-func (s *Server) DialConsole() (io.ReadCloser, error) {
+func (s *Server) DialConsole(ctx context.Context) (io.ReadCloser, error) {
 	req := consoleReq{
+		ctx:  ctx,
 		err:  make(chan error),
 		conn: make(chan io.ReadCloser),
 	}
-	s.dialConsole <- req
+	select {
+	case s.dialConsole <- req:
+	case <-s.done:
+		return nil, driver.ErrOBMStopped
+	}
 	select {
 	case err := <-req.err:
 		return nil, err
@@ -156,13 +315,41 @@ func (s *Server) DialConsole() (io.ReadCloser, error) {
 	}
 }
 
+// Send a serial BREAK over the current console session. See
+// driver.ConsoleBreaker.
+func (s *Server) SendBreak(ctx context.Context, sysrq string) error {
+	if !driver.ValidSysRq(sysrq) {
+		return driver.ErrInvalidSysRq
+	}
+	req := breakReq{ctx: ctx, sysrq: sysrq, err: make(chan error, 1)}
+	select {
+	case s.sendBreak <- req:
+	case <-s.done:
+		return driver.ErrOBMStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Run `fn` inside the server's main loop. This ensures that no (other) console
-// related functionality is taken by the server while `fn` is running.
-func (s *Server) RunInServer(fn func()) {
+// related functionality is taken by the server while `fn` is running. Returns
+// driver.ErrOBMStopped without running `fn` if Serve has returned.
+func (s *Server) RunInServer(fn func()) error {
 	done := make(chan struct{})
-	s.funcs <- func() {
+	select {
+	case s.funcs <- func() {
 		fn()
 		done <- struct{}{}
+	}:
+	case <-s.done:
+		return driver.ErrOBMStopped
 	}
 	<-done
+	return nil
 }
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
 )
 
 var Driver driver.Driver = dummyDriver{}
@@ -21,20 +23,32 @@ type dummyDriver struct {
 }
 
 func (dummyDriver) GetOBM(info []byte) (driver.OBM, error) {
-	ret := dummyOBM{}
-	err := json.Unmarshal(info, &ret)
-	ret.PwrStatus = "off"
-	if err != nil {
+	ret := &dummyOBM{
+		pwrStatus: "off",
+		bootdev:   driver.Bootdev{Dev: "none", Persistent: true},
+	}
+	if err := json.Unmarshal(info, ret); err != nil {
 		return nil, err
 	}
-	return &ret, nil
+	return ret, nil
 }
 
 type dummyOBM struct {
-	Addr      string `json:"addr"`
-	PwrStatus string
+	Addr string `json:"addr"`
+
+	// Protects the fields below. DropConsole is called without the lock
+	// that serializes the other operations, so it may run concurrently
+	// with them.
+	lock      sync.Mutex
+	pwrStatus string
+	bootdev   driver.Bootdev
+	conn      net.Conn
+}
 
-	conn net.Conn
+func (d *dummyOBM) String() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return fmt.Sprintf("addr=%s power=%s bootdev=%+v", d.Addr, d.pwrStatus, d.bootdev)
 }
 
 func (d *dummyOBM) Serve(ctx context.Context) {
@@ -43,14 +57,17 @@ func (d *dummyOBM) Serve(ctx context.Context) {
 }
 
 func (d *dummyOBM) DropConsole() error {
-	if d.conn != nil {
-		d.conn = nil
-		return d.conn.Close()
+	d.lock.Lock()
+	conn := d.conn
+	d.conn = nil
+	d.lock.Unlock()
+	if conn != nil {
+		return conn.Close()
 	}
 	return nil
 }
 
-func (d *dummyOBM) DialConsole() (io.ReadCloser, error) {
+func (d *dummyOBM) DialConsole(ctx context.Context) (io.ReadCloser, error) {
 	conn, err := net.Dial("tcp", d.Addr)
 	if err != nil {
 		return nil, err
@@ -60,34 +77,79 @@ func (d *dummyOBM) DialConsole() (io.ReadCloser, error) {
 		conn.Close()
 		return nil, err
 	}
+	d.lock.Lock()
 	d.conn = conn
+	d.lock.Unlock()
 	return conn, nil
 }
 
-func (d *dummyOBM) PowerOn() error {
-	log.Println("Powering on:", d)
-	d.PwrStatus = "on"
+// Set the power status to `status`.
+func (d *dummyOBM) setPower(status string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.pwrStatus = status
+}
+
+func (d *dummyOBM) PowerOn(ctx context.Context) error {
+	logging.FromContext(ctx).Info("Powering on.", "obm", d)
+	d.setPower("on")
 	return nil
 }
 
-func (d *dummyOBM) PowerOff() error {
-	log.Println("Powering off:", d)
-	d.PwrStatus = "off"
+func (d *dummyOBM) PowerOff(ctx context.Context) error {
+	logging.FromContext(ctx).Info("Powering off.", "obm", d)
+	d.setPower("off")
 	return nil
 }
 
-func (d *dummyOBM) PowerCycle(force bool) error {
-	log.Printf("Power cycling: %v (force = %v)\n", d, force)
-	d.PwrStatus = "on"
+func (d *dummyOBM) PowerCycle(ctx context.Context, force bool) error {
+	logging.FromContext(ctx).Info("Power cycling.", "obm", d, "force", force)
+	d.setPower("on")
 	return nil
 }
 
-func (d *dummyOBM) SetBootdev(dev string) error {
-	log.Printf("Setting bootdev = %v: %v\n", dev, d)
+func (d *dummyOBM) SetBootdev(ctx context.Context, dev driver.Bootdev) error {
+	logging.FromContext(ctx).Info("Setting bootdev.", "obm", d, "bootdev", dev)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.bootdev = dev
 	return nil
 }
 
-func (d *dummyOBM) GetPowerStatus() (string, error) {
-	log.Printf("Status = %v: %v\n", d.PwrStatus, d)
-	return d.PwrStatus, nil
+func (d *dummyOBM) GetBootdev(ctx context.Context) (driver.Bootdev, error) {
+	d.lock.Lock()
+	dev := d.bootdev
+	d.lock.Unlock()
+	logging.FromContext(ctx).Info("Getting bootdev.", "obm", d, "bootdev", dev)
+	return dev, nil
+}
+
+// The dummy driver accepts any boot device or mode; these are just the ones
+// we suggest.
+func (d *dummyOBM) Capabilities() driver.Capabilities {
+	return driver.Capabilities{
+		BootDevices:    []string{"none", "disk", "pxe"},
+		BootModes:      []driver.BootMode{driver.BootModeLegacy, driver.BootModeUEFI},
+		Console:        true,
+		SoftPowerCycle: true,
+	}
+}
+
+func (d *dummyOBM) GetPowerStatus(ctx context.Context) (driver.PowerStatus, error) {
+	d.lock.Lock()
+	raw := d.pwrStatus
+	d.lock.Unlock()
+	logging.FromContext(ctx).Info("Getting power status.", "obm", d, "status", raw)
+	state := driver.PowerUnknown
+	switch raw {
+	case "on":
+		state = driver.PowerOn
+	case "off":
+		state = driver.PowerOff
+	}
+	return driver.PowerStatus{
+		State: state,
+		Raw:   raw,
+		Time:  time.Now(),
+	}, nil
 }
@@ -3,5 +3,25 @@ package driver
 import "errors"
 
 var (
-	ErrInvalidBootdev = errors.New("Invalid boot device.")
+	ErrInvalidBootdev  = errors.New("Invalid boot device.")
+	ErrInvalidBootMode = errors.New("Invalid boot mode.")
+	ErrInvalidIdentify = errors.New("Invalid identify state or duration.")
+	ErrInvalidSysRq    = errors.New("Invalid SysRq command key.")
+
+	// Returned for operations which the OBM does not support. See
+	// OBM.Capabilities.
+	ErrNotSupported = errors.New("Operation not supported by this OBM.")
+
+	// Returned for operations which require an active console session,
+	// when there is none.
+	ErrConsoleNotConnected = errors.New("No console session is active.")
+
+	// Returned for operations on an OBM which health checks have
+	// determined to be unreachable. See HealthMonitor.
+	ErrOBMDown = errors.New("The OBM is not responding.")
+
+	// Returned for operations on an OBM which has been shut down (i.e.
+	// its Serve method has returned), e.g. because the node was deleted
+	// while the operation was waiting.
+	ErrOBMStopped = errors.New("The OBM has been shut down.")
 )
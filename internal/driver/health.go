@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"time"
+)
+
+// Whether an OBM is reachable, according to periodic health checks.
+type HealthState string
+
+const (
+	HealthUp   HealthState = "up"
+	HealthDown HealthState = "down"
+
+	// No health check has succeeded yet, and not enough have failed to
+	// declare the OBM down.
+	HealthUnknown HealthState = "unknown"
+)
+
+// The results of an OBM's health checks.
+type Health struct {
+	State HealthState `json:"state"`
+
+	// The times of the most recent successful and failed checks. The zero
+	// value if there has been no such check.
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+
+	// The number of checks that have failed since the last success.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// The error returned by the most recent failed check, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// The power status read by the most recent successful check, if the
+	// checks read it; nil otherwise. This isn't reported to clients
+	// directly, but saves reading the status again soon after a check.
+	PowerStatus *PowerStatus `json:"-"`
+}
+
+// An OBM which periodically checks whether it is reachable. This is
+// optional.
+type HealthMonitor interface {
+	OBM
+
+	// Report the results of the health checks so far.
+	Health() Health
+}
+
+// A HealthMonitor whose operations may be handled by separately checked
+// parts, e.g. a composite OBM's power and console devices. This is optional.
+type OpHealthMonitor interface {
+	HealthMonitor
+
+	// Report the health of whichever part handles the operation `op`,
+	// named as in obmd's metrics, e.g. "power_on" or "dial_console".
+	HealthFor(op string) Health
+}
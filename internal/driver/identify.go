@@ -0,0 +1,14 @@
+package driver
+
+// A requested state for a chassis identify LED.
+type IdentifyState string
+
+const (
+	// Turn the LED on for a limited time.
+	IdentifyOn IdentifyState = "on"
+
+	// Turn the LED on until it is explicitly turned off.
+	IdentifyForceOn IdentifyState = "force-on"
+
+	IdentifyOff IdentifyState = "off"
+)
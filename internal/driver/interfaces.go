@@ -3,37 +3,126 @@ package driver
 import (
 	"context"
 	"io"
+	"time"
 )
 
 // An OBM.
+//
+// Methods which talk to the OBM take a context.Context. This is used for
+// logging (see the logging package), so that e.g. a failed ipmitool invocation
+// can be traced back to the request which caused it.
 type OBM interface {
 	// Manage the OBM. A goroutine executing Serve must be running when
 	// any other OBM method.
 	Serve(ctx context.Context)
 
 	// Connect to the console. Returns the connection and any error.
-	DialConsole() (io.ReadCloser, error)
+	DialConsole(ctx context.Context) (io.ReadCloser, error)
 
 	// Disconnect the current console session, if any.
 	DropConsole() error
 
 	// Power on the node.
-	PowerOn() error
+	PowerOn(ctx context.Context) error
 
 	// Power off the node.
-	PowerOff() error
+	PowerOff(ctx context.Context) error
 
 	// Reboot the node. `force` indicates whether to do a hard power off,
 	// or a soft shutdown (giving the node's operating system a change to
 	// respond).
-	PowerCycle(force bool) error
+	PowerCycle(ctx context.Context, force bool) error
 
-	// Sets the next boot device to `dev`. Valid boot devices are
-	// driver-dependent.
-	SetBootdev(dev string) error
+	// Sets the boot device to `dev`. Valid boot devices are
+	// driver-dependent, and are listed by Capabilities. Drivers
+	// return ErrInvalidBootdev or ErrInvalidBootMode if they cannot
+	// honor the request.
+	SetBootdev(ctx context.Context, dev Bootdev) error
+
+	// Gets the node's current boot device setting.
+	GetBootdev(ctx context.Context) (Bootdev, error)
 
 	// Gets the node's power status.
-	GetPowerStatus() (string, error)
+	GetPowerStatus(ctx context.Context) (PowerStatus, error)
+
+	// Reports the operations supported by the OBM.
+	Capabilities() Capabilities
+}
+
+// An OBM which can report hardware sensor readings. This is optional;
+// Capabilities().Sensors reports whether it is available.
+type SensorReader interface {
+	OBM
+
+	// Read all of the node's sensors.
+	ReadSensors(ctx context.Context) ([]Sensor, error)
+}
+
+// An OBM which provides access to the node's system event log. This is
+// optional; Capabilities().SEL reports whether it is available.
+type SELReader interface {
+	OBM
+
+	// Read all entries in the event log, oldest first.
+	ReadSEL(ctx context.Context) ([]SELEntry, error)
+
+	// Delete all entries in the event log.
+	ClearSEL(ctx context.Context) error
+}
+
+// An OBM which can report the node's hardware inventory. This is optional;
+// Capabilities().Inventory reports whether it is available.
+type InventoryReader interface {
+	OBM
+
+	ReadInventory(ctx context.Context) (Inventory, error)
+}
+
+// An OBM which can send a serial BREAK over the console, e.g. to trigger a
+// magic SysRq on a Linux host. This is optional; Capabilities().ConsoleBreak
+// reports whether it is available.
+type ConsoleBreaker interface {
+	OBM
+
+	// Send a BREAK over the current console session, followed by
+	// `sysrq`, if it is not empty, as the magic SysRq command key.
+	// Returns ErrConsoleNotConnected if there is no session, and
+	// ErrInvalidSysRq if `sysrq` is not valid (see ValidSysRq).
+	SendBreak(ctx context.Context, sysrq string) error
+}
+
+// Report whether `key` may be sent as a magic SysRq command key: either
+// empty (meaning none), or a single ASCII letter or digit.
+func ValidSysRq(key string) bool {
+	if key == "" {
+		return true
+	}
+	if len(key) != 1 {
+		return false
+	}
+	c := key[0]
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// An OBM which can send a diagnostic interrupt (NMI) to the node, e.g. to
+// trigger a crash dump. This is optional; Capabilities().DiagInterrupt
+// reports whether it is available.
+type DiagInterrupter interface {
+	OBM
+
+	SendDiagInterrupt(ctx context.Context) error
+}
+
+// An OBM which can control the node's chassis identify LED. This is
+// optional; Capabilities().Identify reports whether it is available.
+type Identifier interface {
+	OBM
+
+	// Set the state of the identify LED. `duration` is how long to leave
+	// the LED on for IdentifyOn, and is ignored otherwise; if it is zero,
+	// a driver-dependent default is used. Returns ErrInvalidIdentify if
+	// the state or duration is not supported.
+	Identify(ctx context.Context, state IdentifyState, duration time.Duration) error
 }
 
 // A driver for a type of OBM.
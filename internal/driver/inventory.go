@@ -0,0 +1,22 @@
+package driver
+
+// Hardware inventory information for a node. Fields which the OBM doesn't
+// report are left empty.
+type Inventory struct {
+	Manufacturer string `json:"manufacturer"`
+	Product      string `json:"product"`
+	SerialNumber string `json:"serial_number"`
+
+	BoardManufacturer string `json:"board_manufacturer"`
+	BoardProduct      string `json:"board_product"`
+	BoardSerial       string `json:"board_serial"`
+
+	ChassisSerial string `json:"chassis_serial"`
+
+	// The MAC address of the OBM's own network interface.
+	BMCMACAddress string `json:"bmc_mac_address"`
+
+	// MAC addresses of the node's network interfaces. Empty if the OBM
+	// can't report them, as is the case for IPMI.
+	MACAddresses []string `json:"mac_addresses"`
+}
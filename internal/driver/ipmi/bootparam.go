@@ -0,0 +1,92 @@
+package ipmi
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Returned when the output of `ipmitool chassis bootparam get 5` doesn't look
+// like we expect.
+var errBadBootparam = errors.New("Could not parse boot flags from ipmitool output.")
+
+// Maps the "Boot Device Selector" strings printed by ipmitool to the names
+// ipmitool's `chassis bootdev` command accepts for the same device.
+var bootDeviceSelectors = map[string]string{
+	"no override":                        "none",
+	"force pxe":                          "pxe",
+	"force boot from default hard-drive": "disk",
+	"force boot from default hard-drive, request safe-mode":             "safe",
+	"force boot from diagnostic partition":                              "diag",
+	"force boot from cd/dvd":                                            "cdrom",
+	"force boot into bios setup":                                        "bios",
+	"force boot from floppy/primary removable media":                    "floppy",
+	"force boot from remotely connected floppy/primary removable media": "floppy",
+	"force boot from remotely connected cd/dvd":                         "cdrom",
+	"force boot from remotely connected hard-drive":                     "disk",
+}
+
+// Parse the output of `ipmitool chassis bootparam get 5` (the boot flags
+// parameter), which looks like:
+//
+//	Boot parameter version: 1
+//	Boot parameter 5 is valid/unlocked
+//	Boot parameter data: c004000000
+//	 Boot Flags :
+//	   - Boot Flag Valid
+//	   - Options apply to all future boots
+//	   - BIOS PC Compatible (legacy) boot
+//	   - Boot Device Selector : Force PXE
+//	   ...
+//
+// Devices we don't recognize are reported as "unknown".
+func parseBootparam(out string) (driver.Bootdev, error) {
+	var (
+		ret          driver.Bootdev
+		valid        bool
+		haveSelector bool
+	)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "- ") {
+			continue
+		}
+		line = strings.ToLower(strings.TrimPrefix(line, "- "))
+		switch {
+		case line == "boot flag valid":
+			valid = true
+		case line == "options apply to all future boots":
+			ret.Persistent = true
+		case line == "bios pc compatible (legacy) boot":
+			ret.Mode = driver.BootModeLegacy
+		case line == "bios efi boot":
+			ret.Mode = driver.BootModeUEFI
+		case strings.HasPrefix(line, "boot device selector"):
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				return ret, errBadBootparam
+			}
+			dev, ok := bootDeviceSelectors[strings.TrimSpace(parts[1])]
+			if !ok {
+				dev = "unknown"
+			}
+			ret.Dev = dev
+			haveSelector = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ret, err
+	}
+	if !haveSelector {
+		return ret, errBadBootparam
+	}
+	if !valid {
+		// The BMC will ignore the selector, so the node will boot
+		// using its default boot order.
+		ret.Dev = "none"
+	}
+	return ret, nil
+}
@@ -0,0 +1,64 @@
+package ipmi
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Parse "key : value" lines, as printed by `ipmitool fru print` and
+// `ipmitool lan print`, into a map. Keys are lower-cased. Lines without a
+// colon are skipped, and if a key appears more than once, the first value
+// wins.
+func parseKeyValues(out string) (map[string]string, error) {
+	ret := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, ok := ret[key]; !ok {
+			ret[key] = strings.TrimSpace(parts[1])
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// Parse the output of `ipmitool fru print 0` and `ipmitool lan print`.
+// The former looks like:
+//
+//	FRU Device Description : Builtin FRU Device (ID 0)
+//	 Chassis Type          : Rack Mount Chassis
+//	 Chassis Serial        : C8150LH38N50089
+//	 Board Mfg             : Supermicro
+//	 Board Product         : X10DRi
+//	 Board Serial          : NM15CS002312
+//	 Product Manufacturer  : Supermicro
+//	 Product Name          : SYS-1028R-WTR
+//	 Product Serial        : S16071680A08045
+//
+// From the latter, we only use the "MAC Address" line.
+func parseInventory(fruOut, lanOut string) (driver.Inventory, error) {
+	fru, err := parseKeyValues(fruOut)
+	if err != nil {
+		return driver.Inventory{}, err
+	}
+	lan, err := parseKeyValues(lanOut)
+	if err != nil {
+		return driver.Inventory{}, err
+	}
+	return driver.Inventory{
+		Manufacturer:      fru["product manufacturer"],
+		Product:           fru["product name"],
+		SerialNumber:      fru["product serial"],
+		BoardManufacturer: fru["board mfg"],
+		BoardProduct:      fru["board product"],
+		BoardSerial:       fru["board serial"],
+		ChassisSerial:     fru["chassis serial"],
+		BMCMACAddress:     lan["mac address"],
+		MACAddresses:      []string{},
+	}, nil
+}
@@ -2,10 +2,13 @@
 package ipmi
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -14,20 +17,28 @@ import (
 
 	"github.com/CCI-MOC/obmd/internal/driver"
 	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
+	"github.com/CCI-MOC/obmd/logging"
 )
 
-var Driver driver.Driver = impiDriver{}
+var Driver driver.Driver = New(coordinator.DefaultHealthConfig())
 
-type impiDriver struct{}
+// Get an ipmi driver whose OBMs are health checked according to `health`.
+func New(health coordinator.HealthConfig) driver.Driver {
+	return impiDriver{health: health}
+}
+
+type impiDriver struct {
+	health coordinator.HealthConfig
+}
 
-func (impiDriver) GetOBM(info []byte) (driver.OBM, error) {
+func (d impiDriver) GetOBM(info []byte) (driver.OBM, error) {
 	connInfo := &connInfo{}
 	err := json.Unmarshal(info, connInfo)
 	if err != nil {
 		return nil, err
 	}
 	return &server{
-		Server: coordinator.NewServer(connInfo),
+		Server: coordinator.NewServer(connInfo, d.health),
 		info:   connInfo,
 	}, nil
 }
@@ -61,7 +72,7 @@ type server struct {
 // This injects the shutdown command ".~" into the the impitool process's Stdin,
 // and then after a grace period, kills the process. It also runs ipmitool ...
 // sol deactivate which (empirically) is necessary on some OBMs, but not all.
-func (p *ipmitoolProcess) Shutdown() error {
+func (p *ipmitoolProcess) Shutdown(ctx context.Context) error {
 	_, errWrite := p.conn.Write([]byte("~.\n"))
 	errClose := p.conn.Close()
 
@@ -76,7 +87,7 @@ func (p *ipmitoolProcess) Shutdown() error {
 	defer termTimer.Stop()
 	defer killTimer.Stop()
 	p.proc.Wait()
-	errDeactivate := p.info.ipmitool("sol", "deactivate").Run()
+	errDeactivate := p.info.ipmitool(ctx, "sol", "deactivate").Run()
 
 	// TODO: we should probably be a bit more principled about which
 	// error we return here.
@@ -88,12 +99,21 @@ func (p *ipmitoolProcess) Shutdown() error {
 	return errClose
 }
 
+// Send a serial BREAK, using ipmitool's "~B" escape sequence, followed by the
+// SysRq key, if any. ipmitool only recognizes escapes after a CR or LF, and
+// the last thing we sent may have been an earlier BREAK's "~B" (or SysRq
+// key), so we send a CR first.
+func (p *ipmitoolProcess) SendBreak(ctx context.Context, sysrq string) error {
+	_, err := p.conn.Write([]byte("\r~B" + sysrq))
+	return err
+}
+
 func (p *ipmitoolProcess) Reader() io.Reader {
 	return p.conn
 }
 
-func (info *connInfo) Dial() (coordinator.Proc, error) {
-	cmd := info.ipmitool("sol", "activate")
+func (info *connInfo) Dial(ctx context.Context) (coordinator.Proc, error) {
+	cmd := info.ipmitool(ctx, "sol", "activate")
 	stdio, err := pty.Start(cmd)
 	if err != nil {
 		return nil, err
@@ -105,8 +125,33 @@ func (info *connInfo) Dial() (coordinator.Proc, error) {
 	}, nil
 }
 
-// Invoke ipmitool, adding connection parameters corresponding to `info`.
-func (info *connInfo) ipmitool(args ...string) *exec.Cmd {
+// Check that the BMC is reachable, by querying its power status. See
+// coordinator.Pinger.
+func (info *connInfo) Ping(ctx context.Context) (driver.PowerStatus, error) {
+	return info.powerStatus(ctx)
+}
+
+// Read the power status with `ipmitool chassis power status`. Errors include
+// ipmitool's error message.
+func (info *connInfo) powerStatus(ctx context.Context) (driver.PowerStatus, error) {
+	out, err := info.ipmitool(ctx, "chassis", "power", "status").Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if err != nil {
+		return driver.PowerStatus{}, err
+	}
+	status := parsePowerStatus(string(out))
+	status.Time = time.Now()
+	return status, nil
+}
+
+// Invoke ipmitool, adding connection parameters corresponding to `info`. The
+// command is logged (without the credentials) to the logger in `ctx`.
+func (info *connInfo) ipmitool(ctx context.Context, args ...string) *exec.Cmd {
+	logging.FromContext(ctx).Debug("Running ipmitool.",
+		"addr", info.Addr,
+		"args", strings.Join(args, " "))
 	// Annoyingly, when invoking a variadic function f(x ...Foo), you can't
 	// just do Foo(x, y, z, ...more); you need either Foo(x, y, z) or
 	// Foo(...more). We work around this by adding the static arguments to
@@ -120,66 +165,238 @@ func (info *connInfo) ipmitool(args ...string) *exec.Cmd {
 	return exec.Command("ipmitool", args...)
 }
 
+// Run `fn` in the server's main loop, returning its error, or
+// driver.ErrOBMStopped if the server has shut down.
+func (s *server) runInServer(fn func() error) error {
+	var err error
+	if stopErr := s.RunInServer(func() { err = fn() }); stopErr != nil {
+		return stopErr
+	}
+	return err
+}
+
 // Invoke ipmitool in the server's main loop, passing extra arguments
 // with the connection info for this ipmi controller.
-func (s *server) ipmitool(args ...string) (err error) {
-	s.RunInServer(func() {
-		err = s.info.ipmitool(args...).Run()
+func (s *server) ipmitool(ctx context.Context, args ...string) error {
+	return s.runInServer(func() error {
+		return s.info.ipmitool(ctx, args...).Run()
 	})
-	return
 }
 
 // Power on the server.
-func (s *server) PowerOn() error {
-	return s.ipmitool("chassis", "power", "on")
+func (s *server) PowerOn(ctx context.Context) error {
+	return s.ipmitool(ctx, "chassis", "power", "on")
 }
 
 // Power off the server.
-func (s *server) PowerOff() error {
-	return s.ipmitool("chassis", "power", "off")
+func (s *server) PowerOff(ctx context.Context) error {
+	return s.ipmitool(ctx, "chassis", "power", "off")
 }
 
 // Reboot the server. `force` indicates whether to do a forced shutdown, or
 // to give the operating system a chance to respond.
-func (s *server) PowerCycle(force bool) (err error) {
+func (s *server) PowerCycle(ctx context.Context, force bool) (err error) {
 	var op string
 	if force {
 		op = "reset"
 	} else {
 		op = "cycle"
 	}
-	s.RunInServer(func() {
-		err = s.info.ipmitool("chassis", "power", op).Run()
+	err = s.runInServer(func() (err error) {
+		err = s.info.ipmitool(ctx, "chassis", "power", op).Run()
 		if err == nil {
 			return
 		}
 		// The above can fail if the machine is already powered off; in
 		// this case we just turn it on:
-		err = s.info.ipmitool("chassis", "power", "on").Run()
+		logging.FromContext(ctx).Info("Power cycle failed; powering on instead.",
+			"err", err)
+		err = s.info.ipmitool(ctx, "chassis", "power", "on").Run()
+		return
 	})
 	return
 }
 
-// Set the boot device. Legal values are "disk", "pxe", and "none".
-// "none" resets the boot device to the configured default.
-func (s *server) SetBootdev(dev string) error {
-	if dev != "disk" && dev != "pxe" && dev != "none" {
+// Boot devices accepted by SetBootdev. "none" resets the boot device to the
+// configured default, and "floppy" also covers virtual media on most BMCs.
+// This includes every device parseBootparam can report (other than
+// "unknown"), so that GetBootdev's result can always be set again.
+var bootdevs = []string{"none", "disk", "pxe", "cdrom", "bios", "floppy", "safe", "diag"}
+
+// Set the boot device. Legal devices are those in `bootdevs`. The IPMI
+// boot flags always carry a boot mode, so BootModeDefault means legacy.
+func (s *server) SetBootdev(ctx context.Context, dev driver.Bootdev) error {
+	if !validBootdev(dev.Dev) {
 		return driver.ErrInvalidBootdev
 	}
-	return s.ipmitool("chassis", "bootdev", dev, "options=persistent")
+	var options []string
+	if dev.Persistent {
+		options = append(options, "persistent")
+	}
+	switch dev.Mode {
+	case driver.BootModeDefault, driver.BootModeLegacy:
+	case driver.BootModeUEFI:
+		options = append(options, "efiboot")
+	default:
+		return driver.ErrInvalidBootMode
+	}
+	args := []string{"chassis", "bootdev", dev.Dev}
+	if len(options) != 0 {
+		args = append(args, "options="+strings.Join(options, ","))
+	}
+	return s.ipmitool(ctx, args...)
+}
+
+func (s *server) Capabilities() driver.Capabilities {
+	return driver.Capabilities{
+		// A copy, so callers can't modify bootdevs:
+		BootDevices: append([]string(nil), bootdevs...),
+		BootModes:   []driver.BootMode{driver.BootModeLegacy, driver.BootModeUEFI},
+		Console:     true,
+		// `chassis power cycle` is a hard power off and on, so the
+		// OS doesn't get a chance to shut down:
+		SoftPowerCycle: false,
+		Sensors:        true,
+		SEL:            true,
+		Inventory:      true,
+		ConsoleBreak:   true,
+		DiagInterrupt:  true,
+		Identify:       true,
+	}
+}
+
+func validBootdev(dev string) bool {
+	for _, v := range bootdevs {
+		if v == dev {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the server's boot device setting.
+func (s *server) GetBootdev(ctx context.Context) (dev driver.Bootdev, err error) {
+	err = s.runInServer(func() (err error) {
+		var out []byte
+		out, err = s.info.ipmitool(ctx, "chassis", "bootparam", "get", "5").Output()
+		if err != nil {
+			return
+		}
+		dev, err = parseBootparam(string(out))
+		return
+	})
+	return
 }
 
-// Get the server's power status as a string.
-func (s *server) GetPowerStatus() (status string, err error) {
-	s.RunInServer(func() {
+// Read the server's sensors.
+func (s *server) ReadSensors(ctx context.Context) (sensors []driver.Sensor, err error) {
+	err = s.runInServer(func() (err error) {
 		var out []byte
-		out, err = s.info.ipmitool("chassis", "power", "status").Output()
+		out, err = s.info.ipmitool(ctx, "sensor").Output()
+		if err != nil {
+			return
+		}
+		sensors, err = parseSensors(string(out))
+		return
+	})
+	return
+}
 
-		if strings.Contains(string(out), "on") {
-			status = "on"
-		} else {
-			status = "off"
+// Read the server's system event log. ipmitool prints times in our local
+// time zone.
+func (s *server) ReadSEL(ctx context.Context) (entries []driver.SELEntry, err error) {
+	err = s.runInServer(func() (err error) {
+		var out []byte
+		out, err = s.info.ipmitool(ctx, "sel", "elist").Output()
+		if err != nil {
+			return
 		}
+		entries, err = parseSEL(string(out), time.Local)
+		return
 	})
 	return
 }
+
+// Clear the server's system event log.
+func (s *server) ClearSEL(ctx context.Context) error {
+	return s.ipmitool(ctx, "sel", "clear")
+}
+
+// Read the server's hardware inventory from its FRU data. IPMI doesn't tell
+// us about the node's own network interfaces, so only the BMC's MAC address
+// is reported.
+func (s *server) ReadInventory(ctx context.Context) (inv driver.Inventory, err error) {
+	err = s.runInServer(func() (err error) {
+		var fruOut, lanOut []byte
+		fruOut, err = s.info.ipmitool(ctx, "fru", "print", "0").Output()
+		if err != nil {
+			return
+		}
+		// Not every BMC has its LAN settings on the default channel;
+		// the FRU data is what we're really after, so we just go
+		// without the MAC address in that case.
+		lanOut, _ = s.info.ipmitool(ctx, "lan", "print").Output()
+		inv, err = parseInventory(string(fruOut), string(lanOut))
+		return
+	})
+	return
+}
+
+// Send a diagnostic interrupt (NMI) to the server.
+func (s *server) SendDiagInterrupt(ctx context.Context) error {
+	return s.ipmitool(ctx, "chassis", "power", "diag")
+}
+
+// The longest identify interval IPMI can express.
+const maxIdentifyDuration = 255 * time.Second
+
+// Set the state of the server's identify LED. If the duration is zero, the
+// BMC's default (usually 15 seconds) is used.
+func (s *server) Identify(ctx context.Context, state driver.IdentifyState, duration time.Duration) error {
+	var arg string
+	switch state {
+	case driver.IdentifyOn:
+		if duration < 0 || duration > maxIdentifyDuration {
+			return driver.ErrInvalidIdentify
+		}
+		if duration == 0 {
+			return s.ipmitool(ctx, "chassis", "identify")
+		}
+		// Round up, so short durations don't turn the LED off:
+		arg = strconv.Itoa(int((duration + time.Second - 1) / time.Second))
+	case driver.IdentifyForceOn:
+		arg = "force"
+	case driver.IdentifyOff:
+		arg = "0"
+	default:
+		return driver.ErrInvalidIdentify
+	}
+	return s.ipmitool(ctx, "chassis", "identify", arg)
+}
+
+// Get the server's power status.
+func (s *server) GetPowerStatus(ctx context.Context) (status driver.PowerStatus, err error) {
+	err = s.runInServer(func() (err error) {
+		status, err = s.info.powerStatus(ctx)
+		return
+	})
+	return
+}
+
+// Parse the output of `ipmitool chassis power status`, which looks like:
+//
+//	Chassis Power is on
+func parsePowerStatus(out string) driver.PowerStatus {
+	raw := strings.TrimSpace(out)
+	state := driver.PowerUnknown
+	switch strings.ToLower(raw) {
+	case "chassis power is on":
+		state = driver.PowerOn
+	case "chassis power is off":
+		state = driver.PowerOff
+	}
+	return driver.PowerStatus{
+		State: state,
+		Raw:   raw,
+	}
+}
@@ -0,0 +1,299 @@
+package ipmi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
+)
+
+// Test parsing the output of `ipmitool chassis power status`.
+func TestParsePowerStatus(t *testing.T) {
+	cases := []struct {
+		out      string
+		expected driver.PowerState
+	}{
+		{"Chassis Power is on\n", driver.PowerOn},
+		{"Chassis Power is off\n", driver.PowerOff},
+		{"", driver.PowerUnknown},
+		// The old implementation just looked for "on" anywhere in the
+		// output; make sure we don't fall into that trap:
+		{"Chassis Power Control: Down/Off\n", driver.PowerUnknown},
+	}
+	for i, v := range cases {
+		actual := parsePowerStatus(v.out)
+		if actual.State != v.expected {
+			t.Fatalf("cases[%d]: wanted %q but got %q", i, v.expected, actual.State)
+		}
+	}
+}
+
+// Test parsing the output of `ipmitool chassis bootparam get 5`.
+func TestParseBootparam(t *testing.T) {
+	cases := []struct {
+		out      string
+		expected driver.Bootdev
+	}{
+		{
+			`Boot parameter version: 1
+Boot parameter 5 is valid/unlocked
+Boot parameter data: c004000000
+ Boot Flags :
+   - Boot Flag Valid
+   - Options apply to all future boots
+   - BIOS PC Compatible (legacy) boot
+   - Boot Device Selector : Force PXE
+   - Console Redirection control : System Default
+   - BIOS verbosity : Console redirection occurs per BIOS configuration setting (default)
+   - BIOS Mux Control Override : BIOS uses recommended setting of the mux at the end of POST
+`,
+			driver.Bootdev{
+				Dev:        "pxe",
+				Persistent: true,
+				Mode:       driver.BootModeLegacy,
+			},
+		},
+		{
+			`Boot parameter version: 1
+Boot parameter 5 is valid/unlocked
+Boot parameter data: a008000000
+ Boot Flags :
+   - Boot Flag Valid
+   - Options apply to only next boot
+   - BIOS EFI boot
+   - Boot Device Selector : Force Boot from default Hard-Drive
+`,
+			driver.Bootdev{
+				Dev:        "disk",
+				Persistent: false,
+				Mode:       driver.BootModeUEFI,
+			},
+		},
+		{
+			// The selector is ignored if the flags aren't valid:
+			`Boot parameter version: 1
+Boot parameter 5 is valid/unlocked
+Boot parameter data: 0004000000
+ Boot Flags :
+   - Boot Flag Invalid
+   - Options apply to only next boot
+   - BIOS PC Compatible (legacy) boot
+   - Boot Device Selector : Force PXE
+`,
+			driver.Bootdev{
+				Dev:        "none",
+				Persistent: false,
+				Mode:       driver.BootModeLegacy,
+			},
+		},
+	}
+	for i, v := range cases {
+		actual, err := parseBootparam(v.out)
+		if err != nil {
+			t.Fatalf("cases[%d]: unexpected error: %v", i, err)
+		}
+		if actual != v.expected {
+			t.Fatalf("cases[%d]: wanted %v but got %v", i, v.expected, actual)
+		}
+	}
+
+	if _, err := parseBootparam("Error: Unable to establish IPMI v2 / RMCP+ session\n"); err == nil {
+		t.Fatal("parseBootparam should have failed on garbage input.")
+	}
+}
+
+// Every boot device GetBootdev can report (bar "unknown") must be accepted by
+// SetBootdev, so clients can restore a setting they read earlier.
+func TestBootdevsRoundTrip(t *testing.T) {
+	for selector, dev := range bootDeviceSelectors {
+		if !validBootdev(dev) {
+			t.Errorf("%q is reported for %q, but can't be set.", dev, selector)
+		}
+	}
+}
+
+// PowerCycle(false) is a hard power cycle, so it mustn't be advertised as a
+// clean shutdown.
+func TestNoSoftPowerCycle(t *testing.T) {
+	obm, err := New(coordinator.DefaultHealthConfig()).GetOBM([]byte(`{"addr": "10.0.0.4"}`))
+	if err != nil {
+		t.Fatal("GetOBM:", err)
+	}
+	if obm.Capabilities().SoftPowerCycle {
+		t.Fatal("IPMI OBMs claim to support soft power cycles.")
+	}
+}
+
+// Each BREAK must start a new line, or ipmitool won't recognize the escape.
+func TestSendBreak(t *testing.T) {
+	var sent bytes.Buffer
+	p := &ipmitoolProcess{conn: nopCloser{&sent}}
+	ctx := context.Background()
+	for _, sysrq := range []string{"", "t", "b"} {
+		if err := p.SendBreak(ctx, sysrq); err != nil {
+			t.Fatal("SendBreak:", err)
+		}
+	}
+	if want := "\r~B\r~Bt\r~Bb"; sent.String() != want {
+		t.Fatalf("Wanted to send %q but sent %q", want, sent.String())
+	}
+}
+
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Test parsing the output of `ipmitool sensor`.
+func TestParseSensors(t *testing.T) {
+	out := `CPU Temp         | 45.000     | degrees C  | ok    | 0.000     | 0.000     | 0.000     | 95.000    | 100.000   | 100.000
+FAN1             | 300.000    | RPM        | cr    | 300.000   | 500.000   | 700.000   | 25300.000 | 25400.000 | 25500.000
+FAN2             | na         | RPM        | na    | na        | na        | na        | na        | na        | na
+12V              | 12.190     | Volts      | nc    | 10.173    | 10.299    | 10.740    | 12.945    | 13.260    | 13.386
+PS1 Status       | 0x1        | discrete   | 0x0100| na        | na        | na        | na        | na        | na
+Inlet Humidity   | 40.000     | percent    | ok    | na        | na        | na        | na        | na        | na
+`
+	sensors, err := parseSensors(out)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	expected := []struct {
+		name    string
+		typ     driver.SensorType
+		value   float64
+		hasVal  bool
+		unit    string
+		rawUnit string
+		status  driver.SensorStatus
+	}{
+		{"CPU Temp", driver.SensorTemperature, 45, true, "C", "", driver.SensorOK},
+		{"FAN1", driver.SensorFan, 300, true, "RPM", "", driver.SensorCritical},
+		{"FAN2", driver.SensorFan, 0, false, "", "", driver.SensorUnknown},
+		{"12V", driver.SensorVoltage, 12.19, true, "V", "", driver.SensorWarning},
+		{"PS1 Status", driver.SensorDiscrete, 0, false, "", "", driver.SensorUnknown},
+		{"Inlet Humidity", driver.SensorOther, 40, true, "", "percent", driver.SensorOK},
+	}
+	if len(sensors) != len(expected) {
+		t.Fatalf("Wanted %d sensors but got %d: %v", len(expected), len(sensors), sensors)
+	}
+	for i, v := range expected {
+		actual := sensors[i]
+		if actual.Name != v.name || actual.Type != v.typ ||
+			actual.Unit != v.unit || actual.RawUnit != v.rawUnit || actual.Status != v.status {
+			t.Fatalf("sensors[%d]: wanted %v but got %v", i, v, actual)
+		}
+		if (actual.Value != nil) != v.hasVal || (v.hasVal && *actual.Value != v.value) {
+			t.Fatalf("sensors[%d]: wanted value %v but got %v", i, v.value, actual.Value)
+		}
+	}
+}
+
+// Test parsing the output of `ipmitool sel elist`.
+func TestParseSEL(t *testing.T) {
+	out := `   1 | 04/12/2018 | 10:15:32 | Power Supply PS1 Status | Presence detected | Asserted
+   2 | Pre-Init  |0000000012| System Event #0x83 | Timestamp Clock Sync | Asserted
+   3 | 04/12/2018 | 10:16:00 | Temperature CPU Temp | Upper Critical going high | Asserted | Reading 95 > Threshold 90 degrees C
+   4 | 04/12/2018 | 10:17:00 | Temperature CPU Temp | Upper Critical going high | Deasserted
+   5 | 04/12/2018 | 10:18:00 | Temperature CPU Temp | Upper Non-critical going high | Asserted
+`
+	entries, err := parseSEL(out, time.UTC)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	expected := []driver.SELEntry{
+		{
+			ID:       "1",
+			Time:     time.Date(2018, time.April, 12, 10, 15, 32, 0, time.UTC),
+			Severity: driver.SELInfo,
+			Sensor:   "Power Supply PS1 Status",
+			Event:    "Presence detected",
+			Asserted: true,
+		},
+		{
+			ID:       "2",
+			Severity: driver.SELInfo,
+			Sensor:   "System Event #0x83",
+			Event:    "Timestamp Clock Sync",
+			Asserted: true,
+		},
+		{
+			ID:       "3",
+			Time:     time.Date(2018, time.April, 12, 10, 16, 0, 0, time.UTC),
+			Severity: driver.SELCritical,
+			Sensor:   "Temperature CPU Temp",
+			Event:    "Upper Critical going high (Reading 95 > Threshold 90 degrees C)",
+			Asserted: true,
+		},
+		{
+			ID:       "4",
+			Time:     time.Date(2018, time.April, 12, 10, 17, 0, 0, time.UTC),
+			Severity: driver.SELInfo,
+			Sensor:   "Temperature CPU Temp",
+			Event:    "Upper Critical going high",
+			Asserted: false,
+		},
+		{
+			ID:       "5",
+			Time:     time.Date(2018, time.April, 12, 10, 18, 0, 0, time.UTC),
+			Severity: driver.SELWarning,
+			Sensor:   "Temperature CPU Temp",
+			Event:    "Upper Non-critical going high",
+			Asserted: true,
+		},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Wanted %d entries but got %d: %v", len(expected), len(entries), entries)
+	}
+	for i, v := range expected {
+		if entries[i] != v {
+			t.Fatalf("entries[%d]: wanted %v but got %v", i, v, entries[i])
+		}
+	}
+}
+
+// Test parsing the output of `ipmitool fru print 0` and `ipmitool lan print`.
+func TestParseInventory(t *testing.T) {
+	fru := `FRU Device Description : Builtin FRU Device (ID 0)
+ Chassis Type          : Rack Mount Chassis
+ Chassis Part Number   : CSE-116AC10-R706WB
+ Chassis Serial        : C8150LH38N50089
+ Board Mfg Date        : Mon Jan  1 00:00:00 1996
+ Board Mfg             : Supermicro
+ Board Product         : X10DRi
+ Board Serial          : NM15CS002312
+ Product Manufacturer  : Supermicro
+ Product Name          : SYS-1028R-WTR
+ Product Serial        : S16071680A08045
+`
+	lan := `Set in Progress         : Set Complete
+IP Address Source       : Static Address
+IP Address              : 10.0.0.3
+MAC Address             : 0c:c4:7a:3a:1b:2c
+`
+	inv, err := parseInventory(fru, lan)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	expected := driver.Inventory{
+		Manufacturer:      "Supermicro",
+		Product:           "SYS-1028R-WTR",
+		SerialNumber:      "S16071680A08045",
+		BoardManufacturer: "Supermicro",
+		BoardProduct:      "X10DRi",
+		BoardSerial:       "NM15CS002312",
+		ChassisSerial:     "C8150LH38N50089",
+		BMCMACAddress:     "0c:c4:7a:3a:1b:2c",
+		MACAddresses:      []string{},
+	}
+	if !reflect.DeepEqual(inv, expected) {
+		t.Fatalf("Wanted %v but got %v", expected, inv)
+	}
+}
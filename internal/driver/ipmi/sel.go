@@ -0,0 +1,71 @@
+package ipmi
+
+import (
+	"bufio"
+	"strings"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Parse the output of `ipmitool sel elist`, which looks like:
+//
+//	1 | 04/12/2018 | 10:15:32 | Power Supply PS1 Status | Presence detected | Asserted
+//	2 | Pre-Init  |0000000012| System Event #0x83 | Timestamp Clock Sync | Asserted
+//	3 | 04/12/2018 | 10:16:00 | Temperature CPU Temp | Upper Critical going high | Asserted | Reading 95 > Threshold 90 degrees C
+//
+// Times are interpreted in `loc`. Lines which don't have at least the six
+// columns shown above are skipped.
+func parseSEL(out string, loc *time.Location) ([]driver.SELEntry, error) {
+	ret := []driver.SELEntry{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), "|")
+		if len(cols) < 6 {
+			continue
+		}
+		for i := range cols {
+			cols[i] = strings.TrimSpace(cols[i])
+		}
+		entry := driver.SELEntry{
+			ID:       cols[0],
+			Sensor:   cols[3],
+			Event:    cols[4],
+			Asserted: !strings.EqualFold(cols[5], "deasserted"),
+		}
+		if len(cols) > 6 {
+			entry.Event += " (" + strings.Join(cols[6:], "; ") + ")"
+		}
+		// Entries with a "Pre-Init" timestamp have a time relative to
+		// BMC startup in the second column; we just leave those as the
+		// zero value.
+		t, err := time.ParseInLocation("01/02/2006 15:04:05", cols[1]+" "+cols[2], loc)
+		if err == nil {
+			entry.Time = t
+		}
+		entry.Severity = selSeverity(entry)
+		ret = append(ret, entry)
+	}
+	return ret, scanner.Err()
+}
+
+// Make an educated guess at the severity of an event, based on its
+// description. IPMI doesn't record this directly.
+func selSeverity(entry driver.SELEntry) driver.SELSeverity {
+	if !entry.Asserted {
+		return driver.SELInfo
+	}
+	event := strings.ToLower(entry.Event)
+	switch {
+	case strings.Contains(event, "non-critical"),
+		strings.Contains(event, "predictive failure"):
+		return driver.SELWarning
+	case strings.Contains(event, "critical"),
+		strings.Contains(event, "non-recoverable"),
+		strings.Contains(event, "failure"),
+		strings.Contains(event, "fault"),
+		strings.Contains(event, "uncorrectable"):
+		return driver.SELCritical
+	}
+	return driver.SELInfo
+}
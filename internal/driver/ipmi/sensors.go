@@ -0,0 +1,87 @@
+package ipmi
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Maps the units printed by ipmitool to a sensor type and normalized unit.
+var sensorUnits = map[string]struct {
+	typ  driver.SensorType
+	unit string
+}{
+	"degrees c": {driver.SensorTemperature, "C"},
+	"degrees f": {driver.SensorTemperature, "F"},
+	"rpm":       {driver.SensorFan, "RPM"},
+	"volts":     {driver.SensorVoltage, "V"},
+	"amps":      {driver.SensorCurrent, "A"},
+	"watts":     {driver.SensorPower, "W"},
+	"discrete":  {driver.SensorDiscrete, ""},
+}
+
+// Maps the threshold status codes printed by ipmitool to a SensorStatus.
+// The lower/upper distinction is lost; the value tells you which it is.
+var sensorStatuses = map[string]driver.SensorStatus{
+	"ok":  driver.SensorOK,
+	"nc":  driver.SensorWarning,
+	"cr":  driver.SensorCritical,
+	"nr":  driver.SensorNonRecoverable,
+	"lnc": driver.SensorWarning,
+	"unc": driver.SensorWarning,
+	"lcr": driver.SensorCritical,
+	"ucr": driver.SensorCritical,
+	"lnr": driver.SensorNonRecoverable,
+	"unr": driver.SensorNonRecoverable,
+}
+
+// Parse the output of `ipmitool sensor`, which is a table like:
+//
+//	CPU Temp         | 45.000     | degrees C  | ok    | 0.000     | ...
+//	FAN1             | na         | RPM        | na    | na        | ...
+//	PS1 Status       | 0x1        | discrete   | 0x0100| na        | ...
+//
+// Lines which don't have at least the name, value, unit and status columns
+// are skipped.
+func parseSensors(out string) ([]driver.Sensor, error) {
+	ret := []driver.Sensor{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), "|")
+		if len(cols) < 4 {
+			continue
+		}
+		for i := range cols {
+			cols[i] = strings.TrimSpace(cols[i])
+		}
+		sensor := driver.Sensor{
+			Name:   cols[0],
+			Type:   driver.SensorOther,
+			Status: driver.SensorUnknown,
+		}
+		if unit, ok := sensorUnits[strings.ToLower(cols[2])]; ok {
+			sensor.Type = unit.typ
+			sensor.Unit = unit.unit
+		} else {
+			sensor.RawUnit = cols[2]
+		}
+		if sensor.Type != driver.SensorDiscrete {
+			// Discrete sensors report a bitmask of states, which
+			// doesn't mean anything as a number.
+			if value, err := strconv.ParseFloat(cols[1], 64); err == nil {
+				sensor.Value = &value
+			}
+			if status, ok := sensorStatuses[strings.ToLower(cols[3])]; ok {
+				sensor.Status = status
+			}
+		}
+		if sensor.Value == nil {
+			sensor.Unit = ""
+			sensor.RawUnit = ""
+		}
+		ret = append(ret, sensor)
+	}
+	return ret, scanner.Err()
+}
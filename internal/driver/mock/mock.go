@@ -4,27 +4,39 @@
 package mock
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
 	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
 )
 
-var Driver driver.Driver = mockDriver{}
+var Driver driver.Driver = New(coordinator.DefaultHealthConfig())
+
+// Get a mock driver whose OBMs are health checked according to `health`.
+func New(health coordinator.HealthConfig) driver.Driver {
+	return mockDriver{health: health}
+}
 
 type PowerAction string
 
 const (
-	On          PowerAction = "on"
-	Off                     = "off"
-	ForceReboot             = "force-reboot"
-	SoftReboot              = "soft-reboot"
-	BootDevA                = "bootdev-a"
-	BootDevB                = "bootdev-b"
+	On              PowerAction = "on"
+	Off                         = "off"
+	ForceReboot                 = "force-reboot"
+	SoftReboot                  = "soft-reboot"
+	BootDevA                    = "bootdev-a"
+	BootDevB                    = "bootdev-b"
+	DiagInterrupt               = "diag-interrupt"
+	IdentifyOn                  = "identify-on"
+	IdentifyForceOn             = "identify-force-on"
+	IdentifyOff                 = "identify-off"
 )
 
 var (
@@ -32,27 +44,41 @@ var (
 	// that was preformed on the OBM.
 	LastPowerActions     = map[string]PowerAction{}
 	lastPowerActionsLock sync.Mutex
+
+	// A mapping from node addrs to the number of serial BREAKs sent over
+	// the console, and to the SysRq key sent with the last one.
+	NumBreaks     = map[string]int{}
+	LastSysRqs    = map[string]string{}
+	numBreaksLock sync.Mutex
 )
 
 // Mock driver for use in tests
-type mockDriver struct{}
+type mockDriver struct {
+	health coordinator.HealthConfig
+}
 
 type mockInfo struct {
 	Addr      string `json:"addr"`
 	NumWrites int
+
+	// If true, health checks fail.
+	Unreachable bool `json:"unreachable"`
 }
 
 type server struct {
 	*coordinator.Server
-	info mockInfo
+	info    mockInfo
+	bootdev driver.Bootdev
+	sel     []driver.SELEntry
 }
 
 type proc struct {
+	addr string
 	done chan struct{}
 	conn net.Conn
 }
 
-func (p *proc) Shutdown() error {
+func (p *proc) Shutdown(ctx context.Context) error {
 	err := p.conn.Close()
 	<-p.done
 	p.done = nil
@@ -63,20 +89,31 @@ func (p *proc) Reader() io.Reader {
 	return p.conn
 }
 
-func (mockDriver) GetOBM(info []byte) (driver.OBM, error) {
-	ret := &server{}
+func (p *proc) SendBreak(ctx context.Context, sysrq string) error {
+	numBreaksLock.Lock()
+	defer numBreaksLock.Unlock()
+	NumBreaks[p.addr]++
+	LastSysRqs[p.addr] = sysrq
+	return nil
+}
+
+func (d mockDriver) GetOBM(info []byte) (driver.OBM, error) {
+	ret := &server{
+		bootdev: driver.Bootdev{Dev: "none", Persistent: true},
+		sel:     mockSEL(),
+	}
 	err := json.Unmarshal(info, &ret.info)
 	if err != nil {
 		return nil, err
 	}
-	ret.Server = coordinator.NewServer(&ret.info)
+	ret.Server = coordinator.NewServer(&ret.info, d.health)
 	return ret, nil
 }
 
 // Connect to a mock console stream. The stream writes out increasing numeric
 // values 0, 1, 2, 3... one per line, in a loop until the connection is closed.
 // The count is preserved across connections.
-func (info *mockInfo) Dial() (coordinator.Proc, error) {
+func (info *mockInfo) Dial(ctx context.Context) (coordinator.Proc, error) {
 	myConn, theirConn := net.Pipe()
 
 	done := make(chan struct{})
@@ -91,32 +128,68 @@ func (info *mockInfo) Dial() (coordinator.Proc, error) {
 	}()
 
 	return &proc{
+		addr: info.Addr,
 		done: done,
 		conn: theirConn,
 	}, nil
 }
 
+// Health check the mock OBM. This fails if the "unreachable" field was set in
+// the obm info.
+func (info *mockInfo) Ping(ctx context.Context) (driver.PowerStatus, error) {
+	if info.Unreachable {
+		return driver.PowerStatus{}, errors.New("mock OBM is unreachable")
+	}
+	return info.powerStatus(), nil
+}
+
+// Get the power status implied by the last power action on the OBM.
+func (info *mockInfo) powerStatus() driver.PowerStatus {
+	lastPowerActionsLock.Lock()
+	action, ok := LastPowerActions[info.Addr]
+	lastPowerActionsLock.Unlock()
+
+	status := driver.PowerStatus{
+		State: driver.PowerUnknown,
+		Raw:   "Mock Status",
+		Time:  time.Now(),
+	}
+	if !ok {
+		return status
+	}
+	status.Raw = string(action)
+	switch action {
+	case On, ForceReboot, SoftReboot:
+		status.State = driver.PowerOn
+	case Off:
+		status.State = driver.PowerOff
+	}
+	return status
+}
+
 func (s *server) setPowerAction(action PowerAction) {
 	lastPowerActionsLock.Lock()
 	defer lastPowerActionsLock.Unlock()
 	LastPowerActions[s.info.Addr] = action
 }
 
-func (s *server) GetPowerStatus() (string, error) {
-	return "Mock Status", nil
+// Report the power state implied by the last power action performed on the
+// node. The raw status is the name of that action.
+func (s *server) GetPowerStatus(ctx context.Context) (driver.PowerStatus, error) {
+	return s.info.powerStatus(), nil
 }
 
-func (s *server) PowerOn() error {
+func (s *server) PowerOn(ctx context.Context) error {
 	s.setPowerAction(On)
 	return nil
 }
 
-func (s *server) PowerOff() error {
+func (s *server) PowerOff(ctx context.Context) error {
 	s.setPowerAction(Off)
 	return nil
 }
 
-func (s *server) PowerCycle(force bool) error {
+func (s *server) PowerCycle(ctx context.Context, force bool) error {
 	if force {
 		s.setPowerAction(ForceReboot)
 		return nil
@@ -126,14 +199,130 @@ func (s *server) PowerCycle(force bool) error {
 	}
 }
 
-func (s *server) SetBootdev(dev string) error {
-	switch dev {
+func (s *server) SetBootdev(ctx context.Context, dev driver.Bootdev) error {
+	switch dev.Mode {
+	case driver.BootModeDefault, driver.BootModeLegacy, driver.BootModeUEFI:
+	default:
+		return driver.ErrInvalidBootMode
+	}
+	switch dev.Dev {
 	case "A":
 		s.setPowerAction(BootDevA)
-		return nil
 	case "B":
 		s.setPowerAction(BootDevB)
-		return nil
+	default:
+		return driver.ErrInvalidBootdev
+	}
+	s.bootdev = dev
+	return nil
+}
+
+func (s *server) Capabilities() driver.Capabilities {
+	return driver.Capabilities{
+		BootDevices:    []string{"A", "B"},
+		BootModes:      []driver.BootMode{driver.BootModeLegacy, driver.BootModeUEFI},
+		Console:        true,
+		SoftPowerCycle: true,
+		Sensors:        true,
+		SEL:            true,
+		Inventory:      true,
+		ConsoleBreak:   true,
+		DiagInterrupt:  true,
+		Identify:       true,
+	}
+}
+
+// Report a fixed set of synthetic sensor readings.
+func (s *server) ReadSensors(ctx context.Context) ([]driver.Sensor, error) {
+	reading := func(name string, typ driver.SensorType, value float64, unit string) driver.Sensor {
+		return driver.Sensor{
+			Name:   name,
+			Type:   typ,
+			Value:  &value,
+			Unit:   unit,
+			Status: driver.SensorOK,
+		}
+	}
+	return []driver.Sensor{
+		reading("CPU Temp", driver.SensorTemperature, 42, "C"),
+		reading("FAN1", driver.SensorFan, 4200, "RPM"),
+		reading("12V", driver.SensorVoltage, 12.1, "V"),
+		reading("PS1 Input Power", driver.SensorPower, 180, "W"),
+		{
+			Name:   "PS1 Status",
+			Type:   driver.SensorDiscrete,
+			Status: driver.SensorUnknown,
+		},
+	}, nil
+}
+
+func (s *server) GetBootdev(ctx context.Context) (driver.Bootdev, error) {
+	return s.bootdev, nil
+}
+
+// Synthetic event log entries, which every mock node starts out with.
+func mockSEL() []driver.SELEntry {
+	start := time.Date(2018, time.April, 12, 10, 15, 0, 0, time.UTC)
+	entry := func(id int, severity driver.SELSeverity, sensor, event string) driver.SELEntry {
+		return driver.SELEntry{
+			ID:       fmt.Sprint(id),
+			Time:     start.Add(time.Duration(id) * time.Minute),
+			Severity: severity,
+			Sensor:   sensor,
+			Event:    event,
+			Asserted: true,
+		}
+	}
+	return []driver.SELEntry{
+		entry(1, driver.SELInfo, "PS1 Status", "Presence detected"),
+		entry(2, driver.SELWarning, "CPU Temp", "Upper Non-critical going high"),
+		entry(3, driver.SELCritical, "CPU Temp", "Upper Critical going high"),
 	}
-	return driver.ErrInvalidBootdev
+}
+
+func (s *server) ReadSEL(ctx context.Context) ([]driver.SELEntry, error) {
+	return s.sel, nil
+}
+
+func (s *server) ClearSEL(ctx context.Context) error {
+	s.sel = []driver.SELEntry{}
+	return nil
+}
+
+// Report a synthetic inventory. The serial number is derived from the node's
+// address, so different nodes have different inventories.
+func (s *server) ReadInventory(ctx context.Context) (driver.Inventory, error) {
+	return driver.Inventory{
+		Manufacturer:      "Mock Systems",
+		Product:           "Mock Server 9000",
+		SerialNumber:      "MOCK-" + s.info.Addr,
+		BoardManufacturer: "Mock Systems",
+		BoardProduct:      "Mock Board",
+		BoardSerial:       "MOCKBOARD-" + s.info.Addr,
+		ChassisSerial:     "MOCKCHASSIS-" + s.info.Addr,
+		BMCMACAddress:     "02:00:00:00:00:01",
+		MACAddresses:      []string{"02:00:00:00:01:01", "02:00:00:00:01:02"},
+	}, nil
+}
+
+func (s *server) SendDiagInterrupt(ctx context.Context) error {
+	s.setPowerAction(DiagInterrupt)
+	return nil
+}
+
+func (s *server) Identify(ctx context.Context, state driver.IdentifyState, duration time.Duration) error {
+	switch state {
+	case driver.IdentifyOn:
+		if duration < 0 {
+			return driver.ErrInvalidIdentify
+		}
+		s.setPowerAction(IdentifyOn)
+	case driver.IdentifyForceOn:
+		s.setPowerAction(IdentifyForceOn)
+	case driver.IdentifyOff:
+		s.setPowerAction(IdentifyOff)
+	default:
+		return driver.ErrInvalidIdentify
+	}
+	return nil
 }
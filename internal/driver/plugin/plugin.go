@@ -0,0 +1,382 @@
+// Package plugin implements a driver for OBMs managed by external programs
+// ("plugins"), which obmd talks to over their standard input and output. This
+// lets drivers be written, built and shipped separately from obmd.
+//
+// See docs/plugin-protocol.md for the protocol.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// The version of the protocol implemented by this package. It is sent to the
+// plugin in the initialize request.
+const ProtocolVersion = 1
+
+var (
+	// How long to wait for the plugin to answer a request, on top of any
+	// deadline set by the caller.
+	CallTimeout = time.Minute
+
+	// How long to give a plugin to exit, after closing its standard
+	// input, before killing it.
+	ExitTimeout = 5 * time.Second
+)
+
+type pluginDriver struct {
+	health coordinator.HealthConfig
+	path   string
+	args   []string
+}
+
+// Get a driver which runs the executable at `path`, with arguments `args`,
+// for each node. OBMs are health checked according to `health`.
+func New(health coordinator.HealthConfig, path string, args ...string) driver.Driver {
+	return pluginDriver{health: health, path: path, args: args}
+}
+
+// Get a driver for each executable in `dir`, keyed by the executable's name.
+// Hidden files, directories and non-executable files are skipped. See New.
+func Load(dir string, health coordinator.HealthConfig) (map[string]driver.Driver, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]driver.Driver)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !entry.Mode().IsRegular() || entry.Mode()&0111 == 0 {
+			continue
+		}
+		ret[name] = New(health, filepath.Join(dir, name))
+	}
+	return ret, nil
+}
+
+// The info is passed through to the plugin as-is; it only has to be valid
+// JSON.
+func (d pluginDriver) GetOBM(info []byte) (driver.OBM, error) {
+	if !json.Valid(info) {
+		return nil, errors.New("Plugin OBM info is not valid JSON.")
+	}
+	p := &plugin{
+		path: d.path,
+		args: d.args,
+		info: json.RawMessage(append([]byte{}, info...)),
+	}
+	return &server{
+		Server: coordinator.NewServer(p, d.health),
+		plugin: p,
+	}, nil
+}
+
+// A node's plugin process, which is started when first needed, and restarted
+// if it exits.
+type plugin struct {
+	path string
+	args []string
+	info json.RawMessage
+
+	lock sync.Mutex
+	proc *process
+
+	// Reported by the plugin when it started. This has its own lock, since
+	// `lock` is held while the plugin starts up, and reading the
+	// capabilities shouldn't wait for that.
+	capsLock sync.Mutex
+	caps     driver.Capabilities
+
+	// Set once the OBM has been shut down.
+	stopped bool
+}
+
+// The parameters of the initialize request.
+type initParams struct {
+	ProtocolVersion int             `json:"protocol_version"`
+	Info            json.RawMessage `json:"info"`
+}
+
+// The result of the initialize request.
+type initResult struct {
+	Capabilities driver.Capabilities `json:"capabilities"`
+}
+
+// Get the running plugin process, starting it if need be.
+func (p *plugin) running(ctx context.Context) (*process, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped {
+		return nil, driver.ErrOBMStopped
+	}
+	if p.proc != nil {
+		select {
+		case <-p.proc.exited:
+			logging.FromContext(ctx).Warn("Plugin exited; restarting it.",
+				"plugin", p.path, "err", p.proc.err)
+		default:
+			return p.proc, nil
+		}
+	}
+	proc, err := startProcess(ctx, p.path, p.args)
+	if err != nil {
+		return nil, err
+	}
+	var result initResult
+	err = proc.call(ctx, "initialize", initParams{
+		ProtocolVersion: ProtocolVersion,
+		Info:            p.info,
+	}, &result)
+	if err != nil {
+		proc.stop()
+		return nil, fmt.Errorf("Initializing plugin: %v", err)
+	}
+	p.proc = proc
+	p.capsLock.Lock()
+	p.caps = result.Capabilities
+	p.capsLock.Unlock()
+	return proc, nil
+}
+
+// Send a request to the plugin, starting it if need be. See process.call.
+func (p *plugin) call(ctx context.Context, method string, params, result interface{}) error {
+	proc, err := p.running(ctx)
+	if err != nil {
+		return err
+	}
+	return proc.call(ctx, method, params, result)
+}
+
+// Get the plugin's capabilities, starting it if need be. Returns an error if
+// it can't be started.
+func (p *plugin) capabilities(ctx context.Context) (driver.Capabilities, error) {
+	if _, err := p.running(ctx); err != nil {
+		return driver.Capabilities{}, err
+	}
+	return p.cachedCapabilities(), nil
+}
+
+// Get the capabilities the plugin reported when it last started, or none if
+// it hasn't yet. Unlike capabilities, this never starts the plugin.
+func (p *plugin) cachedCapabilities() driver.Capabilities {
+	p.capsLock.Lock()
+	defer p.capsLock.Unlock()
+	return p.caps
+}
+
+// Stop the plugin, and prevent it from being restarted.
+func (p *plugin) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stopped = true
+	if p.proc != nil {
+		p.proc.stop()
+		p.proc = nil
+	}
+}
+
+// Connect to the console. See coordinator.OBM.
+func (p *plugin) Dial(ctx context.Context) (coordinator.Proc, error) {
+	caps, err := p.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !caps.Console {
+		return nil, driver.ErrNotSupported
+	}
+	proc, err := p.running(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return proc.dialConsole(ctx)
+}
+
+// Check that the OBM is reachable, by querying its power status. See
+// coordinator.Pinger.
+func (p *plugin) Ping(ctx context.Context) (driver.PowerStatus, error) {
+	return p.powerStatus(ctx)
+}
+
+// Get the power status with "get_power_status".
+func (p *plugin) powerStatus(ctx context.Context) (driver.PowerStatus, error) {
+	var status powerStatus
+	if err := p.call(ctx, "get_power_status", nil, &status); err != nil {
+		return driver.PowerStatus{}, err
+	}
+	switch status.State {
+	case driver.PowerOn, driver.PowerOff, driver.PowerPoweringOn, driver.PowerPoweringOff:
+	default:
+		status.State = driver.PowerUnknown
+	}
+	return driver.PowerStatus{
+		State: status.State,
+		Raw:   status.Raw,
+		Time:  time.Now(),
+	}, nil
+}
+
+// A driver.OBM backed by a plugin. Console handling is left to the
+// coordinator; everything else is passed through to the plugin.
+type server struct {
+	*coordinator.Server
+	plugin *plugin
+}
+
+// Also starts the plugin in the background, rather than waiting until the
+// node is first used, so that its capabilities are known by then.
+func (s *server) Serve(ctx context.Context) {
+	go func() {
+		_, err := s.plugin.running(ctx)
+		if err != nil && err != driver.ErrOBMStopped && ctx.Err() == nil {
+			logging.FromContext(ctx).Warn("Starting plugin.",
+				"plugin", s.plugin.path, "err", err)
+		}
+	}()
+	s.Server.Serve(ctx)
+	s.plugin.stop()
+}
+
+// Returns the capabilities reported by the plugin, or none until it has
+// started (see Serve). This doesn't wait for the plugin to start, since it
+// mustn't block.
+func (s *server) Capabilities() driver.Capabilities {
+	return s.plugin.cachedCapabilities()
+}
+
+// Return driver.ErrNotSupported unless `supported` returns true for the
+// plugin's capabilities.
+func (s *server) require(ctx context.Context, supported func(driver.Capabilities) bool) error {
+	caps, err := s.plugin.capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	if !supported(caps) {
+		return driver.ErrNotSupported
+	}
+	return nil
+}
+
+func (s *server) PowerOn(ctx context.Context) error {
+	return s.plugin.call(ctx, "power_on", nil, nil)
+}
+
+func (s *server) PowerOff(ctx context.Context) error {
+	return s.plugin.call(ctx, "power_off", nil, nil)
+}
+
+func (s *server) PowerCycle(ctx context.Context, force bool) error {
+	return s.plugin.call(ctx, "power_cycle", map[string]bool{"force": force}, nil)
+}
+
+// The wire format of a driver.Bootdev.
+type bootdev struct {
+	Dev        string          `json:"dev"`
+	Persistent bool            `json:"persistent"`
+	Mode       driver.BootMode `json:"mode"`
+}
+
+func (s *server) SetBootdev(ctx context.Context, dev driver.Bootdev) error {
+	return s.plugin.call(ctx, "set_bootdev", bootdev{
+		Dev:        dev.Dev,
+		Persistent: dev.Persistent,
+		Mode:       dev.Mode,
+	}, nil)
+}
+
+func (s *server) GetBootdev(ctx context.Context) (driver.Bootdev, error) {
+	var dev bootdev
+	err := s.plugin.call(ctx, "get_bootdev", nil, &dev)
+	return driver.Bootdev{Dev: dev.Dev, Persistent: dev.Persistent, Mode: dev.Mode}, err
+}
+
+// The wire format of a driver.PowerStatus. The time is filled in by obmd.
+type powerStatus struct {
+	State driver.PowerState `json:"state"`
+	Raw   string            `json:"raw"`
+}
+
+func (s *server) GetPowerStatus(ctx context.Context) (driver.PowerStatus, error) {
+	return s.plugin.powerStatus(ctx)
+}
+
+func (s *server) ReadSensors(ctx context.Context) ([]driver.Sensor, error) {
+	err := s.require(ctx, func(caps driver.Capabilities) bool { return caps.Sensors })
+	if err != nil {
+		return nil, err
+	}
+	sensors := []driver.Sensor{}
+	err = s.plugin.call(ctx, "read_sensors", nil, &sensors)
+	return sensors, err
+}
+
+func (s *server) ReadSEL(ctx context.Context) ([]driver.SELEntry, error) {
+	err := s.require(ctx, func(caps driver.Capabilities) bool { return caps.SEL })
+	if err != nil {
+		return nil, err
+	}
+	entries := []driver.SELEntry{}
+	err = s.plugin.call(ctx, "read_sel", nil, &entries)
+	return entries, err
+}
+
+func (s *server) ClearSEL(ctx context.Context) error {
+	err := s.require(ctx, func(caps driver.Capabilities) bool { return caps.SEL })
+	if err != nil {
+		return err
+	}
+	return s.plugin.call(ctx, "clear_sel", nil, nil)
+}
+
+func (s *server) ReadInventory(ctx context.Context) (driver.Inventory, error) {
+	var inv driver.Inventory
+	err := s.require(ctx, func(caps driver.Capabilities) bool { return caps.Inventory })
+	if err != nil {
+		return inv, err
+	}
+	err = s.plugin.call(ctx, "read_inventory", nil, &inv)
+	return inv, err
+}
+
+func (s *server) SendBreak(ctx context.Context, sysrq string) error {
+	err := s.require(ctx, func(caps driver.Capabilities) bool { return caps.ConsoleBreak })
+	if err != nil {
+		return err
+	}
+	return s.Server.SendBreak(ctx, sysrq)
+}
+
+func (s *server) SendDiagInterrupt(ctx context.Context) error {
+	err := s.require(ctx, func(caps driver.Capabilities) bool { return caps.DiagInterrupt })
+	if err != nil {
+		return err
+	}
+	return s.plugin.call(ctx, "diag_interrupt", nil, nil)
+}
+
+// The parameters of the identify request.
+type identifyParams struct {
+	State      driver.IdentifyState `json:"state"`
+	DurationMs int64                `json:"duration_ms"`
+}
+
+func (s *server) Identify(ctx context.Context, state driver.IdentifyState, duration time.Duration) error {
+	err := s.require(ctx, func(caps driver.Capabilities) bool { return caps.Identify })
+	if err != nil {
+		return err
+	}
+	return s.plugin.call(ctx, "identify", identifyParams{
+		State:      state,
+		DurationMs: duration.Milliseconds(),
+	}, nil)
+}
@@ -0,0 +1,267 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
+)
+
+// Set in the environment of the test binary when it is run as a plugin; see
+// TestHelperProcess.
+const helperEnv = "OBMD_TEST_PLUGIN"
+
+// Not a real test: when run with helperEnv set, this acts as a plugin, for
+// the other tests to talk to.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv(helperEnv) != "1" {
+		return
+	}
+	runFakePlugin()
+	os.Exit(0)
+}
+
+// A minimal plugin. Its power status's raw output is the "addr" field of its
+// info, so tests can check that the info was passed through.
+func runFakePlugin() {
+	var (
+		writeLock sync.Mutex
+		enc       = json.NewEncoder(os.Stdout)
+		addr      string
+		power     = driver.PowerOff
+		dev       = bootdev{Dev: "disk", Persistent: true}
+		stop      chan struct{}
+	)
+	send := func(msg message) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		enc.Encode(&msg)
+	}
+	respond := func(req message, result interface{}, code string) {
+		resp := message{ID: req.ID}
+		if code != "" {
+			resp.Error = &rpcError{Code: code, Message: "failed"}
+		} else if result != nil {
+			resp.Result, _ = json.Marshal(result)
+		}
+		send(resp)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req message
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, "bad request:", err)
+			os.Exit(1)
+		}
+		switch req.Method {
+		case "initialize":
+			var params struct {
+				ProtocolVersion int `json:"protocol_version"`
+				Info            struct {
+					Addr string `json:"addr"`
+				} `json:"info"`
+			}
+			json.Unmarshal(req.Params, &params)
+			addr = params.Info.Addr
+			respond(req, initResult{Capabilities: driver.Capabilities{
+				BootDevices:  []string{"disk", "pxe"},
+				Console:      true,
+				ConsoleBreak: true,
+			}}, "")
+		case "power_on":
+			power = driver.PowerOn
+			respond(req, nil, "")
+		case "power_off":
+			power = driver.PowerOff
+			respond(req, nil, "")
+		case "get_power_status":
+			respond(req, powerStatus{State: power, Raw: addr}, "")
+		case "set_bootdev":
+			var params bootdev
+			json.Unmarshal(req.Params, &params)
+			if params.Dev != "disk" && params.Dev != "pxe" {
+				respond(req, nil, "invalid_bootdev")
+				continue
+			}
+			dev = params
+			respond(req, nil, "")
+		case "get_bootdev":
+			respond(req, dev, "")
+		case "console_connect":
+			stop = make(chan struct{})
+			go func(stop chan struct{}) {
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+						data, _ := json.Marshal(consoleData{Data: []byte(fmt.Sprintf("%d\n", i))})
+						send(message{Method: "console_data", Params: data})
+					}
+				}
+			}(stop)
+			respond(req, nil, "")
+		case "console_disconnect":
+			if stop != nil {
+				close(stop)
+				stop = nil
+			}
+			respond(req, nil, "")
+		case "console_break":
+			respond(req, nil, "")
+		default:
+			respond(req, nil, "not_supported")
+		}
+	}
+}
+
+// Start an OBM backed by the fake plugin. Call the returned function to shut
+// it down.
+func startOBM(t *testing.T, info string) (driver.OBM, func()) {
+	os.Setenv(helperEnv, "1")
+	drv := New(coordinator.DefaultHealthConfig(), os.Args[0], "-test.run=^TestHelperProcess$")
+	obm, err := drv.GetOBM([]byte(info))
+	if err != nil {
+		t.Fatal("GetOBM:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		obm.Serve(ctx)
+		close(done)
+	}()
+	return obm, func() {
+		cancel()
+		<-done
+		os.Unsetenv(helperEnv)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	ctx := context.Background()
+	obm, stop := startOBM(t, `{"addr": "10.0.0.7"}`)
+	defer stop()
+
+	// The plugin is started as soon as the OBM is served, so its
+	// capabilities are known without using the node first:
+	for i := 0; !obm.Capabilities().Console; i++ {
+		if i == 100 {
+			t.Fatal("Plugin's capabilities were never reported.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if caps := obm.Capabilities(); len(caps.BootDevices) != 2 {
+		t.Fatalf("Unexpected capabilities: %+v", caps)
+	}
+	if err := obm.PowerOn(ctx); err != nil {
+		t.Fatal("PowerOn:", err)
+	}
+	status, err := obm.GetPowerStatus(ctx)
+	if err != nil {
+		t.Fatal("GetPowerStatus:", err)
+	}
+	if status.State != driver.PowerOn || status.Raw != "10.0.0.7" || status.Time.IsZero() {
+		t.Fatalf("Unexpected power status: %+v", status)
+	}
+
+	if err = obm.SetBootdev(ctx, driver.Bootdev{Dev: "floppy"}); err != driver.ErrInvalidBootdev {
+		t.Fatalf("SetBootdev(floppy): wanted %v but got %v", driver.ErrInvalidBootdev, err)
+	}
+	want := driver.Bootdev{Dev: "pxe", Mode: driver.BootModeUEFI}
+	if err = obm.SetBootdev(ctx, want); err != nil {
+		t.Fatal("SetBootdev:", err)
+	}
+	if dev, err := obm.GetBootdev(ctx); err != nil || dev != want {
+		t.Fatalf("GetBootdev: wanted %+v but got %+v (error %v)", want, dev, err)
+	}
+
+	// Operations the plugin doesn't claim to support aren't sent to it:
+	if _, err = obm.(driver.SensorReader).ReadSensors(ctx); err != driver.ErrNotSupported {
+		t.Fatalf("ReadSensors: wanted %v but got %v", driver.ErrNotSupported, err)
+	}
+	// ...and those it rejects come back as the matching driver error:
+	if err = obm.PowerCycle(ctx, true); err != driver.ErrNotSupported {
+		t.Fatalf("PowerCycle: wanted %v but got %v", driver.ErrNotSupported, err)
+	}
+
+	conn, err := obm.DialConsole(ctx)
+	if err != nil {
+		t.Fatal("DialConsole:", err)
+	}
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != fmt.Sprintf("%d\n", i) {
+			t.Fatalf("Reading console: wanted line %d but got %q (error %v)", i, line, err)
+		}
+	}
+	if err = obm.(driver.ConsoleBreaker).SendBreak(ctx, "t"); err != nil {
+		t.Fatal("SendBreak:", err)
+	}
+	// Responses still get through while nobody is reading the console:
+	time.Sleep(20 * time.Millisecond)
+	if _, err = obm.GetPowerStatus(ctx); err != nil {
+		t.Fatal("GetPowerStatus while the console is unread:", err)
+	}
+	conn.Close()
+	if err = obm.DropConsole(); err != nil {
+		t.Fatal("DropConsole:", err)
+	}
+
+	// If the plugin dies, it is restarted:
+	plugin := obm.(*server).plugin
+	plugin.lock.Lock()
+	proc := plugin.proc
+	plugin.lock.Unlock()
+	proc.cmd.Process.Kill()
+	<-proc.exited
+	if status, err = obm.GetPowerStatus(ctx); err != nil || status.State != driver.PowerOff {
+		t.Fatalf("GetPowerStatus after restart: got %+v (error %v)", status, err)
+	}
+}
+
+func TestPluginBadInfo(t *testing.T) {
+	if _, err := New(coordinator.DefaultHealthConfig(), "/bin/true").GetOBM([]byte("{")); err == nil {
+		t.Fatal("GetOBM accepted invalid JSON.")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obmd-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]os.FileMode{
+		"vendor-a":  0755,
+		"vendor-b":  0700,
+		".hidden":   0755,
+		"README.md": 0644,
+	}
+	for name, mode := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	drivers, err := Load(dir, coordinator.DefaultHealthConfig())
+	if err != nil {
+		t.Fatal("Load:", err)
+	}
+	if len(drivers) != 2 || drivers["vendor-a"] == nil || drivers["vendor-b"] == nil {
+		t.Fatalf("Wanted drivers vendor-a and vendor-b, but got %v", drivers)
+	}
+}
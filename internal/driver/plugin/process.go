@@ -0,0 +1,411 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// The longest line we accept from a plugin.
+const maxMessageSize = 16 << 20
+
+// The most console output we hold for a client which isn't keeping up. Any
+// more is dropped, so that console data never holds up the plugin's
+// responses.
+const consoleBufferSize = 1 << 20
+
+// A message to or from a plugin. Requests have an ID, a Method and (maybe)
+// Params; responses have the ID of the request and either a Result or an
+// Error; notifications have a Method and Params, but no ID.
+type message struct {
+	ID     uint64          `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *rpcError       `json:"error,omitempty"`
+}
+
+// An error reported by a plugin.
+type rpcError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes which correspond to driver errors.
+var errorCodes = map[string]error{
+	"not_supported":         driver.ErrNotSupported,
+	"invalid_bootdev":       driver.ErrInvalidBootdev,
+	"invalid_boot_mode":     driver.ErrInvalidBootMode,
+	"invalid_identify":      driver.ErrInvalidIdentify,
+	"console_not_connected": driver.ErrConsoleNotConnected,
+}
+
+func (e *rpcError) err() error {
+	if err, ok := errorCodes[e.Code]; ok {
+		return err
+	}
+	if e.Code == "" {
+		return errors.New(e.Message)
+	}
+	return fmt.Errorf("%s: %s", e.Code, e.Message)
+}
+
+// The parameters of the console_data notification.
+type consoleData struct {
+	Data []byte `json:"data"`
+}
+
+// The parameters of the console_closed notification.
+type consoleClosed struct {
+	Error string `json:"error"`
+}
+
+// A running plugin.
+type process struct {
+	cmd *exec.Cmd
+
+	// Writes to stdin must hold writeLock, so messages aren't
+	// interleaved.
+	writeLock sync.Mutex
+	stdin     io.WriteCloser
+
+	lock sync.Mutex
+	// The ID of the last request sent.
+	lastID uint64
+	// Channels on which to deliver the responses to outstanding requests.
+	pending map[uint64]chan *message
+	// Where to send console data, if a console session is active.
+	console *consoleBuffer
+
+	// Closed once the plugin has exited; err is then the reason.
+	exited chan struct{}
+	err    error
+}
+
+// Start the plugin at `path`. Its standard error is logged to the logger in
+// `ctx`.
+func startProcess(ctx context.Context, path string, args []string) (*process, error) {
+	log := logging.FromContext(ctx).With("plugin", path)
+	cmd := exec.Command(path, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &process{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[uint64]chan *message),
+		exited:  make(chan struct{}),
+	}
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Info("Plugin output.", "line", scanner.Text())
+		}
+	}()
+	go func() {
+		p.readMessages(log, stdout)
+		// Wait must not be called until the pipes have been read to
+		// completion:
+		<-stderrDone
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New("Plugin exited.")
+		}
+		p.lock.Lock()
+		p.err = err
+		if p.console != nil {
+			p.console.CloseWithError(err)
+			p.console = nil
+		}
+		p.lock.Unlock()
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// Handle messages from the plugin until it closes its standard output.
+func (p *process) readMessages(log *slog.Logger, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, maxMessageSize)
+	for scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Warn("Malformed message from plugin.", "err", err)
+			continue
+		}
+		switch {
+		case msg.ID != 0:
+			p.lock.Lock()
+			ch, ok := p.pending[msg.ID]
+			delete(p.pending, msg.ID)
+			p.lock.Unlock()
+			if ok {
+				ch <- &msg
+			}
+		case msg.Method == "console_data":
+			var params consoleData
+			if err := json.Unmarshal(msg.Params, &params); err != nil {
+				log.Warn("Malformed console data from plugin.", "err", err)
+				continue
+			}
+			p.lock.Lock()
+			console := p.console
+			p.lock.Unlock()
+			if console != nil && console.write(params.Data) {
+				log.Warn("Console client is falling behind; dropping output.")
+			}
+		case msg.Method == "console_closed":
+			var params consoleClosed
+			json.Unmarshal(msg.Params, &params)
+			p.lock.Lock()
+			if p.console != nil {
+				if params.Error != "" {
+					p.console.CloseWithError(errors.New(params.Error))
+				} else {
+					p.console.Close()
+				}
+				p.console = nil
+			}
+			p.lock.Unlock()
+		default:
+			log.Warn("Unexpected message from plugin.", "method", msg.Method)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Warn("Reading from plugin.", "err", err)
+	}
+}
+
+// Send a request to the plugin, and wait for the response. If the request
+// succeeds and `result` is not nil, the response's result is decoded into it.
+func (p *process) call(ctx context.Context, method string, params, result interface{}) error {
+	msg := message{Method: method}
+	if params != nil {
+		var err error
+		if msg.Params, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	ch := make(chan *message, 1)
+	p.lock.Lock()
+	p.lastID++
+	msg.ID = p.lastID
+	p.pending[msg.ID] = ch
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.pending, msg.ID)
+		p.lock.Unlock()
+	}()
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	p.writeLock.Lock()
+	_, err = p.stdin.Write(append(data, '\n'))
+	p.writeLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("Writing to plugin: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CallTimeout)
+	defer cancel()
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error.err()
+		}
+		if result != nil {
+			if err := json.Unmarshal(resp.Result, result); err != nil {
+				return fmt.Errorf("Malformed %s result from plugin: %v", method, err)
+			}
+		}
+		return nil
+	case <-p.exited:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start a console session. See coordinator.OBM.
+func (p *process) dialConsole(ctx context.Context) (*consoleProc, error) {
+	buf := newConsoleBuffer()
+	p.lock.Lock()
+	if p.console != nil {
+		p.console.Close()
+	}
+	p.console = buf
+	p.lock.Unlock()
+	if err := p.call(ctx, "console_connect", nil, nil); err != nil {
+		p.dropConsole(buf)
+		return nil, err
+	}
+	return &consoleProc{proc: p, buf: buf}, nil
+}
+
+// Stop sending console data to `buf`, if we still are.
+func (p *process) dropConsole(buf *consoleBuffer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.console == buf {
+		p.console = nil
+	}
+	buf.Close()
+}
+
+// Stop the plugin: close its standard input, which should cause it to exit,
+// and kill it if it doesn't do so within ExitTimeout.
+func (p *process) stop() {
+	p.writeLock.Lock()
+	p.stdin.Close()
+	p.writeLock.Unlock()
+	select {
+	case <-p.exited:
+	case <-time.After(ExitTimeout):
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
+
+// A console session. See coordinator.Proc.
+type consoleProc struct {
+	proc *process
+	buf  *consoleBuffer
+}
+
+func (c *consoleProc) Reader() io.Reader {
+	return c.buf
+}
+
+func (c *consoleProc) Shutdown(ctx context.Context) error {
+	c.proc.dropConsole(c.buf)
+	err := c.proc.call(ctx, "console_disconnect", nil, nil)
+	select {
+	case <-c.proc.exited:
+		// Nothing left to disconnect.
+		return nil
+	default:
+		return err
+	}
+}
+
+// The parameters of the console_break request.
+type consoleBreakParams struct {
+	SysRq string `json:"sysrq,omitempty"`
+}
+
+func (c *consoleProc) SendBreak(ctx context.Context, sysrq string) error {
+	return c.proc.call(ctx, "console_break", consoleBreakParams{SysRq: sysrq}, nil)
+}
+
+// Holds console data between readMessages and the client reading the
+// console. Unlike an io.Pipe, writing never blocks: if the buffer is full,
+// the data is dropped.
+type consoleBuffer struct {
+	lock sync.Mutex
+	data []byte
+	// Set once the buffer is closed; returned by Read once data is empty.
+	err error
+	// Whether the last write was (partly) dropped.
+	dropping bool
+	// Signaled (without blocking) whenever data or err changes.
+	ready chan struct{}
+}
+
+func newConsoleBuffer() *consoleBuffer {
+	return &consoleBuffer{ready: make(chan struct{}, 1)}
+}
+
+// Add `data` to the buffer, dropping whatever doesn't fit. Returns true if
+// this starts dropping data, i.e. if this write was dropped but the previous
+// one wasn't. Writes after the buffer is closed are ignored.
+func (b *consoleBuffer) write(data []byte) (startedDropping bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return false
+	}
+	n := len(data)
+	if room := consoleBufferSize - len(b.data); n > room {
+		n = room
+	}
+	b.data = append(b.data, data[:n]...)
+	startedDropping = n < len(data) && !b.dropping
+	b.dropping = n < len(data)
+	b.signal()
+	return startedDropping
+}
+
+// Wake up a waiting Read, if any. Must be called with the lock held.
+func (b *consoleBuffer) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Read buffered data, waiting for some if there is none. Once the buffer is
+// closed and empty, this returns the error it was closed with.
+func (b *consoleBuffer) Read(p []byte) (int, error) {
+	for {
+		b.lock.Lock()
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.lock.Unlock()
+			return n, nil
+		}
+		err := b.err
+		b.lock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		<-b.ready
+	}
+}
+
+// Close the buffer, so that Read returns `err` (or io.EOF, if it is nil)
+// once the data already buffered has been read. Closing a closed buffer
+// does nothing.
+func (b *consoleBuffer) CloseWithError(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err == nil {
+		b.err = err
+		b.signal()
+	}
+}
+
+func (b *consoleBuffer) Close() error {
+	b.CloseWithError(nil)
+	return nil
+}
@@ -0,0 +1,31 @@
+package driver
+
+import (
+	"time"
+)
+
+// A node's power state, as reported by its OBM.
+type PowerState string
+
+const (
+	PowerOn          PowerState = "on"
+	PowerOff         PowerState = "off"
+	PowerPoweringOn  PowerState = "powering-on"
+	PowerPoweringOff PowerState = "powering-off"
+
+	// The OBM gave us an answer, but we couldn't make sense of it.
+	PowerUnknown PowerState = "unknown"
+)
+
+// The result of a power status query.
+type PowerStatus struct {
+	// The power state, normalized across drivers.
+	State PowerState
+
+	// The unmodified response from the OBM, for debugging and for clients
+	// that want to know more than State can express.
+	Raw string
+
+	// The time at which the status was read from the OBM.
+	Time time.Time
+}
@@ -0,0 +1,35 @@
+package driver
+
+import (
+	"time"
+)
+
+// How serious a system event log entry is.
+type SELSeverity string
+
+const (
+	SELInfo     SELSeverity = "info"
+	SELWarning  SELSeverity = "warning"
+	SELCritical SELSeverity = "critical"
+)
+
+// An entry in a node's system event log.
+type SELEntry struct {
+	// The OBM's identifier for the record.
+	ID string `json:"id"`
+
+	// When the event occurred. The zero value if the OBM didn't record a
+	// time (e.g. because the event happened before its clock was set).
+	Time time.Time `json:"time"`
+
+	Severity SELSeverity `json:"severity"`
+
+	// The sensor which generated the event.
+	Sensor string `json:"sensor"`
+
+	// A description of the event.
+	Event string `json:"event"`
+
+	// Whether the event condition started (true) or ended (false).
+	Asserted bool `json:"asserted"`
+}
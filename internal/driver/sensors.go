@@ -0,0 +1,54 @@
+package driver
+
+// The kind of quantity a sensor measures.
+type SensorType string
+
+const (
+	SensorTemperature SensorType = "temperature"
+	SensorFan         SensorType = "fan"
+	SensorVoltage     SensorType = "voltage"
+	SensorCurrent     SensorType = "current"
+	SensorPower       SensorType = "power"
+
+	// Sensors which report a state (e.g. "power supply present") rather
+	// than a quantity.
+	SensorDiscrete SensorType = "discrete"
+
+	SensorOther SensorType = "other"
+)
+
+// The health of a sensor's reading, relative to its thresholds.
+type SensorStatus string
+
+const (
+	SensorOK       SensorStatus = "ok"
+	SensorWarning  SensorStatus = "warning"
+	SensorCritical SensorStatus = "critical"
+
+	// The reading is outside of the range from which the hardware can
+	// recover.
+	SensorNonRecoverable SensorStatus = "non-recoverable"
+
+	// No reading is available, or the OBM doesn't report thresholds.
+	SensorUnknown SensorStatus = "unknown"
+)
+
+// A single sensor reading.
+type Sensor struct {
+	Name string     `json:"name"`
+	Type SensorType `json:"type"`
+
+	// The reading, in units of Unit. nil if the sensor has no
+	// (numeric) reading.
+	Value *float64 `json:"value"`
+
+	// The unit of Value; one of "C", "F", "RPM", "V", "A", "W", or ""
+	// if there is no value or the OBM reported some other unit.
+	Unit string `json:"unit"`
+
+	// The unit as reported by the OBM, if there is a value but the unit
+	// isn't one of those Unit can be.
+	RawUnit string `json:"raw_unit,omitempty"`
+
+	Status SensorStatus `json:"status"`
+}
@@ -0,0 +1,59 @@
+// Package logging carries log/slog loggers in contexts.
+//
+// Loggers are usually passed around in a context.Context (see NewContext and
+// FromContext), so that e.g. every line logged while handling an HTTP request
+// includes that request's ID:
+//
+//	logging.FromContext(ctx).Info("Powering on node.", "node", label)
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Output formats accepted by New.
+const (
+	// key=value pairs, separated by spaces; see https://brandur.org/logfmt.
+	FormatLogfmt = "logfmt"
+
+	// One JSON object per line.
+	FormatJSON = "json"
+)
+
+// Create a logger which writes records at `level` or above to `w`, in the
+// given format (FormatLogfmt or FormatJSON).
+func New(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case FormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("Invalid log format %q; must be %q or %q.",
+		format, FormatLogfmt, FormatJSON)
+}
+
+type contextKey struct{}
+
+// Return a copy of `ctx` which carries the logger `l`.
+func NewContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// Return the logger carried by `ctx`, or slog.Default() if there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// Return a copy of `ctx` whose logger adds the key/value pairs `kv` to every
+// record. This is shorthand for NewContext(ctx, FromContext(ctx).With(kv...)).
+func With(ctx context.Context, kv ...interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(kv...))
+}
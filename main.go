@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	// Schedules may name time zones, which we shouldn't depend on the
+	// host having a database for:
+	_ "time/tzdata"
 
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
@@ -13,11 +23,15 @@ import (
 	"github.com/caarlos0/env"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/composite"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
 	"github.com/CCI-MOC/obmd/internal/driver/dummy"
 	"github.com/CCI-MOC/obmd/internal/driver/ipmi"
 	"github.com/CCI-MOC/obmd/internal/driver/mock"
+	"github.com/CCI-MOC/obmd/internal/driver/plugin"
 
 	"github.com/CCI-MOC/obmd/httpserver"
+	"github.com/CCI-MOC/obmd/logging"
 	"github.com/CCI-MOC/obmd/token"
 )
 
@@ -27,31 +41,142 @@ type Config struct {
 	DBPath     string      `env:"DB_PATH,required"`
 	AdminToken token.Token `env:"ADMIN_TOKEN,required"`
 	ServerCfg  httpserver.Config
+
+	HealthCheckInterval time.Duration `env:"HEALTH_CHECK_INTERVAL" envDefault:"1m"`
+	HealthCheckFailures int           `env:"HEALTH_CHECK_FAILURES" envDefault:"3"`
+
+	// How often to check the power states of nodes that event streams or
+	// webhooks want power.changed events for. Zero disables this.
+	PowerPollInterval time.Duration `env:"POWER_POLL_INTERVAL" envDefault:"30s"`
+
+	// How old a power status read by a health check, the poller or an
+	// earlier request may be and still be returned by the power status
+	// endpoint. Zero disables caching.
+	PowerStatusMaxAge time.Duration `env:"POWER_STATUS_MAX_AGE" envDefault:"1m"`
+
+	// See RetryPolicy in breaker.go.
+	RetryAttempts          int           `env:"RETRY_ATTEMPTS" envDefault:"3"`
+	RetryBackoff           time.Duration `env:"RETRY_BACKOFF" envDefault:"500ms"`
+	CircuitBreakerFailures int           `env:"CIRCUIT_BREAKER_FAILURES" envDefault:"5"`
+	CircuitBreakerCooldown time.Duration `env:"CIRCUIT_BREAKER_COOLDOWN" envDefault:"30s"`
+
+	// If set, each executable in this directory is made available as a
+	// driver, named after the file. See docs/plugin-protocol.md.
+	PluginDir string `env:"PLUGIN_DIR"`
+
+	// Whether /metrics may be fetched without the admin token.
+	PublicMetrics bool `env:"PUBLIC_METRICS" envDefault:"false"`
+
+	// How long to keep serving requests after receiving SIGTERM/SIGINT,
+	// with /readyz failing, before starting to shut down. This gives load
+	// balancers a chance to notice and stop sending us traffic.
+	ShutdownDelay time.Duration `env:"SHUTDOWN_DELAY" envDefault:"0s"`
+
+	// Whether to upgrade the database schema on startup. This is on by
+	// default, so that existing deployments keep working after an
+	// upgrade. If it is false, obmd refuses to start against an out of
+	// date schema; run with -migrate to upgrade it.
+	AutoMigrate bool `env:"AUTO_MIGRATE" envDefault:"true"`
+
+	LogLevel  string `env:"LOG_LEVEL" envDefault:"info"`
+	LogFormat string `env:"LOG_FORMAT" envDefault:"logfmt"`
+
+	// If set, connection info in exports is encrypted with this
+	// passphrase, and it is used to decrypt encrypted imports.
+	ExportPassphrase string `env:"EXPORT_PASSPHRASE"`
 }
 
 var (
 	genToken = flag.Bool("gen-token", false,
 		"Generate a random token, instead of starting the daemon.")
+	migrate = flag.Bool("migrate", false,
+		"Upgrade the database schema, instead of starting the daemon.")
+	exportFile = flag.String("export", "",
+		"Dump all nodes to the named file (- for stdout), instead of starting the daemon.")
+	importFile = flag.String("import", "",
+		"Load nodes from the named file (- for stdin), instead of starting the daemon.")
 )
 
 // Exit with an error message if err != nil.
 func chkfatal(err error) {
 	if err != nil {
-		log.Fatal(err)
+		fatal(err.Error())
 	}
 }
 
+// Log an error message, and exit.
+func fatal(msg string, kv ...interface{}) {
+	slog.Error(msg, kv...)
+	os.Exit(1)
+}
+
 func getConfig() Config {
 	cfg := Config{}
 	if err := env.Parse(&cfg); err != nil {
-		log.Fatal("Parsing config from environment: ", err)
+		fatal("Parsing config from environment.", "err", err)
 	}
 	if err := env.Parse(&cfg.ServerCfg); err != nil {
-		log.Fatal("Parsing config from environment: ", err)
+		fatal("Parsing config from environment.", "err", err)
 	}
 	return cfg
 }
 
+// Replace the default logger with one configured according to `config`.
+func setupLogging(config *Config) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return err
+	}
+	logger, err := logging.New(os.Stderr, level, config.LogFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Carry out the -export or -import command.
+func exportImport(daemon *Daemon, config *Config) error {
+	ctx := context.Background()
+	if *exportFile != "" {
+		doc, err := daemon.Export(ctx, config.ExportPassphrase)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(doc, "", "    ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if *exportFile == "-" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		// The export may contain OBM credentials, so don't make it
+		// world-readable:
+		return ioutil.WriteFile(*exportFile, data, 0600)
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if *importFile == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*importFile)
+	}
+	if err != nil {
+		return err
+	}
+	var doc Export
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	_, err = daemon.Import(ctx, &doc, config.ExportPassphrase)
+	return err
+}
+
 func main() {
 	flag.Parse()
 
@@ -66,27 +191,104 @@ func main() {
 	}
 
 	config := getConfig()
+	chkfatal(setupLogging(&config))
 
 	// DB Types: sqlite3 or postgres
 	db, err := sql.Open(config.DBType, config.DBPath)
 	chkfatal(err)
 	chkfatal(db.Ping())
 
-	state, err := NewState(db, driver.Registry{
-		"ipmi": ipmi.Driver,
+	if *migrate || config.AutoMigrate {
+		chkfatal(migrateSchema(context.Background(), db, config.DBType))
+		if *migrate {
+			return
+		}
+	}
+
+	health := coordinator.HealthConfig{
+		Interval:         config.HealthCheckInterval,
+		FailureThreshold: config.HealthCheckFailures,
+	}
+	registry := driver.Registry{
+		"ipmi": ipmi.New(health),
 
 		// TODO: maybe mask this behind a build tag, so it's not there
 		// in production builds:
 		"dummy": dummy.Driver,
-		"mock":  mock.Driver,
-	})
+		"mock":  mock.New(health),
+	}
+	// Composite OBMs may be built from any of the other drivers,
+	// including plugins and other composites:
+	registry["composite"] = composite.New(registry)
+	if config.PluginDir != "" {
+		plugins, err := plugin.Load(config.PluginDir, health)
+		chkfatal(err)
+		for name, drv := range plugins {
+			if _, ok := registry[name]; ok {
+				chkfatal(fmt.Errorf("Plugin %q has the same name as a built-in driver.", name))
+			}
+			registry[name] = drv
+			slog.Info("Loaded driver plugin.", "driver", name)
+		}
+	}
+
+	if *exportFile != "" || *importFile != "" {
+		// These only need the database, so don't start the nodes'
+		// OBMs:
+		state, err := NewOfflineState(db, registry)
+		chkfatal(err)
+		daemon := NewDaemon(state, DefaultRetryPolicy(), config.PowerStatusMaxAge)
+		chkfatal(exportImport(daemon, &config))
+		chkfatal(daemon.Close())
+		chkfatal(db.Close())
+		return
+	}
+
+	state, err := NewState(db, registry)
 	chkfatal(err)
-	srv := makeHandler(&config, NewDaemon(state))
+	daemon := NewDaemon(state, RetryPolicy{
+		Attempts:         config.RetryAttempts,
+		Backoff:          config.RetryBackoff,
+		BreakerThreshold: config.CircuitBreakerFailures,
+		BreakerCooldown:  config.CircuitBreakerCooldown,
+	}, config.PowerStatusMaxAge)
+	srv := makeHandler(&config, daemon)
 	http.Handle("/", srv)
 
-	if err := config.ServerCfg.Validate(); err != nil {
-		log.Fatal(err)
-	}
+	chkfatal(config.ServerCfg.Validate())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigs
+		slog.Info("Shutting down.", "signal", sig)
+		daemon.BeginShutdown()
+		time.Sleep(config.ShutdownDelay)
+		cancel()
+	}()
+
+	schedulerDone := make(chan struct{})
+	go func() {
+		daemon.RunScheduler(ctx)
+		close(schedulerDone)
+	}()
+	healthWatcherDone := make(chan struct{})
+	go func() {
+		daemon.RunHealthWatcher(ctx)
+		close(healthWatcherDone)
+	}()
+	powerPollerDone := make(chan struct{})
+	go func() {
+		daemon.RunPowerPoller(ctx, config.PowerPollInterval)
+		close(powerPollerDone)
+	}()
 
-	chkfatal(httpserver.Run(&config.ServerCfg, nil))
+	slog.Info("Listening.", "addr", config.ServerCfg.ListenAddr)
+	chkfatal(httpserver.RunContext(ctx, &config.ServerCfg, nil))
+	<-schedulerDone
+	<-healthWatcherDone
+	<-powerPollerDone
+	chkfatal(daemon.Close())
+	chkfatal(db.Close())
 }
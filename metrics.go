@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// Histogram buckets, in seconds. These cover everything from a quick HTTP
+// request to an ipmitool invocation that hits its timeout.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics exported via /metrics. These are global, since there is only one
+// Daemon per process (outside of tests, where sharing them is harmless).
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequests = newCounterVec(
+		"obmd_http_requests_total",
+		"HTTP requests served, by route, method and status code.",
+		"route", "method", "status")
+	httpDuration = newHistogramVec(
+		"obmd_http_request_duration_seconds",
+		"Time taken to serve HTTP requests (for console requests, this "+
+			"is the length of the session).",
+		"route", "method")
+
+	driverOps = newCounterVec(
+		"obmd_driver_operations_total",
+		"Operations performed on OBMs, by driver type and operation.",
+		"driver", "operation")
+	driverFailures = newCounterVec(
+		"obmd_driver_operation_failures_total",
+		"Operations on OBMs which returned an error, by driver type and "+
+			"operation.",
+		"driver", "operation")
+	driverDuration = newHistogramVec(
+		"obmd_driver_operation_duration_seconds",
+		"Time taken by operations on OBMs, by driver type and operation.",
+		"driver", "operation")
+
+	consoleSessions = newGaugeVec(
+		"obmd_console_sessions_active",
+		"Console sessions currently being streamed to clients.").WithLabelValues()
+	consoleBytes = newCounterVec(
+		"obmd_console_bytes_total",
+		"Bytes of console output streamed to clients.").WithLabelValues()
+
+	tokensIssued = newCounterVec(
+		"obmd_tokens_issued_total",
+		"Node tokens issued.").WithLabelValues()
+	tokensRevoked = newCounterVec(
+		"obmd_tokens_revoked_total",
+		"Node tokens explicitly revoked.").WithLabelValues()
+
+	bmcHealth = newGaugeVec(
+		"obmd_bmc_health",
+		"1 for the health state each node's OBM is in, 0 for the others. "+
+			"Nodes whose OBMs aren't health checked are omitted.",
+		"node", "state")
+	bmcFailures = newGaugeVec(
+		"obmd_bmc_consecutive_failures",
+		"Consecutive failed health checks for each node's OBM.",
+		"node")
+)
+
+// Create and register a counter with the given name, help text and label
+// names.
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	ret := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(ret)
+	return ret
+}
+
+// Like newCounterVec, but for gauges.
+func newGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	ret := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(ret)
+	return ret
+}
+
+// Like newCounterVec, but for histograms, with durationBuckets.
+func newHistogramVec(name, help string, labels ...string) *prometheus.HistogramVec {
+	ret := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: durationBuckets,
+	}, labels)
+	metricsRegistry.MustRegister(ret)
+	return ret
+}
+
+// Serves the metrics in metricsRegistry.
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// Record metrics for an operation `op` on a node's OBM, which is performed
+// by calling `f`, and log the outcome. The context passed to `f` logs the
+// node's label.
+func observeDriverOp(ctx context.Context, node *Node, op string, f func(context.Context) error) error {
+	ctx = logging.With(ctx, "node", node.Label)
+	start := time.Now()
+	err := f(ctx)
+	duration := time.Since(start)
+	driverDuration.WithLabelValues(node.Type, op).Observe(duration.Seconds())
+	driverOps.WithLabelValues(node.Type, op).Inc()
+	logger := logging.FromContext(ctx)
+	if err != nil {
+		driverFailures.WithLabelValues(node.Type, op).Inc()
+		logger.Warn("OBM operation failed.",
+			"operation", op, "duration", duration, "err", err)
+	} else {
+		logger.Debug("OBM operation succeeded.",
+			"operation", op, "duration", duration)
+	}
+	return err
+}
+
+// Set the BMC health gauges from the current state of the nodes.
+func (d *Daemon) updateHealthMetrics() {
+	d.Lock()
+	defer d.Unlock()
+	bmcHealth.Reset()
+	bmcFailures.Reset()
+	for label, node := range d.state.nodes {
+		info := node.Info()
+		if info.Health == nil {
+			continue
+		}
+		for _, state := range []driver.HealthState{
+			driver.HealthUp,
+			driver.HealthDown,
+			driver.HealthUnknown,
+		} {
+			value := 0.0
+			if info.Health.State == state {
+				value = 1
+			}
+			bmcHealth.WithLabelValues(label, string(state)).Set(value)
+		}
+		bmcFailures.WithLabelValues(label).Set(float64(info.Health.ConsecutiveFailures))
+	}
+}
+
+// An http.ResponseWriter which remembers the status code, for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// The console handler needs this to stream output promptly.
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Wrap the router `r`, recording metrics for each request. Requests are
+// labeled with the path template of the route they match (so that e.g. all
+// power_on requests are counted together regardless of node), or "none" if
+// they don't match any route.
+func instrumentHandler(r *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := "none"
+		var match mux.RouteMatch
+		if r.Match(req, &match) && match.Route != nil {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		r.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, req.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
@@ -2,22 +2,49 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
 	"github.com/CCI-MOC/obmd/token"
 )
 
 // Information about a node
 type Node struct {
+	Label        string             // The node's label.
+	Type         string             // The type of this node's OBM.
 	ConnInfo     []byte             // Connection info for this node's OBM.
 	ObmCancel    context.CancelFunc // stop the OBM
 	OBM          driver.OBM         // OBM for this node.
 	CurrentToken token.Token        // Token for regular user operations.
+
+	// Arbitrary key/value metadata, e.g. the node's rack. Never nil.
+	Metadata map[string]string
+
+	// Held while performing operations on the OBM (see runOnNode). Unlike
+	// the rest of the node's fields, which are protected by the daemon's
+	// lock, this lets operations on different nodes run concurrently.
+	opLock sync.Mutex
+
+	// The last power status read from the OBM, or nil if there isn't one
+	// or it has been invalidated; see readPowerStatus. This has its own
+	// lock so that it can be read while an operation is in progress.
+	powerCacheLock sync.Mutex
+	powerCache     *driver.PowerStatus
+
+	// When powerCache was last invalidated. Power statuses read by
+	// health checks before then are out of date.
+	powerInvalidated time.Time
+
+	// Tracks failed operations on the OBM; see runOnNode.
+	breaker circuitBreaker
 }
 
-// Returns a new node with the given driver information. The token will be
-// freshly generated.
-func NewNode(d driver.Driver, info []byte) (*Node, error) {
+// Returns a new node with the given label and driver information. The token
+// will be freshly generated.
+func NewNode(d driver.Driver, label string, info []byte) (*Node, error) {
 	tok, err := token.New()
 	if err != nil {
 		return nil, err
@@ -27,14 +54,82 @@ func NewNode(d driver.Driver, info []byte) (*Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	// d is a driver.Registry (at least outside of tests), so if GetOBM
+	// succeeded, info has a "type" field:
+	var typ struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(info, &typ)
 	ret := &Node{
+		Label:        label,
+		Type:         typ.Type,
 		OBM:          obm,
 		ConnInfo:     info,
 		CurrentToken: tok,
+		Metadata:     map[string]string{},
 	}
 	return ret, nil
 }
 
+// Publicly visible information about a node, as reported by the node
+// inspection endpoint. This deliberately leaves out the connection info,
+// which may contain credentials.
+type NodeInfo struct {
+	Type string `json:"type"`
+
+	// Results of the OBM's health checks; nil if the OBM doesn't do
+	// health checks.
+	Health *driver.Health `json:"health"`
+
+	CircuitBreaker BreakerStatus `json:"circuit_breaker"`
+
+	Metadata map[string]string `json:"metadata"`
+}
+
+// An entry in the node list.
+type NodeListEntry struct {
+	Label string `json:"label"`
+	NodeInfo
+}
+
+func (n *Node) Info() NodeInfo {
+	info := NodeInfo{
+		Type:           n.Type,
+		CircuitBreaker: n.breaker.Status(),
+		Metadata:       make(map[string]string, len(n.Metadata)),
+	}
+	// Copy the metadata, so the caller can use it without holding
+	// the daemon's lock:
+	for k, v := range n.Metadata {
+		info.Metadata[k] = v
+	}
+	if obm, ok := n.OBM.(driver.HealthMonitor); ok {
+		health := obm.Health()
+		info.Health = &health
+	}
+	return info
+}
+
+// Returns driver.ErrOBMDown if health checks have determined that the node's
+// OBM (or, for a driver.OpHealthMonitor, the part of it which handles `op`) is
+// unreachable, so that callers can fail fast rather than waiting for the OBM
+// to time out. Returns nil otherwise.
+func (n *Node) CheckOBM(op string) error {
+	var health driver.Health
+	switch obm := n.OBM.(type) {
+	case driver.OpHealthMonitor:
+		health = obm.HealthFor(op)
+	case driver.HealthMonitor:
+		health = obm.Health()
+	default:
+		return nil
+	}
+	if health.State == driver.HealthDown {
+		return driver.ErrOBMDown
+	}
+	return nil
+}
+
 // Generate a new token, invaidating the old one if any, and disconnecting
 // clients using it. If an error occurs, the state of the node/token will
 // be unchanged.
@@ -70,7 +165,10 @@ func (n *Node) StartOBM() {
 	if n.ObmCancel != nil {
 		panic("BUG: OBM is already started!")
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	// Everything the OBM logs in the background (as opposed to while
+	// handling a request) is tagged with the node's label:
+	ctx := logging.With(context.Background(), "node", n.Label)
+	ctx, cancel := context.WithCancel(ctx)
 	n.ObmCancel = cancel
 	go n.OBM.Serve(ctx)
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// The number of nodes the power poller queries at once.
+const powerPollConcurrency = 10
+
+// Read the node's power status from its OBM, and cache it. Must be called
+// with the node's opLock held, e.g. from within runOnNode.
+func readPowerStatus(ctx context.Context, n *Node) (driver.PowerStatus, error) {
+	status, err := n.OBM.GetPowerStatus(ctx)
+	if err != nil {
+		return status, err
+	}
+	n.powerCacheLock.Lock()
+	defer n.powerCacheLock.Unlock()
+	n.powerCache = &status
+	return status, nil
+}
+
+// Forget the node's cached power status, e.g. because we've just changed it.
+// Must be called with the node's opLock held, e.g. from within runOnNode.
+func invalidatePowerStatus(n *Node) {
+	n.powerCacheLock.Lock()
+	defer n.powerCacheLock.Unlock()
+	n.powerCache = nil
+	n.powerInvalidated = time.Now()
+}
+
+// Get the node's most recently read power status, if there is one no older
+// than `maxAge`. This may have been read by an earlier operation, or by the
+// OBM's health checks.
+func cachedPowerStatus(n *Node, maxAge time.Duration) (status driver.PowerStatus, ok bool) {
+	n.powerCacheLock.Lock()
+	latest := n.powerCache
+	invalidated := n.powerInvalidated
+	n.powerCacheLock.Unlock()
+	if monitor, isMonitor := n.OBM.(driver.HealthMonitor); isMonitor {
+		checked := monitor.Health().PowerStatus
+		if checked != nil && checked.Time.After(invalidated) &&
+			(latest == nil || checked.Time.After(latest.Time)) {
+			latest = checked
+		}
+	}
+	if latest == nil || time.Since(latest.Time) > maxAge {
+		return status, false
+	}
+	return *latest, true
+}
+
+// Check the power state of every node someone wants power.changed events for
+// every `interval`, publishing events when they change, until `ctx` is
+// canceled. Does nothing if `interval` is zero.
+func (d *Daemon) RunPowerPoller(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	last := make(map[*Node]driver.PowerState)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.pollPowerStates(ctx, last, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Get the power state of each node that an event stream or webhook wants
+// power.changed events for, comparing it to that recorded in `last`,
+// publishing events for any which have changed, and update `last`. Nodes
+// whose power state can't be read are skipped.
+//
+// A power status no older than `maxAge` (e.g. from a health check) is used
+// rather than querying the OBM again. Otherwise, the OBM is queried once:
+// unlike a client's request, this isn't retried, and failures don't count
+// towards the node's circuit breaker, since nobody is waiting on the result.
+func (d *Daemon) pollPowerStates(ctx context.Context, last map[*Node]driver.PowerState, maxAge time.Duration) {
+	d.Lock()
+	nodes := make([]*Node, 0, len(d.state.nodes))
+	current := make(map[*Node]bool, len(d.state.nodes))
+	for label, node := range d.state.nodes {
+		if !d.events.wanted(Event{Type: EventPowerChanged, Node: label}) {
+			continue
+		}
+		nodes = append(nodes, node)
+		current[node] = true
+	}
+	d.Unlock()
+	for node := range last {
+		if !current[node] {
+			delete(last, node)
+		}
+	}
+
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, powerPollConcurrency)
+	)
+	defer wg.Wait()
+	for _, node := range nodes {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(node *Node) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			status, err := pollPowerStatus(ctx, node, maxAge)
+			if err != nil {
+				logging.FromContext(ctx).Debug("Polling power state.",
+					"node", node.Label, "err", err)
+				return
+			}
+			lock.Lock()
+			old, seen := last[node]
+			last[node] = status.State
+			lock.Unlock()
+			if seen && old != status.State {
+				d.publish(ctx, EventPowerChanged, node.Label,
+					"state", status.State, "previous_state", old)
+			}
+		}(node)
+	}
+}
+
+// Get the node's power status for pollPowerStates.
+func pollPowerStatus(ctx context.Context, node *Node, maxAge time.Duration) (driver.PowerStatus, error) {
+	if status, ok := cachedPowerStatus(node, maxAge); ok {
+		return status, nil
+	}
+	if err := node.CheckOBM("power_poll"); err != nil {
+		return driver.PowerStatus{}, err
+	}
+	if node.breaker.Status().State == BreakerOpen {
+		return driver.PowerStatus{}, ErrCircuitOpen
+	}
+	node.opLock.Lock()
+	defer node.opLock.Unlock()
+	var status driver.PowerStatus
+	err := observeDriverOp(ctx, node, "power_poll", func(ctx context.Context) (err error) {
+		status, err = readPowerStatus(ctx, node)
+		return
+	})
+	return status, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// The header carrying a request's ID. If the client (or a proxy in front of
+// us) supplies one, we use it; otherwise we generate one. Either way it is
+// sent back in the response.
+const requestIDHeader = "X-Request-ID"
+
+// The longest client-supplied request ID we accept.
+const maxRequestIDLen = 128
+
+// Generate a random request ID.
+func newRequestID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// Only used for correlating log lines, so we don't need
+		// to give up on the request.
+		return "unknown"
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Report whether a client-supplied request ID is reasonable to put in our
+// logs and response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Wrap `h`, assigning each request an ID and logging the outcome. The request's
+// context carries a logger which includes the ID, so everything logged while
+// handling the request can be correlated.
+//
+// Only the URL's path is logged, since the query string may contain a token.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := logging.With(req.Context(), "request_id", id)
+		req = req.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logging.FromContext(ctx).Info("Handled request.",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start))
+	})
+}
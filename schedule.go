@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+var (
+	ErrNoSuchSchedule  = errors.New("No such schedule.")
+	ErrInvalidSchedule = errors.New("Invalid schedule.")
+)
+
+const (
+	// How late a scheduled action may start. Runs which are due further in
+	// the past than this (e.g. because obmd was down at the time) are
+	// recorded as missed rather than carried out, since powering nodes
+	// off hours after the fact is likely to surprise someone.
+	scheduleGracePeriod = 10 * time.Minute
+
+	// The longest the scheduler sleeps without checking for due
+	// schedules, so that it copes with changes to the system clock.
+	maxSchedulerSleep = time.Minute
+
+	// The number of runs kept in each schedule's history.
+	maxScheduleRuns = 100
+)
+
+// The possible statuses of a ScheduleRun.
+const (
+	ScheduleRunOK     = "ok"     // The action succeeded on every node.
+	ScheduleRunFailed = "failed" // The action failed on at least one node.
+	ScheduleRunMissed = "missed" // The run was skipped; see scheduleGracePeriod.
+)
+
+// What a schedule does, and when. Exactly one of At (for a one-shot action)
+// and Cron (for a recurring one) must be set.
+type ScheduleSpec struct {
+	BulkPowerArgs
+
+	At *time.Time `json:"at,omitempty"`
+
+	// A cron expression (see ParseCron), interpreted in Timezone, which is
+	// an IANA time zone name, defaulting to UTC.
+	Cron     string `json:"cron,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// A power action to be carried out at some time(s) in the future.
+type Schedule struct {
+	ID string `json:"id"`
+	ScheduleSpec
+
+	// When the action is next due. nil once a one-shot schedule has run.
+	NextRun *time.Time `json:"next_run"`
+}
+
+// A record of a schedule being carried out (or not).
+type ScheduleRun struct {
+	ScheduledFor time.Time         `json:"scheduled_for"`
+	StartedAt    time.Time         `json:"started_at"`
+	Status       string            `json:"status"`
+	Results      []BulkPowerResult `json:"results"`
+}
+
+// Check that the spec is well-formed and refers to the future (relative to
+// `now`), returning ErrInvalidSchedule (or one of the errors returned by
+// BulkPowerArgs.validate) if not.
+func (spec *ScheduleSpec) validate(now time.Time) error {
+	if err := spec.BulkPowerArgs.validate(); err != nil {
+		return err
+	}
+	if spec.Nodes != nil && len(spec.Nodes) == 0 {
+		return ErrInvalidSchedule
+	}
+	switch {
+	case spec.At != nil && spec.Cron == "" && spec.Timezone == "":
+		if !spec.At.After(now) {
+			return ErrInvalidSchedule
+		}
+		return nil
+	case spec.At == nil && spec.Cron != "":
+		if spec.nextRun(now) == nil {
+			return ErrInvalidSchedule
+		}
+		return nil
+	default:
+		return ErrInvalidSchedule
+	}
+}
+
+// Get the first time after `after` at which the action is due, or nil if
+// there is none (or the spec is invalid).
+func (spec *ScheduleSpec) nextRun(after time.Time) *time.Time {
+	if spec.At != nil {
+		if !spec.At.After(after) {
+			return nil
+		}
+		at := spec.At.UTC()
+		return &at
+	}
+	expr, err := ParseCron(spec.Cron)
+	if err != nil {
+		return nil
+	}
+	loc, err := time.LoadLocation(spec.Timezone)
+	if err != nil {
+		return nil
+	}
+	next := expr.Next(after.In(loc))
+	if next.IsZero() {
+		return nil
+	}
+	next = next.UTC()
+	return &next
+}
+
+// Generate a random ID, for a new schedule or job.
+func newID() (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// Tell the scheduler that the set of schedules has changed, so it can
+// recompute when it next needs to wake up.
+func (d *Daemon) notifyScheduler() {
+	select {
+	case d.schedulesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Create a new schedule from `spec`.
+func (d *Daemon) CreateSchedule(ctx context.Context, spec ScheduleSpec) (Schedule, error) {
+	id, err := newID()
+	if err != nil {
+		return Schedule{}, err
+	}
+	return d.saveSchedule(ctx, id, spec, true)
+}
+
+// Replace the spec of an existing schedule. Its history is kept.
+func (d *Daemon) UpdateSchedule(ctx context.Context, id string, spec ScheduleSpec) (Schedule, error) {
+	return d.saveSchedule(ctx, id, spec, false)
+}
+
+func (d *Daemon) saveSchedule(ctx context.Context, id string, spec ScheduleSpec, create bool) (Schedule, error) {
+	now := time.Now()
+	if err := spec.validate(now); err != nil {
+		return Schedule{}, err
+	}
+	sched := &Schedule{
+		ID:           id,
+		ScheduleSpec: spec,
+		NextRun:      spec.nextRun(now),
+	}
+	d.Lock()
+	defer d.Unlock()
+	var err error
+	if create {
+		err = d.state.CreateSchedule(sched)
+	} else {
+		err = d.state.UpdateSchedule(sched)
+	}
+	if err != nil {
+		return Schedule{}, err
+	}
+	d.notifyScheduler()
+	logging.FromContext(ctx).Info("Saved schedule.",
+		"schedule", id, "action", spec.Action, "next_run", *sched.NextRun)
+	return *sched, nil
+}
+
+func (d *Daemon) DeleteSchedule(ctx context.Context, id string) error {
+	d.Lock()
+	defer d.Unlock()
+	err := d.state.DeleteSchedule(id)
+	if err == nil {
+		d.notifyScheduler()
+		logging.FromContext(ctx).Info("Deleted schedule.", "schedule", id)
+	}
+	return err
+}
+
+func (d *Daemon) GetSchedule(ctx context.Context, id string) (Schedule, error) {
+	d.Lock()
+	defer d.Unlock()
+	sched, ok := d.state.schedules[id]
+	if !ok {
+		return Schedule{}, ErrNoSuchSchedule
+	}
+	return *sched, nil
+}
+
+// List all schedules, sorted by ID.
+func (d *Daemon) ListSchedules(ctx context.Context) []Schedule {
+	d.Lock()
+	defer d.Unlock()
+	ret := []Schedule{}
+	for _, sched := range d.state.schedules {
+		ret = append(ret, *sched)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
+
+// Get the history of a schedule, most recent first.
+func (d *Daemon) GetScheduleRuns(ctx context.Context, id string, offset, limit int) ([]ScheduleRun, error) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.state.schedules[id]; !ok {
+		return nil, ErrNoSuchSchedule
+	}
+	return d.state.ScheduleRuns(id, offset, limit)
+}
+
+// Carry out schedules as they come due, until `ctx` is canceled. Waits for any
+// runs in progress to finish before returning.
+func (d *Daemon) RunScheduler(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		sleep := maxSchedulerSleep
+		next := d.runDueSchedules(ctx, time.Now(), &wg)
+		if until := time.Until(next); !next.IsZero() && until < sleep {
+			sleep = until
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.schedulesChanged:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Start running each schedule which is due at `now`, in the background,
+// adding them to `wg`. Returns the time at which the next schedule is due, or
+// the zero time if there are none.
+func (d *Daemon) runDueSchedules(ctx context.Context, now time.Time, wg *sync.WaitGroup) time.Time {
+	type dueRun struct {
+		sched Schedule
+		due   time.Time
+	}
+	var (
+		due  []dueRun
+		next time.Time
+	)
+	d.Lock()
+	for _, sched := range d.state.schedules {
+		if sched.NextRun != nil && !sched.NextRun.After(now) {
+			due = append(due, dueRun{*sched, *sched.NextRun})
+			// Any runs between the one that was due and now were
+			// missed entirely; skip them.
+			err := d.state.SetScheduleNextRun(sched.ID, sched.ScheduleSpec.nextRun(now))
+			if err != nil {
+				logging.FromContext(ctx).Error("Updating schedule.",
+					"schedule", sched.ID, "err", err)
+			}
+		}
+		if sched.NextRun != nil && (next.IsZero() || sched.NextRun.Before(next)) {
+			next = *sched.NextRun
+		}
+	}
+	d.Unlock()
+
+	for _, run := range due {
+		wg.Add(1)
+		go func(sched Schedule, due time.Time) {
+			defer wg.Done()
+			d.runSchedule(ctx, &sched, due, now)
+		}(run.sched, run.due)
+	}
+	return next
+}
+
+// Carry out a single run of `sched`, which was due at `due`, and record it in
+// the schedule's history.
+func (d *Daemon) runSchedule(ctx context.Context, sched *Schedule, due, now time.Time) {
+	ctx = logging.With(ctx, "schedule", sched.ID)
+	log := logging.FromContext(ctx)
+	run := ScheduleRun{
+		ScheduledFor: due,
+		StartedAt:    now,
+		Status:       ScheduleRunMissed,
+		Results:      []BulkPowerResult{},
+	}
+	if now.Sub(due) > scheduleGracePeriod {
+		log.Warn("Missed scheduled action.", "scheduled_for", due)
+	} else {
+		log.Info("Running scheduled action.", "action", sched.Action)
+		results, err := d.RunBulkPower(ctx, &sched.BulkPowerArgs)
+		run.Status = ScheduleRunOK
+		if err != nil {
+			// Only possible if the spec was invalid, which we
+			// checked when saving it.
+			log.Error("Running scheduled action.", "err", err)
+			run.Status = ScheduleRunFailed
+		}
+		for _, result := range results {
+			run.Results = append(run.Results, result)
+			if result.Error != "" {
+				run.Status = ScheduleRunFailed
+			}
+		}
+		if run.Status == ScheduleRunFailed {
+			log.Warn("Scheduled action failed on some nodes.")
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.state.schedules[sched.ID]; !ok {
+		// Deleted while we were running.
+		return
+	}
+	if err := d.state.RecordScheduleRun(sched.ID, &run); err != nil {
+		log.Error("Recording schedule run.", "err", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/mock"
+)
+
+func TestScheduleSpecValidate(t *testing.T) {
+	now := time.Date(2024, 1, 3, 10, 30, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	rack := "rack=r1"
+	badSelector := "rack==r1"
+	args := func(nodes []string, selector *string, action PowerAction) BulkPowerArgs {
+		return BulkPowerArgs{
+			Nodes:       nodes,
+			Selector:    selector,
+			Action:      action,
+			Concurrency: defaultBulkConcurrency,
+		}
+	}
+	node1 := []string{"node-1"}
+	cases := []struct {
+		name  string
+		spec  ScheduleSpec
+		valid bool
+	}{
+		{"one-shot", ScheduleSpec{BulkPowerArgs: args(node1, nil, PowerOff), At: &future}, true},
+		{"cron", ScheduleSpec{BulkPowerArgs: args(nil, &rack, PowerOn), Cron: "0 7 * * mon"}, true},
+		{"cron with timezone", ScheduleSpec{
+			BulkPowerArgs: args(node1, nil, PowerOn),
+			Cron:          "0 7 * * mon",
+			Timezone:      "America/New_York",
+		}, true},
+		{"past", ScheduleSpec{BulkPowerArgs: args(node1, nil, PowerOff), At: &past}, false},
+		{"no time", ScheduleSpec{BulkPowerArgs: args(node1, nil, PowerOff)}, false},
+		{"both times", ScheduleSpec{
+			BulkPowerArgs: args(node1, nil, PowerOff),
+			At:            &future,
+			Cron:          "@daily",
+		}, false},
+		{"bad cron", ScheduleSpec{BulkPowerArgs: args(node1, nil, PowerOff), Cron: "@never"}, false},
+		{"bad timezone", ScheduleSpec{
+			BulkPowerArgs: args(node1, nil, PowerOff),
+			Cron:          "@daily",
+			Timezone:      "Mars/Olympus_Mons",
+		}, false},
+		{"no nodes", ScheduleSpec{BulkPowerArgs: args([]string{}, nil, PowerOff), Cron: "@daily"}, false},
+		{"no targets", ScheduleSpec{BulkPowerArgs: args(nil, nil, PowerOff), Cron: "@daily"}, false},
+		{"bad selector", ScheduleSpec{BulkPowerArgs: args(nil, &badSelector, PowerOff), Cron: "@daily"}, false},
+		{"bad action", ScheduleSpec{BulkPowerArgs: args(node1, nil, "explode"), Cron: "@daily"}, false},
+	}
+	for _, v := range cases {
+		err := v.spec.validate(now)
+		if (err == nil) != v.valid {
+			t.Errorf("%s: wanted valid = %v, but got error %v", v.name, v.valid, err)
+		}
+	}
+}
+
+// Run the schedules due at `now` to completion.
+func runSchedulesAt(d *Daemon, now time.Time) {
+	var wg sync.WaitGroup
+	d.runDueSchedules(context.Background(), now, &wg)
+	wg.Wait()
+}
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	daemon := newDaemon()
+	for _, label := range []string{"sched-1", "sched-2"} {
+		info := []byte(`{"type": "ipmi", "info": {"addr": "` + label + `"}}`)
+		if err := daemon.SetNode(ctx, label, info); err != nil {
+			t.Fatal("SetNode:", err)
+		}
+	}
+	if err := daemon.SetNodeMetadata(ctx, "sched-2", "rack", "r1"); err != nil {
+		t.Fatal("SetNodeMetadata:", err)
+	}
+
+	// Schedule both for an hour from now:
+	at := time.Now().UTC().Add(time.Hour).Truncate(time.Minute)
+	cron := fmt.Sprintf("%d %d * * *", at.Minute(), at.Hour())
+	oneShot, err := daemon.CreateSchedule(ctx, ScheduleSpec{
+		BulkPowerArgs: BulkPowerArgs{
+			Nodes:       []string{"sched-1", "no-such-node"},
+			Action:      PowerOff,
+			Concurrency: defaultBulkConcurrency,
+		},
+		At: &at,
+	})
+	if err != nil {
+		t.Fatal("CreateSchedule:", err)
+	}
+	rack := "rack=r1"
+	recurring, err := daemon.CreateSchedule(ctx, ScheduleSpec{
+		BulkPowerArgs: BulkPowerArgs{
+			Selector:    &rack,
+			Action:      PowerOn,
+			Concurrency: defaultBulkConcurrency,
+		},
+		Cron: cron,
+	})
+	if err != nil {
+		t.Fatal("CreateSchedule:", err)
+	}
+
+	// Nothing is due yet:
+	runSchedulesAt(daemon, time.Now())
+	if _, ok := mock.LastPowerActions["sched-1"]; ok {
+		t.Fatal("One-shot schedule ran early.")
+	}
+
+	runSchedulesAt(daemon, at)
+	if mock.LastPowerActions["sched-1"] != mock.Off || mock.LastPowerActions["sched-2"] != mock.On {
+		t.Fatalf("Scheduled actions not carried out: %v", mock.LastPowerActions)
+	}
+	oneShot, _ = daemon.GetSchedule(ctx, oneShot.ID)
+	if oneShot.NextRun != nil {
+		t.Fatalf("One-shot schedule still has a next run: %v", oneShot.NextRun)
+	}
+	runs, err := daemon.GetScheduleRuns(ctx, oneShot.ID, 0, 10)
+	if err != nil {
+		t.Fatal("GetScheduleRuns:", err)
+	}
+	if len(runs) != 1 || runs[0].Status != ScheduleRunFailed || len(runs[0].Results) != 2 ||
+		runs[0].Results[1].Status != http.StatusNotFound {
+		t.Fatalf("Unexpected history for one-shot schedule: %+v", runs)
+	}
+
+	// Schedules survive a restart:
+	state, err := NewState(daemon.state.db, driver.Registry{"ipmi": mock.Driver})
+	if err != nil {
+		t.Fatal("NewState:", err)
+	}
+	restarted := NewDaemon(state, testRetryPolicy(), time.Minute)
+	reloaded, err := restarted.GetSchedule(ctx, recurring.ID)
+	if err != nil {
+		t.Fatal("GetSchedule after restart:", err)
+	}
+	if reloaded.NextRun == nil || !reloaded.NextRun.After(at) || reloaded.Cron != cron {
+		t.Fatalf("Unexpected schedule after restart: %+v", reloaded)
+	}
+
+	// If we were down for a day, the run is recorded as missed:
+	runSchedulesAt(restarted, reloaded.NextRun.Add(24*time.Hour))
+	runs, err = restarted.GetScheduleRuns(ctx, recurring.ID, 0, 10)
+	if err != nil {
+		t.Fatal("GetScheduleRuns:", err)
+	}
+	if len(runs) != 2 || runs[0].Status != ScheduleRunMissed || runs[1].Status != ScheduleRunOK {
+		t.Fatalf("Unexpected history for recurring schedule: %+v", runs)
+	}
+
+	if err = restarted.DeleteSchedule(ctx, recurring.ID); err != nil {
+		t.Fatal("DeleteSchedule:", err)
+	}
+	if _, err = restarted.GetScheduleRuns(ctx, recurring.ID, 0, 10); err != ErrNoSuchSchedule {
+		t.Fatalf("Wanted ErrNoSuchSchedule after deleting, but got %v", err)
+	}
+}
+
+// Exactly maxScheduleRuns runs are kept, even if several started in the same
+// second.
+func TestScheduleRunsPruned(t *testing.T) {
+	state := newDaemon().state
+	started := time.Date(2024, 1, 3, 10, 30, 0, 0, time.UTC)
+	extra := 5
+	for i := 0; i < maxScheduleRuns+extra; i++ {
+		run := &ScheduleRun{
+			ScheduledFor: started.Add(time.Duration(i) * time.Second),
+			StartedAt:    started,
+			Status:       ScheduleRunOK,
+			Results:      []BulkPowerResult{},
+		}
+		if err := state.RecordScheduleRun("some-schedule", run); err != nil {
+			t.Fatal("RecordScheduleRun:", err)
+		}
+	}
+	runs, err := state.ScheduleRuns("some-schedule", 0, 2*maxScheduleRuns)
+	if err != nil {
+		t.Fatal("ScheduleRuns:", err)
+	}
+	if len(runs) != maxScheduleRuns {
+		t.Fatalf("Wanted %d runs, but got %d", maxScheduleRuns, len(runs))
+	}
+	// The most recently recorded are kept, newest first:
+	newest := started.Add(time.Duration(maxScheduleRuns+extra-1) * time.Second)
+	oldest := started.Add(time.Duration(extra) * time.Second)
+	if !runs[0].ScheduledFor.Equal(newest) || !runs[len(runs)-1].ScheduledFor.Equal(oldest) {
+		t.Fatalf("Wanted runs scheduled from %v back to %v, but got %v back to %v",
+			newest, oldest, runs[0].ScheduledFor, runs[len(runs)-1].ScheduledFor)
+	}
+}
+
+func TestScheduleEndpoints(t *testing.T) {
+	handler := newHandler()
+	resp := adminReq(handler, requestSpec{"POST", "http://localhost/schedules", `{
+		"nodes": ["node-1"],
+		"action": "power_cycle",
+		"cron": "0 2 * * *"
+	}`})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Creating schedule: status %d", resp.Code)
+	}
+	var sched Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&sched); err != nil {
+		t.Fatal("Decoding schedule:", err)
+	}
+	if sched.ID == "" || sched.NextRun == nil || sched.NextRun.Hour() != 2 ||
+		sched.Concurrency != defaultBulkConcurrency {
+		t.Fatalf("Unexpected schedule: %+v", sched)
+	}
+
+	url := "http://localhost/schedule/" + sched.ID
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"GET", url, ""})
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"GET", url + "/runs", ""})
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{"PUT", url, `{
+		"nodes": ["node-1"],
+		"action": "power_cycle",
+		"cron": "0 25 * * *"
+	}`})
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"PUT", url, `{
+		"selector": "rack=r1",
+		"action": "power_off",
+		"cron": "0 18 * * fri"
+	}`})
+
+	resp = adminReq(handler, requestSpec{"GET", "http://localhost/schedules", ""})
+	var list SchedulesResp
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal("Decoding schedule list:", err)
+	}
+	if len(list.Schedules) != 1 || list.Schedules[0].Action != PowerOff {
+		t.Fatalf("Unexpected schedule list: %+v", list)
+	}
+
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"DELETE", url, ""})
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{"GET", url, ""})
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{"DELETE", url, ""})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+// A change to the database schema.
+type migration struct {
+	// A short description, for logging.
+	description string
+
+	// SQL statements to run, keyed by database type (the value of DB_TYPE).
+	// Statements under "" are used for database types not listed
+	// explicitly, so migrations which don't need to care about dialect
+	// differences can just use that.
+	stmts map[string][]string
+}
+
+// All schema migrations, in order. Applying migrations[i] takes the schema
+// from version i to version i+1, so the version of the current schema is
+// len(migrations). Never edit or remove a migration once it has been
+// released; add a new one instead.
+var migrations = []migration{
+	{
+		// Databases created before we tracked schema versions already
+		// have the first two tables, hence IF NOT EXISTS.
+		description: "Create nodes table",
+		stmts: map[string][]string{"": {
+			`CREATE TABLE IF NOT EXISTS nodes (
+				label VARCHAR(80) PRIMARY KEY,
+				obm_info TEXT NOT NULL
+			)`,
+		}},
+	},
+	{
+		// Cached hardware inventory for each node. The inventory is
+		// stored as JSON, and read_at is a unix timestamp.
+		description: "Create node_inventory table",
+		stmts: map[string][]string{"": {
+			`CREATE TABLE IF NOT EXISTS node_inventory (
+				label VARCHAR(80) PRIMARY KEY,
+				inventory TEXT NOT NULL,
+				read_at BIGINT NOT NULL
+			)`,
+		}},
+	},
+	{
+		// Arbitrary key/value metadata for each node, as a JSON object.
+		description: "Add metadata to nodes",
+		stmts: map[string][]string{"": {
+			`ALTER TABLE nodes ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}'`,
+		}},
+	},
+	{
+		// Scheduled power actions, and their history. spec is a
+		// ScheduleSpec as JSON, and results a list of BulkPowerResults.
+		// Times are unix timestamps; next_run is NULL once a one-shot
+		// schedule has run.
+		description: "Create schedules tables",
+		stmts: map[string][]string{"": {
+			`CREATE TABLE schedules (
+				id VARCHAR(32) PRIMARY KEY,
+				spec TEXT NOT NULL,
+				next_run BIGINT
+			)`,
+			`CREATE TABLE schedule_runs (
+				schedule_id VARCHAR(32) NOT NULL,
+				scheduled_for BIGINT NOT NULL,
+				started_at BIGINT NOT NULL,
+				status VARCHAR(16) NOT NULL,
+				results TEXT NOT NULL
+			)`,
+			`CREATE INDEX schedule_runs_schedule_id ON schedule_runs(schedule_id)`,
+		}},
+	},
+	{
+		// Power-on sequences. spec is a Sequence as JSON.
+		description: "Create sequences table",
+		stmts: map[string][]string{"": {
+			`CREATE TABLE sequences (
+				name VARCHAR(80) PRIMARY KEY,
+				spec TEXT NOT NULL
+			)`,
+		}},
+	},
+	{
+		// Webhooks. spec is a WebhookSpec as JSON.
+		description: "Create webhooks table",
+		stmts: map[string][]string{"": {
+			`CREATE TABLE webhooks (
+				id VARCHAR(32) PRIMARY KEY,
+				spec TEXT NOT NULL
+			)`,
+		}},
+	},
+	{
+		// Runs may start in the same second, so started_at alone
+		// doesn't order them; id is increasing in the order runs are
+		// recorded. sqlite can't add a primary key to an existing
+		// table, so there we copy the table instead.
+		description: "Add id to schedule_runs",
+		stmts: map[string][]string{
+			"postgres": {
+				`ALTER TABLE schedule_runs ADD COLUMN id BIGSERIAL PRIMARY KEY`,
+			},
+			"sqlite3": {
+				`CREATE TABLE schedule_runs_new (
+					id INTEGER PRIMARY KEY,
+					schedule_id VARCHAR(32) NOT NULL,
+					scheduled_for BIGINT NOT NULL,
+					started_at BIGINT NOT NULL,
+					status VARCHAR(16) NOT NULL,
+					results TEXT NOT NULL
+				)`,
+				`INSERT INTO schedule_runs_new(schedule_id, scheduled_for, started_at, status, results)
+					SELECT schedule_id, scheduled_for, started_at, status, results
+					FROM schedule_runs ORDER BY rowid`,
+				`DROP TABLE schedule_runs`,
+				`ALTER TABLE schedule_runs_new RENAME TO schedule_runs`,
+				`CREATE INDEX schedule_runs_schedule_id ON schedule_runs(schedule_id)`,
+			},
+		},
+	},
+}
+
+// The version of the schema this version of obmd expects.
+func currentSchemaVersion() int {
+	return len(migrations)
+}
+
+// An error indicating that the database's schema is not the version we expect.
+type schemaVersionError struct {
+	actual, expected int
+}
+
+func (e schemaVersionError) Error() string {
+	if e.actual > e.expected {
+		return fmt.Sprintf("The database schema is at version %d, which is newer "+
+			"than this version of obmd understands (%d). Refusing to use it; "+
+			"upgrade obmd.", e.actual, e.expected)
+	}
+	return fmt.Sprintf("The database schema is at version %d, but this version "+
+		"of obmd requires version %d. Run obmd with -migrate, or set "+
+		"AUTO_MIGRATE=true, to upgrade it.", e.actual, e.expected)
+}
+
+// Create the schema_version table, if it doesn't already exist. The table
+// has (at most) one row, holding the current version; if it is empty, the
+// version is zero.
+func createSchemaVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL
+	)`)
+	return err
+}
+
+// Get the version of the database's schema.
+func schemaVersion(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (int, error) {
+	var version int
+	err := q.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Check that the database's schema is the version we expect, returning a
+// schemaVersionError if it isn't.
+func checkSchema(db *sql.DB) error {
+	if err := createSchemaVersionTable(db); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version != currentSchemaVersion() {
+		return schemaVersionError{actual: version, expected: currentSchemaVersion()}
+	}
+	return nil
+}
+
+// Bring the database's schema up to date, by applying any migrations which
+// haven't been applied yet. `dbType` is the type of the database, as in
+// DB_TYPE. Each migration is applied in its own transaction, so if one
+// fails, the schema is left at the last version which succeeded.
+//
+// Returns a schemaVersionError if the schema is newer than we understand.
+func migrateSchema(ctx context.Context, db *sql.DB, dbType string) error {
+	if err := createSchemaVersionTable(db); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > currentSchemaVersion() {
+		return schemaVersionError{actual: version, expected: currentSchemaVersion()}
+	}
+	for ; version < currentSchemaVersion(); version++ {
+		m := migrations[version]
+		logging.FromContext(ctx).Info("Migrating database schema.",
+			"version", version+1, "description", m.description)
+		if err := applyMigration(db, dbType, version, m); err != nil {
+			return fmt.Errorf("Migrating database schema to version %d (%s): %v",
+				version+1, m.description, err)
+		}
+	}
+	return nil
+}
+
+// Apply the migration `m`, which takes the schema from version `from` to
+// `from+1`.
+func applyMigration(db *sql.DB, dbType string, from int, m migration) error {
+	stmts, ok := m.stmts[dbType]
+	if !ok {
+		stmts = m.stmts[""]
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Make sure nobody else migrated the schema while we weren't looking:
+	version, err := schemaVersion(tx)
+	if err == nil && version != from {
+		err = fmt.Errorf("schema version changed from %d to %d while migrating", from, version)
+	}
+	for i := 0; err == nil && i < len(stmts); i++ {
+		_, err = tx.Exec(stmts[i])
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM schema_version")
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO schema_version(version) VALUES ($1)", from+1)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/mock"
+)
+
+// Open a fresh in-memory database. sqlite gives each connection to ":memory:"
+// its own database, so we limit the pool to one connection.
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("Opening database:", err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+// Check that migrating a fresh database brings it up to date, that doing so
+// again is a no-op, and that NewState insists on an up to date schema.
+func TestMigrate(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	registry := driver.Registry{"ipmi": mock.Driver}
+
+	_, err := NewState(db, registry)
+	if _, ok := err.(schemaVersionError); !ok {
+		t.Fatalf("NewState on an empty database: wanted a schemaVersionError, but got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := migrateSchema(context.Background(), db, "sqlite3"); err != nil {
+			t.Fatalf("Migrating (pass %d): %v", i, err)
+		}
+		version, err := schemaVersion(db)
+		if err != nil {
+			t.Fatal("Getting schema version:", err)
+		}
+		if version != currentSchemaVersion() {
+			t.Fatalf("Wanted version %d but got %d.", currentSchemaVersion(), version)
+		}
+	}
+	state, err := NewState(db, registry)
+	if err != nil {
+		t.Fatal("NewState after migrating:", err)
+	}
+	state.Close()
+}
+
+// Check that databases created before schema versioning are adopted, keeping
+// their nodes.
+func TestMigrateUnversioned(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	_, err := db.Exec(`CREATE TABLE nodes (
+		label VARCHAR(80) PRIMARY KEY,
+		obm_info TEXT NOT NULL
+	)`)
+	if err != nil {
+		t.Fatal("Creating nodes table:", err)
+	}
+	_, err = db.Exec(`INSERT INTO nodes(label, obm_info) VALUES ($1, $2)`,
+		"somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.3"}}`)
+	if err != nil {
+		t.Fatal("Inserting node:", err)
+	}
+
+	if err := migrateSchema(context.Background(), db, "sqlite3"); err != nil {
+		t.Fatal("Migrating:", err)
+	}
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver})
+	if err != nil {
+		t.Fatal("NewState after migrating:", err)
+	}
+	defer state.Close()
+	if _, err := state.GetNode("somenode"); err != nil {
+		t.Fatal("Node was lost in migration:", err)
+	}
+}
+
+// Check that we refuse to touch a schema newer than we understand.
+func TestSchemaTooNew(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	if err := migrateSchema(context.Background(), db, "sqlite3"); err != nil {
+		t.Fatal("Migrating:", err)
+	}
+	_, err := db.Exec("UPDATE schema_version SET version = $1", currentSchemaVersion()+1)
+	if err != nil {
+		t.Fatal("Updating schema version:", err)
+	}
+
+	err = migrateSchema(context.Background(), db, "sqlite3")
+	if _, ok := err.(schemaVersionError); !ok {
+		t.Fatalf("Migrating: wanted a schemaVersionError, but got %v", err)
+	}
+	_, err = NewState(db, driver.Registry{"ipmi": mock.Driver})
+	if _, ok := err.(schemaVersionError); !ok {
+		t.Fatalf("NewState: wanted a schemaVersionError, but got %v", err)
+	}
+}
+
+// Check that schedule history recorded before runs had ids survives adding
+// them.
+func TestMigrateScheduleRunIDs(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	if err := createSchemaVersionTable(db); err != nil {
+		t.Fatal("Creating schema_version table:", err)
+	}
+	last := currentSchemaVersion() - 1
+	for version := 0; version < last; version++ {
+		if err := applyMigration(db, "sqlite3", version, migrations[version]); err != nil {
+			t.Fatalf("Migrating to version %d: %v", version+1, err)
+		}
+	}
+	_, err := db.Exec(`INSERT INTO schedule_runs(schedule_id, scheduled_for, started_at, status, results)
+		VALUES ($1, $2, $3, $4, $5)`, "some-schedule", 1000, 1000, ScheduleRunOK, "[]")
+	if err != nil {
+		t.Fatal("Inserting run:", err)
+	}
+
+	if err = migrateSchema(context.Background(), db, "sqlite3"); err != nil {
+		t.Fatal("Migrating:", err)
+	}
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver})
+	if err != nil {
+		t.Fatal("NewState after migrating:", err)
+	}
+	defer state.Close()
+	runs, err := state.ScheduleRuns("some-schedule", 0, 10)
+	if err != nil || len(runs) != 1 || runs[0].StartedAt.Unix() != 1000 {
+		t.Fatalf("Run was lost in migration: got %+v (error %v)", runs, err)
+	}
+}
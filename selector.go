@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrInvalidMetadata = errors.New("Invalid metadata key or value.")
+	ErrInvalidSelector = errors.New("Invalid selector.")
+)
+
+// Limits on the size of metadata keys and values.
+const (
+	maxMetadataKeyLen   = 63
+	maxMetadataValueLen = 255
+)
+
+// Report whether `key` is a valid metadata key: 1-63 letters, digits, '.', '_'
+// and '-', starting and ending with a letter or digit.
+func validMetadataKey(key string) bool {
+	if key == "" || len(key) > maxMetadataKeyLen {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case i != 0 && i != len(key)-1 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether `value` is a valid metadata value: at most 255 printable
+// characters, not including commas or equals signs (which have special
+// meanings in selectors), nor leading or trailing spaces (which ParseSelector
+// ignores, so such values could never be selected). Values may be empty.
+func validMetadataValue(value string) bool {
+	if len(value) > maxMetadataValueLen || strings.TrimSpace(value) != value {
+		return false
+	}
+	for _, c := range value {
+		if c == ',' || c == '=' || !unicode.IsPrint(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// The kinds of requirement a selector can make of a key.
+type selectorOp int
+
+const (
+	selectEquals    selectorOp = iota // key=value
+	selectNotEquals                   // key!=value
+	selectExists                      // key
+	selectNotExists                   // !key
+)
+
+type requirement struct {
+	op    selectorOp
+	key   string
+	value string
+}
+
+// A Selector picks out nodes by their metadata. It is a comma-separated list
+// of requirements, all of which must hold:
+//
+//	key=value   the node has `key`, and its value is `value`
+//	key!=value  the node doesn't have `key`, or its value isn't `value`
+//	key         the node has `key`
+//	!key        the node doesn't have `key`
+//
+// The empty selector matches every node.
+type Selector []requirement
+
+// Parse a selector, as described above. Returns ErrInvalidSelector if `s` is
+// malformed.
+func ParseSelector(s string) (Selector, error) {
+	if strings.TrimSpace(s) == "" {
+		return Selector{}, nil
+	}
+	var sel Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var req requirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			req = requirement{selectNotEquals, kv[0], kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			req = requirement{selectEquals, kv[0], kv[1]}
+		case strings.HasPrefix(part, "!"):
+			req = requirement{op: selectNotExists, key: part[1:]}
+		default:
+			req = requirement{op: selectExists, key: part}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if !validMetadataKey(req.key) || !validMetadataValue(req.value) {
+			return nil, ErrInvalidSelector
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Report whether the metadata `md` satisfies the selector.
+func (sel Selector) Matches(md map[string]string) bool {
+	for _, req := range sel {
+		value, ok := md[req.key]
+		var matches bool
+		switch req.op {
+		case selectEquals:
+			matches = ok && value == req.value
+		case selectNotEquals:
+			matches = !ok || value != req.value
+		case selectExists:
+			matches = ok
+		case selectNotExists:
+			matches = !ok
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
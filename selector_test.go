@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	md := map[string]string{
+		"rack":    "r12",
+		"project": "",
+	}
+	cases := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"rack=r12", true},
+		{"rack = r12", true},
+		{"rack=r13", false},
+		{"rack!=r13", true},
+		{"row!=3", true},
+		{"rack", true},
+		{"row", false},
+		{"!row", true},
+		{"!rack", false},
+		{"project=", true},
+		{"rack=r12,project", true},
+		{"rack=r12,!project", false},
+	}
+	for _, v := range cases {
+		sel, err := ParseSelector(v.selector)
+		if err != nil {
+			t.Fatalf("Parsing %q: %v", v.selector, err)
+		}
+		if sel.Matches(md) != v.matches {
+			t.Fatalf("Selector %q: wanted match = %v", v.selector, v.matches)
+		}
+	}
+
+	for _, bad := range []string{"=r12", "rack=r12,", "!", "ra ck", "rack==r12", "-rack"} {
+		if _, err := ParseSelector(bad); err != ErrInvalidSelector {
+			t.Fatalf("Parsing %q: wanted ErrInvalidSelector but got %v", bad, err)
+		}
+	}
+}
+
+// Every valid value can be selected, so values can't have the surrounding
+// spaces ParseSelector ignores.
+func TestValidMetadataValue(t *testing.T) {
+	cases := []struct {
+		value string
+		valid bool
+	}{
+		{"", true},
+		{"r12", true},
+		{"rack 12", true},
+		{" r12", false},
+		{"r12 ", false},
+		{" ", false},
+		{"r=12", false},
+		{"r,12", false},
+	}
+	for _, v := range cases {
+		if validMetadataValue(v.value) != v.valid {
+			t.Fatalf("validMetadataValue(%q): wanted %v", v.value, v.valid)
+		}
+		if !v.valid {
+			continue
+		}
+		sel, err := ParseSelector("rack=" + v.value)
+		if err != nil {
+			t.Fatalf("Parsing a selector for %q: %v", v.value, err)
+		}
+		if !sel.Matches(map[string]string{"rack": v.value}) {
+			t.Fatalf("Value %q can't be selected.", v.value)
+		}
+	}
+}
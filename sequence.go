@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+var (
+	ErrNoSuchSequence  = errors.New("No such sequence.")
+	ErrInvalidSequence = errors.New("Invalid sequence.")
+	ErrNoSuchJob       = errors.New("No such job.")
+	ErrJobFinished     = errors.New("The job has already finished.")
+
+	// Recorded when a group's nodes don't all report being powered on
+	// before its wait_timeout_ms elapses.
+	errWaitTimedOut = errors.New("Timed out waiting for nodes to power on.")
+)
+
+const (
+	// The longest sequence name we accept; this matches the size of the
+	// database column.
+	maxSequenceNameLen = 80
+
+	// How long a group waits for its nodes to power on, if it doesn't
+	// say.
+	defaultSequenceWaitTimeout = 5 * time.Minute
+
+	// The number of finished jobs we remember.
+	maxFinishedJobs = 100
+)
+
+// How often to check nodes' power status while waiting for them to power on.
+// This is a variable so tests can shorten it.
+var sequencePollInterval = 2 * time.Second
+
+// The possible statuses of a job, and of each group within it.
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+
+	GroupPending    = "pending"
+	GroupPoweringOn = "powering_on"
+	GroupWaiting    = "waiting"
+	GroupDelaying   = "delaying"
+	GroupDone       = "done"
+	GroupFailed     = "failed"
+	GroupSkipped    = "skipped"
+)
+
+// One step of a power-on sequence: a set of nodes which are powered on
+// together. Exactly one of Nodes and Selector must be set.
+type SequenceGroup struct {
+	Nodes       []string `json:"nodes,omitempty"`
+	Selector    *string  `json:"selector,omitempty"`
+	Concurrency int      `json:"concurrency"`
+	StaggerMs   int      `json:"stagger_ms"`
+
+	// If set, don't move on to the next group until every node in this
+	// one reports that it is powered on, failing the job if that takes
+	// longer than WaitTimeoutMs (default 5 minutes).
+	WaitForOn     bool `json:"wait_for_on"`
+	WaitTimeoutMs int  `json:"wait_timeout_ms"`
+
+	// How long to wait after powering on the group (and waiting for it, if
+	// WaitForOn is set) before moving on to the next one.
+	DelayMs int `json:"delay_ms"`
+}
+
+// An ordered list of groups of nodes to power on, e.g. storage before
+// compute.
+type Sequence struct {
+	Name   string          `json:"name"`
+	Groups []SequenceGroup `json:"groups"`
+}
+
+// The progress of one group within a job.
+type JobGroup struct {
+	Status  string            `json:"status"`
+	Results []BulkPowerResult `json:"results"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// A run of a sequence.
+type Job struct {
+	ID         string     `json:"id"`
+	Sequence   string     `json:"sequence"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Groups     []JobGroup `json:"groups"`
+
+	cancel context.CancelFunc
+}
+
+// Get the arguments for powering on the group.
+func (g *SequenceGroup) args() BulkPowerArgs {
+	return BulkPowerArgs{
+		Nodes:       g.Nodes,
+		Selector:    g.Selector,
+		Action:      PowerOn,
+		Concurrency: g.Concurrency,
+		StaggerMs:   g.StaggerMs,
+	}
+}
+
+// Check that the sequence is well-formed, returning ErrInvalidSequence (or one
+// of the errors returned by BulkPowerArgs.validate) if not.
+func (seq *Sequence) validate() error {
+	if seq.Name == "" || len(seq.Name) > maxSequenceNameLen || len(seq.Groups) == 0 {
+		return ErrInvalidSequence
+	}
+	for _, g := range seq.Groups {
+		args := g.args()
+		if err := args.validate(); err != nil {
+			return err
+		}
+		if g.WaitTimeoutMs < 0 || g.DelayMs < 0 {
+			return ErrInvalidSequence
+		}
+	}
+	return nil
+}
+
+// Create or replace the sequence `seq`.
+func (d *Daemon) SetSequence(ctx context.Context, seq Sequence) error {
+	for i := range seq.Groups {
+		if seq.Groups[i].Concurrency == 0 {
+			seq.Groups[i].Concurrency = defaultBulkConcurrency
+		}
+	}
+	if err := seq.validate(); err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	err := d.state.SetSequence(&seq)
+	if err == nil {
+		logging.FromContext(ctx).Info("Saved sequence.", "sequence", seq.Name)
+	}
+	return err
+}
+
+func (d *Daemon) GetSequence(ctx context.Context, name string) (Sequence, error) {
+	d.Lock()
+	defer d.Unlock()
+	seq, ok := d.state.sequences[name]
+	if !ok {
+		return Sequence{}, ErrNoSuchSequence
+	}
+	return *seq, nil
+}
+
+// List all sequences, sorted by name.
+func (d *Daemon) ListSequences(ctx context.Context) []Sequence {
+	d.Lock()
+	defer d.Unlock()
+	ret := []Sequence{}
+	for _, seq := range d.state.sequences {
+		ret = append(ret, *seq)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Delete a sequence. Jobs already running it are unaffected.
+func (d *Daemon) DeleteSequence(ctx context.Context, name string) error {
+	d.Lock()
+	defer d.Unlock()
+	err := d.state.DeleteSequence(name)
+	if err == nil {
+		logging.FromContext(ctx).Info("Deleted sequence.", "sequence", name)
+	}
+	return err
+}
+
+// Make a copy of a job, safe to hand out while it is still running. Must be
+// called with the daemon's lock held.
+func (job *Job) snapshot() Job {
+	ret := *job
+	ret.Groups = make([]JobGroup, len(job.Groups))
+	for i, g := range job.Groups {
+		ret.Groups[i] = g
+		ret.Groups[i].Results = append([]BulkPowerResult{}, g.Results...)
+	}
+	if job.FinishedAt != nil {
+		finishedAt := *job.FinishedAt
+		ret.FinishedAt = &finishedAt
+	}
+	return ret
+}
+
+// Start running the named sequence in the background, returning the new job.
+// The job is not tied to `ctx`, other than for logging; see CancelJob.
+func (d *Daemon) StartSequence(ctx context.Context, name string) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	d.Lock()
+	defer d.Unlock()
+	seq, ok := d.state.sequences[name]
+	if !ok {
+		return Job{}, ErrNoSuchSequence
+	}
+	ctx = logging.NewContext(context.Background(), logging.FromContext(ctx).With("job", id))
+	ctx, cancel := context.WithCancel(ctx)
+	job := &Job{
+		ID:        id,
+		Sequence:  name,
+		Status:    JobRunning,
+		StartedAt: time.Now().UTC(),
+		Groups:    make([]JobGroup, len(seq.Groups)),
+		cancel:    cancel,
+	}
+	for i := range job.Groups {
+		job.Groups[i] = JobGroup{Status: GroupPending, Results: []BulkPowerResult{}}
+	}
+	d.jobs[id] = job
+	d.pruneJobs()
+	d.jobsWG.Add(1)
+	go func(seq Sequence) {
+		defer d.jobsWG.Done()
+		d.runSequence(ctx, job, &seq)
+	}(*seq)
+	logging.FromContext(ctx).Info("Started sequence.", "sequence", name)
+	return job.snapshot(), nil
+}
+
+// Forget the oldest finished jobs, if there are more than maxFinishedJobs.
+// Must be called with the daemon's lock held.
+func (d *Daemon) pruneJobs() {
+	finished := []*Job{}
+	for _, job := range d.jobs {
+		if job.FinishedAt != nil {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(*finished[j].FinishedAt)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(d.jobs, job.ID)
+	}
+}
+
+func (d *Daemon) GetJob(ctx context.Context, id string) (Job, error) {
+	d.Lock()
+	defer d.Unlock()
+	job, ok := d.jobs[id]
+	if !ok {
+		return Job{}, ErrNoSuchJob
+	}
+	return job.snapshot(), nil
+}
+
+// List all jobs we remember, most recently started first.
+func (d *Daemon) ListJobs(ctx context.Context) []Job {
+	d.Lock()
+	defer d.Unlock()
+	ret := []Job{}
+	for _, job := range d.jobs {
+		ret = append(ret, job.snapshot())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].StartedAt.After(ret[j].StartedAt)
+	})
+	return ret
+}
+
+// Abort a running job. Operations already in progress are allowed to finish,
+// but nothing further is started.
+func (d *Daemon) CancelJob(ctx context.Context, id string) error {
+	d.Lock()
+	defer d.Unlock()
+	job, ok := d.jobs[id]
+	if !ok {
+		return ErrNoSuchJob
+	}
+	if job.FinishedAt != nil {
+		return ErrJobFinished
+	}
+	job.cancel()
+	logging.FromContext(ctx).Info("Canceling job.", "job", id)
+	return nil
+}
+
+// Update a job's state, with the daemon's lock held.
+func (d *Daemon) updateJob(f func()) {
+	d.Lock()
+	defer d.Unlock()
+	f()
+}
+
+// Carry out `seq`, recording progress in `job`.
+func (d *Daemon) runSequence(ctx context.Context, job *Job, seq *Sequence) {
+	log := logging.FromContext(ctx)
+	status := JobSucceeded
+	for i := range seq.Groups {
+		err := d.runSequenceGroup(ctx, job, i, &seq.Groups[i])
+		if err == nil {
+			continue
+		}
+		status = JobFailed
+		if ctx.Err() != nil {
+			status = JobCanceled
+		}
+		log.Warn("Sequence aborted.", "group", i, "status", status, "err", err)
+		d.updateJob(func() {
+			job.Groups[i].Status = GroupFailed
+			job.Groups[i].Error = err.Error()
+			for j := i + 1; j < len(job.Groups); j++ {
+				job.Groups[j].Status = GroupSkipped
+			}
+		})
+		break
+	}
+	d.updateJob(func() {
+		now := time.Now().UTC()
+		job.Status = status
+		job.FinishedAt = &now
+		job.cancel()
+	})
+	log.Info("Finished sequence.", "status", status)
+}
+
+// Carry out the `i`th group of a sequence. Returns an error if the group
+// failed, in which case the job should be aborted.
+func (d *Daemon) runSequenceGroup(ctx context.Context, job *Job, i int, g *SequenceGroup) error {
+	setStatus := func(status string) {
+		d.updateJob(func() { job.Groups[i].Status = status })
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	setStatus(GroupPoweringOn)
+	args := g.args()
+	results, err := d.RunBulkPower(ctx, &args)
+	if err != nil {
+		return err
+	}
+	d.updateJob(func() { job.Groups[i].Results = results })
+	labels := make([]string, len(results))
+	for j, result := range results {
+		if result.Error != "" {
+			return errors.New(result.Node + ": " + result.Error)
+		}
+		labels[j] = result.Node
+	}
+
+	if g.WaitForOn {
+		setStatus(GroupWaiting)
+		timeout := defaultSequenceWaitTimeout
+		if g.WaitTimeoutMs > 0 {
+			timeout = time.Duration(g.WaitTimeoutMs) * time.Millisecond
+		}
+		if err := d.waitForPowerOn(ctx, labels, timeout); err != nil {
+			return err
+		}
+	}
+
+	if g.DelayMs > 0 {
+		setStatus(GroupDelaying)
+		select {
+		case <-time.After(time.Duration(g.DelayMs) * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	setStatus(GroupDone)
+	return nil
+}
+
+// Wait until each of the nodes in `labels` reports that it is powered on,
+// returning errWaitTimedOut if that takes longer than `timeout`.
+func (d *Daemon) waitForPowerOn(ctx context.Context, labels []string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for len(labels) > 0 {
+		pending := labels[:0]
+		for _, label := range labels {
+			state, err := d.nodePowerState(ctx, label)
+			if err != nil || state != driver.PowerOn {
+				// Errors may be transient (e.g. the BMC is
+				// busy while the node boots), so keep trying
+				// until the deadline.
+				pending = append(pending, label)
+			}
+		}
+		labels = pending
+		if len(labels) == 0 {
+			break
+		}
+		select {
+		case <-time.After(sequencePollInterval):
+		case <-deadline:
+			return errWaitTimedOut
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Get the power state of a node, without needing its token.
+func (d *Daemon) nodePowerState(ctx context.Context, label string) (driver.PowerState, error) {
+	d.Lock()
+	node, err := d.state.GetNode(label)
+	d.Unlock()
+	if err != nil {
+		return driver.PowerUnknown, err
+	}
+	var status driver.PowerStatus
+	err = d.runOnNode(ctx, node, "power_status", func(ctx context.Context, n *Node) (err error) {
+		status, err = readPowerStatus(ctx, n)
+		return
+	})
+	return status.State, err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver/mock"
+)
+
+func init() {
+	sequencePollInterval = time.Millisecond
+}
+
+// Wait for the job with the given id to reach a state satisfying `done`.
+func waitForJob(t *testing.T, d *Daemon, id string, done func(Job) bool) Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := d.GetJob(context.Background(), id)
+		if err != nil {
+			t.Fatal("GetJob:", err)
+		}
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for job; last state: %+v", job)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func jobFinished(job Job) bool {
+	return job.FinishedAt != nil
+}
+
+func TestSequence(t *testing.T) {
+	ctx := context.Background()
+	daemon := newDaemon()
+	for _, label := range []string{"seq-storage-1", "seq-storage-2", "seq-compute-1", "seq-compute-2"} {
+		info := []byte(`{"type": "ipmi", "info": {"addr": "` + label + `"}}`)
+		if err := daemon.SetNode(ctx, label, info); err != nil {
+			t.Fatal("SetNode:", err)
+		}
+	}
+	for _, label := range []string{"seq-compute-1", "seq-compute-2"} {
+		if err := daemon.SetNodeMetadata(ctx, label, "role", "compute"); err != nil {
+			t.Fatal("SetNodeMetadata:", err)
+		}
+	}
+	compute := "role=compute"
+	err := daemon.SetSequence(ctx, Sequence{
+		Name: "boot",
+		Groups: []SequenceGroup{
+			{Nodes: []string{"seq-storage-1"}, WaitForOn: true, DelayMs: 10},
+			{Selector: &compute},
+		},
+	})
+	if err != nil {
+		t.Fatal("SetSequence:", err)
+	}
+	err = daemon.SetSequence(ctx, Sequence{
+		Name: "broken",
+		Groups: []SequenceGroup{
+			{Nodes: []string{"no-such-node"}},
+			{Nodes: []string{"seq-storage-2"}},
+		},
+	})
+	if err != nil {
+		t.Fatal("SetSequence:", err)
+	}
+	err = daemon.SetSequence(ctx, Sequence{
+		Name:   "slow",
+		Groups: []SequenceGroup{{Nodes: []string{"seq-storage-2"}, DelayMs: 3600000}},
+	})
+	if err != nil {
+		t.Fatal("SetSequence:", err)
+	}
+
+	job, err := daemon.StartSequence(ctx, "boot")
+	if err != nil {
+		t.Fatal("StartSequence:", err)
+	}
+	job = waitForJob(t, daemon, job.ID, jobFinished)
+	if job.Status != JobSucceeded || job.Groups[0].Status != GroupDone ||
+		job.Groups[1].Status != GroupDone || len(job.Groups[1].Results) != 2 {
+		t.Fatalf("Unexpected job state: %+v", job)
+	}
+	for _, label := range []string{"seq-storage-1", "seq-compute-1", "seq-compute-2"} {
+		if mock.LastPowerActions[label] != mock.On {
+			t.Fatalf("%s was not powered on.", label)
+		}
+	}
+
+	// A failure aborts the rest of the sequence:
+	job, err = daemon.StartSequence(ctx, "broken")
+	if err != nil {
+		t.Fatal("StartSequence:", err)
+	}
+	job = waitForJob(t, daemon, job.ID, jobFinished)
+	if job.Status != JobFailed || job.Groups[0].Status != GroupFailed ||
+		job.Groups[0].Results[0].Status != http.StatusNotFound ||
+		job.Groups[1].Status != GroupSkipped {
+		t.Fatalf("Unexpected job state: %+v", job)
+	}
+	if _, ok := mock.LastPowerActions["seq-storage-2"]; ok {
+		t.Fatal("Group after the failed one was powered on.")
+	}
+
+	// Jobs can be canceled:
+	job, err = daemon.StartSequence(ctx, "slow")
+	if err != nil {
+		t.Fatal("StartSequence:", err)
+	}
+	waitForJob(t, daemon, job.ID, func(job Job) bool {
+		return job.Groups[0].Status == GroupDelaying
+	})
+	if err = daemon.CancelJob(ctx, job.ID); err != nil {
+		t.Fatal("CancelJob:", err)
+	}
+	job = waitForJob(t, daemon, job.ID, jobFinished)
+	if job.Status != JobCanceled || job.Groups[0].Status != GroupFailed {
+		t.Fatalf("Unexpected job state: %+v", job)
+	}
+	if err = daemon.CancelJob(ctx, job.ID); err != ErrJobFinished {
+		t.Fatalf("Canceling finished job: wanted %v but got %v", ErrJobFinished, err)
+	}
+	if jobs := daemon.ListJobs(ctx); len(jobs) != 3 || jobs[0].ID != job.ID {
+		t.Fatalf("Unexpected job list: %+v", jobs)
+	}
+}
+
+func TestSequenceEndpoints(t *testing.T) {
+	handler := newHandler()
+	for _, body := range []string{
+		`{"groups": []}`,
+		`{"groups": [{}]}`,
+		`{"groups": [{"nodes": ["a"], "selector": "role=compute"}]}`,
+		`{"groups": [{"nodes": ["a"], "delay_ms": -1}]}`,
+	} {
+		adminRequireStatus(t, handler, http.StatusBadRequest,
+			requestSpec{"PUT", "http://localhost/sequence/boot", body})
+	}
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"PUT", "http://localhost/sequence/boot",
+		`{"groups": [{"nodes": ["a"], "wait_for_on": true}, {"selector": "role=compute"}]}`,
+	})
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"GET", "http://localhost/sequence/boot", ""})
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"POST", "http://localhost/sequence/no-such-sequence/run", ""})
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"GET", "http://localhost/job/no-such-job", ""})
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"DELETE", "http://localhost/sequence/boot", ""})
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"GET", "http://localhost/sequence/boot", ""})
+}
@@ -3,14 +3,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
 	"github.com/CCI-MOC/obmd/internal/driver/mock"
 	"github.com/CCI-MOC/obmd/token"
 )
@@ -75,29 +81,9 @@ func TestViewConsole(t *testing.T) {
 		}
 	}`)
 
-	streamConsole := func(token string) io.ReadCloser {
-		req := httptest.NewRequest(
-			"GET",
-			"http://localhost/node/somenode/console?token="+token,
-			bytes.NewBuffer(nil),
-		)
-
-		r, w := io.Pipe()
-		respStreamer := &responseStreamer{
-			header: make(http.Header),
-			body:   w,
-		}
-
-		go func() {
-			handler.ServeHTTP(respStreamer, req)
-			w.Close()
-		}()
-		return r
-	}
-
 	numReadsFirstClient := make(chan int)
 	go func() {
-		r := bufio.NewReader(streamConsole(getToken(t, handler, "somenode")))
+		r := bufio.NewReader(streamConsole(handler, "somenode", getToken(t, handler, "somenode")))
 		i := 0
 		defer func() { numReadsFirstClient <- i }()
 		for {
@@ -106,12 +92,14 @@ func TestViewConsole(t *testing.T) {
 				break
 			}
 			if err != nil {
-				t.Fatalf("Error reading from console: %v", err)
+				t.Errorf("Error reading from console: %v", err)
+				return
 			}
 			expected := fmt.Sprintf("%d\n", i)
 			if line != expected {
-				t.Fatalf("Unexpected data read from console. Wanted %q but got %q",
+				t.Errorf("Unexpected data read from console. Wanted %q but got %q",
 					expected, line)
+				return
 			}
 			i++
 		}
@@ -120,7 +108,7 @@ func TestViewConsole(t *testing.T) {
 	resp := adminReq(handler, requestSpec{"DELETE", "http://localhost/node/somenode/token", ""})
 	requireStatus(t, "Invalidating token", resp, http.StatusOK)
 
-	r := bufio.NewReader(streamConsole(getToken(t, handler, "somenode")))
+	r := bufio.NewReader(streamConsole(handler, "somenode", getToken(t, handler, "somenode")))
 	line, err := r.ReadString('\n')
 	if err != nil {
 		t.Fatal("Error reading from console:", err)
@@ -153,62 +141,116 @@ func TestPowerStatus(t *testing.T) {
 		}
 	}`)
 	token := getToken(t, handler, "somenode")
-	testStringOn := string("{\"power_status\":\"on\"}\n")
-	testStringOff := string("{\"power_status\":\"off\"}\n")
 
-	// First make sure dummy node is off
-	request := requestSpec{"GET",
-		"http://localhost/node/somenode/power_status", ""}
-	resp := tokenReq(handler, token, request)
-	body, err := ioutil.ReadAll(resp.Body)
-	errpanic(err)
-	if string(body) != testStringOff {
-		t.Fatalf("GetPowerStatus: Incorrect power status; "+
-			"wanted %v but got %v.", testStringOff, string(body))
+	// Fetch the power status, and check that it's what we expect.
+	requirePowerState := func(expected driver.PowerState) {
+		request := requestSpec{"GET",
+			"http://localhost/node/somenode/power_status", ""}
+		resp := tokenReq(handler, token, request)
+		var body PowerResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		if body.Resp != expected {
+			t.Fatalf("GetPowerStatus: Incorrect power status; "+
+				"wanted %v but got %v.", expected, body.Resp)
+		}
+		if body.Raw != string(expected) {
+			t.Fatalf("GetPowerStatus: Incorrect raw status; "+
+				"wanted %q but got %q.", expected, body.Raw)
+		}
+		if body.ReadAt.IsZero() {
+			t.Fatal("GetPowerStatus: read_at was not set.")
+		}
 	}
 
+	// First make sure dummy node is off
+	requirePowerState(driver.PowerOff)
+
 	// Now test powering on
-	request = requestSpec{"POST",
+	request := requestSpec{"POST",
 		"http://localhost/node/somenode/power_cycle", `{"force": false}`,
 	}
-	// Power on ...
-	resp = tokenReq(handler, token, request)
-	body, err = ioutil.ReadAll(resp.Body)
-	errpanic(err)
-
-	// Get power status ...
-	request = requestSpec{"GET",
-		"http://localhost/node/somenode/power_status", ""}
-	resp = tokenReq(handler, token, request)
-	body, err = ioutil.ReadAll(resp.Body)
-	errpanic(err)
-
-	if string(body) != testStringOn {
-		t.Fatalf("GetPowerStatus: Incorrect power status; "+
-			"wanted %v but got %v.", testStringOn, string(body))
-	}
+	resp := tokenReq(handler, token, request)
+	requireStatus(t, "Power cycle", resp, http.StatusOK)
+	requirePowerState(driver.PowerOn)
 
 	// Now test powering off
 	request = requestSpec{"POST",
 		"http://localhost/node/somenode/power_off", "",
 	}
-	// Power off ...
 	resp = tokenReq(handler, token, request)
-	body, err = ioutil.ReadAll(resp.Body)
-	errpanic(err)
+	requireStatus(t, "Power off", resp, http.StatusOK)
+	requirePowerState(driver.PowerOff)
+}
 
-	// Get power status ...
-	request = requestSpec{"GET",
-		"http://localhost/node/somenode/power_status", ""}
-	resp = tokenReq(handler, token, request)
-	body, err = ioutil.ReadAll(resp.Body)
-	errpanic(err)
+func TestPowerStatusCache(t *testing.T) {
+	daemon := newDaemon()
+	handler := makeHandler(theConfig, daemon)
+	makeNode(t, handler, "cachenode", `{"type": "dummy", "info": {"addr": "10.0.0.3"}}`)
+	token := getToken(t, handler, "cachenode")
 
-	if string(body) != testStringOff {
-		t.Fatalf("GetPowerStatus: Incorrect power status; "+
-			"wanted %v but got %v.", testStringOff, string(body))
+	// Fetch the power status, and check whether it came from the cache.
+	requireCached := func(query string, expected bool) {
+		spec := requestSpec{"GET",
+			"http://localhost/node/cachenode/power_status?" + query + "token=" + token, ""}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, spec.toNoAuth())
+		requireStatus(t, "Power status", resp, http.StatusOK)
+		var body PowerResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		if body.Cached != expected {
+			t.Fatalf("GetPowerStatus(%q): wanted cached = %v but got %v.",
+				query, expected, body.Cached)
+		}
 	}
 
+	requireCached("", false)
+	requireCached("", true)
+	requireCached("refresh=true&", false)
+
+	// Power actions invalidate the cache:
+	resp := tokenReq(handler, token, requestSpec{"POST",
+		"http://localhost/node/cachenode/power_on", ""})
+	requireStatus(t, "Power on", resp, http.StatusOK)
+	requireCached("", false)
+
+	// The poller fills it in, but only if someone wants to hear about
+	// changes:
+	resp = tokenReq(handler, token, requestSpec{"POST",
+		"http://localhost/node/cachenode/power_off", ""})
+	requireStatus(t, "Power off", resp, http.StatusOK)
+	daemon.pollPowerStates(context.Background(), make(map[*Node]driver.PowerState), 0)
+	requireCached("", false)
+	_, unsubscribe, err := daemon.SubscribeEvents(context.Background(), "cachenode")
+	if err != nil {
+		t.Fatal("SubscribeEvents:", err)
+	}
+	defer unsubscribe()
+	daemon.pollPowerStates(context.Background(), make(map[*Node]driver.PowerState), 0)
+	requireCached("", true)
+
+	// Stale entries are ignored:
+	daemon.maxPowerStatusAge = 0
+	requireCached("", false)
+}
+
+// Power statuses read by health checks are cached too.
+func TestPowerStatusFromHealthCheck(t *testing.T) {
+	daemon := newDaemonWithRegistry(driver.Registry{
+		"ipmi": mock.New(coordinator.HealthConfig{Interval: 10 * time.Millisecond, FailureThreshold: 3}),
+	})
+	handler := makeHandler(theConfig, daemon)
+	makeNode(t, handler, "checkednode", `{"type": "ipmi", "info": {"addr": "checkednode"}}`)
+	node, err := daemon.state.GetNode("checkednode")
+	if err != nil {
+		t.Fatal("GetNode:", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := cachedPowerStatus(node, time.Minute); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Health checks never cached a power status.")
 }
 
 func TestPowerActions(t *testing.T) {
@@ -305,6 +347,49 @@ func TestPowerActions(t *testing.T) {
 				"PUT", "/node/somenode/boot_device", `{"bootdev": "invalid"}`,
 			},
 		},
+		{
+			"diagnostic interrupt",
+			tok,
+			http.StatusOK,
+			mock.DiagInterrupt,
+			requestSpec{"POST", "/node/somenode/diag_interrupt", ""},
+		},
+		{
+			"identify on",
+			tok,
+			http.StatusOK,
+			mock.IdentifyOn,
+			requestSpec{
+				"PUT", "/node/somenode/identify", `{"state": "on", "duration": 30}`,
+			},
+		},
+		{
+			"identify force on",
+			tok,
+			http.StatusOK,
+			mock.IdentifyForceOn,
+			requestSpec{
+				"PUT", "/node/somenode/identify", `{"state": "force-on"}`,
+			},
+		},
+		{
+			"identify off",
+			tok,
+			http.StatusOK,
+			mock.IdentifyOff,
+			requestSpec{
+				"PUT", "/node/somenode/identify", `{"state": "off"}`,
+			},
+		},
+		{
+			"identify with an invalid state",
+			tok,
+			http.StatusBadRequest,
+			mock.IdentifyOff, // should be unchanged.
+			requestSpec{
+				"PUT", "/node/somenode/identify", `{"state": "blink"}`,
+			},
+		},
 	}
 
 	for _, v := range testCases {
@@ -321,3 +406,577 @@ func TestPowerActions(t *testing.T) {
 		}
 	}
 }
+
+// Set the boot device, and make sure we can read back the new setting.
+func TestGetBootdev(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	tok := getToken(t, handler, "somenode")
+
+	requireBootdev := func(expected BootdevResp) {
+		resp := tokenReq(handler, tok, requestSpec{
+			"GET", "http://localhost/node/somenode/boot_device", "",
+		})
+		requireStatus(t, "Get bootdev", resp, http.StatusOK)
+		var body BootdevResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		if body != expected {
+			t.Fatalf("Incorrect boot device; wanted %v but got %v.",
+				expected, body)
+		}
+	}
+	setBootdev := func(expectedStatus int, args string) {
+		resp := tokenReq(handler, tok, requestSpec{
+			"PUT", "http://localhost/node/somenode/boot_device", args,
+		})
+		requireStatus(t, "Set bootdev "+args, resp, expectedStatus)
+	}
+
+	requireBootdev(BootdevResp{Dev: "none", Persistent: true})
+
+	// Persistent is the default:
+	setBootdev(http.StatusOK, `{"bootdev": "B"}`)
+	requireBootdev(BootdevResp{Dev: "B", Persistent: true})
+
+	setBootdev(http.StatusOK, `{"bootdev": "A", "persistent": false, "mode": "uefi"}`)
+	requireBootdev(BootdevResp{Dev: "A", Persistent: false, Mode: driver.BootModeUEFI})
+
+	// Bad mode; the setting should be unchanged:
+	setBootdev(http.StatusBadRequest, `{"bootdev": "B", "mode": "openfirmware"}`)
+	requireBootdev(BootdevResp{Dev: "A", Persistent: false, Mode: driver.BootModeUEFI})
+}
+
+// Check that the capabilities endpoint reports what the driver supports.
+func TestCapabilities(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	tok := getToken(t, handler, "somenode")
+
+	spec := requestSpec{"GET", "http://localhost/node/somenode/capabilities", ""}
+	badToken, _ := token.Token{}.MarshalText()
+	requireStatus(t, "Capabilities (invalid token)",
+		tokenReq(handler, string(badToken), spec), http.StatusUnauthorized)
+
+	resp := tokenReq(handler, tok, spec)
+	requireStatus(t, "Capabilities", resp, http.StatusOK)
+	var caps driver.Capabilities
+	errpanic(json.NewDecoder(resp.Body).Decode(&caps))
+	if len(caps.BootDevices) != 2 || caps.BootDevices[0] != "A" || caps.BootDevices[1] != "B" {
+		t.Fatalf("Unexpected boot devices: %v", caps.BootDevices)
+	}
+	if !caps.Console {
+		t.Fatal("The mock driver should report a console.")
+	}
+}
+
+// Read sensors from a node that has them, and one that doesn't.
+func TestSensors(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	makeNode(t, handler, "dummynode", `{
+		"type": "dummy",
+		"info": {
+			"addr": "10.0.0.4"
+		}
+	}`)
+
+	resp := tokenReq(handler, getToken(t, handler, "somenode"), requestSpec{
+		"GET", "http://localhost/node/somenode/sensors", "",
+	})
+	requireStatus(t, "Reading sensors", resp, http.StatusOK)
+	var body SensorsResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&body))
+	if len(body.Sensors) == 0 {
+		t.Fatal("Mock driver returned no sensors.")
+	}
+	temp := body.Sensors[0]
+	if temp.Type != driver.SensorTemperature || temp.Value == nil || *temp.Value != 42 {
+		t.Fatalf("Unexpected sensor reading: %v", temp)
+	}
+
+	resp = tokenReq(handler, getToken(t, handler, "dummynode"), requestSpec{
+		"GET", "http://localhost/node/dummynode/sensors", "",
+	})
+	requireStatus(t, "Reading sensors (unsupported)", resp, http.StatusNotImplemented)
+}
+
+// Page through the event log, then clear it.
+func TestSEL(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	tok := getToken(t, handler, "somenode")
+
+	// tokenReq puts the token at the end of the url, so it can't be used
+	// with other query parameters; we build these requests ourselves.
+	selReq := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET",
+			"http://localhost/node/somenode/sel?token="+tok+"&"+query, nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+	getSEL := func(query string) SELResp {
+		resp := selReq(query)
+		requireStatus(t, "Reading SEL ("+query+")", resp, http.StatusOK)
+		var body SELResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	all := getSEL("")
+	if all.Total != 3 || len(all.Entries) != 3 {
+		t.Fatalf("Expected 3 entries, but got %d (total %d).",
+			len(all.Entries), all.Total)
+	}
+	page := getSEL("offset=1&limit=1")
+	if page.Total != 3 || len(page.Entries) != 1 || page.Entries[0].ID != all.Entries[1].ID {
+		t.Fatalf("Unexpected page: %v", page)
+	}
+	if past := getSEL("offset=10"); len(past.Entries) != 0 {
+		t.Fatalf("Expected no entries past the end of the log, but got %v", past)
+	}
+
+	requireStatus(t, "Reading SEL (bad limit)", selReq("limit=0"), http.StatusBadRequest)
+
+	// Clearing the log is admin-only:
+	clear := requestSpec{"DELETE", "http://localhost/node/somenode/sel", ""}
+	resp := tokenReq(handler, tok, clear)
+	requireStatus(t, "Clearing SEL (as non-admin)", resp, http.StatusMethodNotAllowed)
+	adminRequireStatus(t, handler, http.StatusOK, clear)
+	if cleared := getSEL(""); cleared.Total != 0 {
+		t.Fatalf("Log was not cleared: %v", cleared)
+	}
+}
+
+// Fetch a node's inventory, and make sure later requests are served from the
+// cache unless a refresh is requested.
+func TestInventory(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+
+	getInventory := func(url string) InventoryResp {
+		resp := adminReq(handler, requestSpec{"GET", url, ""})
+		requireStatus(t, "GET "+url, resp, http.StatusOK)
+		var body InventoryResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	url := "http://localhost/node/somenode/inventory"
+	first := getInventory(url)
+	if first.Cached {
+		t.Fatal("First inventory request should not have been cached.")
+	}
+	if first.Inventory.SerialNumber != "MOCK-10.0.0.3" {
+		t.Fatalf("Unexpected serial number: %q", first.Inventory.SerialNumber)
+	}
+	second := getInventory(url)
+	if !second.Cached || !second.ReadAt.Equal(first.ReadAt) {
+		t.Fatalf("Second inventory request should have hit the cache: %v", second)
+	}
+	if second.Inventory.SerialNumber != first.Inventory.SerialNumber {
+		t.Fatalf("Cached inventory differs: %v vs. %v", first, second)
+	}
+	if refreshed := getInventory(url + "?refresh=true"); refreshed.Cached {
+		t.Fatal("Refreshed inventory request should not have been cached.")
+	}
+
+	requireStatus(t, "Inventory (no auth)",
+		tokenReq(handler, getToken(t, handler, "somenode"), requestSpec{"GET", url, ""}),
+		http.StatusNotFound)
+}
+
+// Send a BREAK over the console, with and without an active console session.
+func TestConsoleBreak(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.5",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	tok := getToken(t, handler, "somenode")
+	spec := requestSpec{"POST", "http://localhost/node/somenode/console/break", ""}
+
+	requireStatus(t, "Sending BREAK (no console)",
+		tokenReq(handler, tok, spec), http.StatusConflict)
+
+	console := streamConsole(handler, "somenode", tok)
+	defer console.Close()
+	// Wait until the console is connected:
+	if _, err := bufio.NewReader(console).ReadString('\n'); err != nil {
+		t.Fatal("Error reading from console:", err)
+	}
+	requireStatus(t, "Sending BREAK", tokenReq(handler, tok, spec), http.StatusOK)
+	if mock.NumBreaks["10.0.0.5"] != 1 {
+		t.Fatalf("Expected one BREAK to be sent, but got %d.",
+			mock.NumBreaks["10.0.0.5"])
+	}
+
+	spec.body = `{"sysrq": "t"}`
+	requireStatus(t, "Sending BREAK with SysRq", tokenReq(handler, tok, spec), http.StatusOK)
+	if mock.NumBreaks["10.0.0.5"] != 2 || mock.LastSysRqs["10.0.0.5"] != "t" {
+		t.Fatalf("Expected a second BREAK with SysRq key t, but got %d BREAKs, last key %q.",
+			mock.NumBreaks["10.0.0.5"], mock.LastSysRqs["10.0.0.5"])
+	}
+	for _, body := range []string{`{"sysrq": "tt"}`, `{"sysrq": "\n"}`, `{`} {
+		spec.body = body
+		requireStatus(t, "Sending BREAK with "+body, tokenReq(handler, tok, spec),
+			http.StatusBadRequest)
+	}
+}
+
+// Check that health checks are reported by node inspection, and that
+// operations on a node whose OBM is down fail fast.
+func TestHealthCheck(t *testing.T) {
+	health := coordinator.HealthConfig{Interval: 10 * time.Millisecond, FailureThreshold: 2}
+	handler := makeHandler(theConfig, newDaemonWithRegistry(driver.Registry{
+		"ipmi": mock.New(health),
+	}))
+	makeNode(t, handler, "goodnode", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.6"}
+	}`)
+	makeNode(t, handler, "badnode", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.7", "unreachable": true}
+	}`)
+
+	// Wait for the node's health to reach the given state.
+	waitForHealth := func(nodeId string, state driver.HealthState) NodeInfo {
+		var info NodeInfo
+		for i := 0; i < 100; i++ {
+			resp := adminReq(handler, requestSpec{
+				"GET", "http://localhost/node/" + nodeId, "",
+			})
+			requireStatus(t, "Inspecting "+nodeId, resp, http.StatusOK)
+			errpanic(json.NewDecoder(resp.Body).Decode(&info))
+			if info.Health != nil && info.Health.State == state {
+				return info
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Node %s never reached health state %q: %v", nodeId, state, info.Health)
+		return info
+	}
+
+	good := waitForHealth("goodnode", driver.HealthUp)
+	if good.Type != "ipmi" || good.Health.LastSuccess.IsZero() {
+		t.Fatalf("Unexpected node info: %v", good)
+	}
+	bad := waitForHealth("badnode", driver.HealthDown)
+	if bad.Health.ConsecutiveFailures < 2 || bad.Health.LastError == "" {
+		t.Fatalf("Unexpected health: %v", bad.Health)
+	}
+
+	requireStatus(t, "Power on (OBM up)",
+		tokenReq(handler, getToken(t, handler, "goodnode"),
+			requestSpec{"POST", "http://localhost/node/goodnode/power_on", ""}),
+		http.StatusOK)
+	requireStatus(t, "Power on (OBM down)",
+		tokenReq(handler, getToken(t, handler, "badnode"),
+			requestSpec{"POST", "http://localhost/node/badnode/power_on", ""}),
+		http.StatusServiceUnavailable)
+}
+
+// Make some requests, and check that they show up in /metrics.
+func TestMetrics(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.3"}
+	}`)
+	tok := getToken(t, handler, "somenode")
+	requireStatus(t, "Power on",
+		tokenReq(handler, tok, requestSpec{"POST", "http://localhost/node/somenode/power_on", ""}),
+		http.StatusOK)
+
+	// Metrics are global, so other tests may have bumped the values;
+	// we just check that the series exist.
+	requireStatus(t, "Fetching metrics without the admin token",
+		tokenReq(handler, "", requestSpec{"GET", "http://localhost/metrics", ""}),
+		http.StatusNotFound)
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/metrics", ""})
+	requireStatus(t, "Fetching metrics", resp, http.StatusOK)
+	body := resp.Body.String()
+	for _, series := range []string{
+		`obmd_http_requests_total{method="POST",route="/node/{node_id}/power_on",status="200"} `,
+		`obmd_http_requests_total{method="POST",route="/node/{node_id}/token",status="200"} `,
+		`obmd_http_request_duration_seconds_count{method="PUT",route="/node/{node_id}"} `,
+		`obmd_driver_operations_total{driver="ipmi",operation="power_on"} `,
+		`obmd_tokens_issued_total `,
+	} {
+		if !strings.Contains(body, series) {
+			t.Fatalf("Metrics do not contain %q:\n%s", series, body)
+		}
+	}
+}
+
+// Test the liveness and readiness endpoints, including readiness going away
+// when we start shutting down.
+func TestHealthzReadyz(t *testing.T) {
+	daemon := newDaemon()
+	handler := makeHandler(theConfig, daemon)
+
+	requireStatus(t, "Liveness check",
+		tokenReq(handler, "", requestSpec{"GET", "http://localhost/healthz", ""}),
+		http.StatusOK)
+	requireStatus(t, "Readiness check",
+		tokenReq(handler, "", requestSpec{"GET", "http://localhost/readyz", ""}),
+		http.StatusOK)
+
+	daemon.BeginShutdown()
+	requireStatus(t, "Liveness check while shutting down",
+		tokenReq(handler, "", requestSpec{"GET", "http://localhost/healthz", ""}),
+		http.StatusOK)
+	requireStatus(t, "Readiness check while shutting down",
+		tokenReq(handler, "", requestSpec{"GET", "http://localhost/readyz", ""}),
+		http.StatusServiceUnavailable)
+
+	// Other requests should still work until the server actually stops:
+	requireStatus(t, "Registering a node while shutting down",
+		adminReq(handler, requestSpec{"PUT", "http://localhost/node/somenode", `{
+			"type": "dummy",
+			"info": {"addr": "10.0.0.3"}
+		}`}),
+		http.StatusOK)
+	if err := daemon.Close(); err != nil {
+		t.Fatal("Closing daemon:", err)
+	}
+}
+
+// Test that requests are assigned IDs, which are returned in the response and
+// included in log lines from deeper in the stack.
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	oldLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(oldLogger)
+
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.3"}
+	}`)
+	tok := getToken(t, handler, "somenode")
+
+	// If the client doesn't supply an ID, we make one up:
+	resp := tokenReq(handler, tok, requestSpec{"POST", "http://localhost/node/somenode/power_on", ""})
+	requireStatus(t, "Power on", resp, http.StatusOK)
+	if resp.Header().Get("X-Request-ID") == "" {
+		t.Fatal("Response has no X-Request-ID header.")
+	}
+
+	// If it does, we use theirs:
+	req := httptest.NewRequest("POST",
+		"http://localhost/node/somenode/power_off?token="+tok, nil)
+	req.Header.Set("X-Request-ID", "test-request-1")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	requireStatus(t, "Power off", resp, http.StatusOK)
+	if id := resp.Header().Get("X-Request-ID"); id != "test-request-1" {
+		t.Fatalf("Wanted X-Request-ID test-request-1, but got %q.", id)
+	}
+
+	var opLogged, requestLogged bool
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if !strings.Contains(line, "request_id=test-request-1") {
+			continue
+		}
+		if strings.Contains(line, "node=somenode") &&
+			strings.Contains(line, "operation=power_off") {
+			opLogged = true
+		}
+		if strings.Contains(line, "status=200") {
+			requestLogged = true
+		}
+	}
+	if !opLogged || !requestLogged {
+		t.Fatalf("Request was not logged as expected. Logs:\n%s", logs.String())
+	}
+}
+
+// Test setting and removing node metadata, and listing nodes by selector.
+func TestMetadata(t *testing.T) {
+	handler := newHandler()
+	for _, label := range []string{"node-1", "node-2", "node-3"} {
+		makeNode(t, handler, label, `{
+			"type": "ipmi",
+			"info": {"addr": "`+label+`"}
+		}`)
+	}
+	setMetadata := func(label, key, value string, expected int) {
+		adminRequireStatus(t, handler, expected, requestSpec{
+			"PUT",
+			"http://localhost/node/" + label + "/metadata/" + key,
+			`{"value": "` + value + `"}`,
+		})
+	}
+	setMetadata("node-1", "rack", "r1", http.StatusOK)
+	setMetadata("node-1", "project", "foo", http.StatusOK)
+	setMetadata("node-2", "rack", "r1", http.StatusOK)
+	setMetadata("node-3", "rack", "r2", http.StatusOK)
+	setMetadata("node-3", "bad.", "x", http.StatusBadRequest)
+	setMetadata("node-3", "rack", "r1,r2", http.StatusBadRequest)
+	setMetadata("no-such-node", "rack", "r1", http.StatusNotFound)
+
+	listNodes := func(selector string) []string {
+		resp := adminReq(handler, requestSpec{
+			"GET", "http://localhost/nodes?selector=" + url.QueryEscape(selector), "",
+		})
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Listing nodes with selector %q: status %d", selector, resp.Code)
+		}
+		var body NodesResp
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal("Decoding node list:", err)
+		}
+		labels := []string{}
+		for _, node := range body.Nodes {
+			labels = append(labels, node.Label)
+		}
+		return labels
+	}
+	cases := []struct {
+		selector string
+		expected []string
+	}{
+		{"", []string{"node-1", "node-2", "node-3"}},
+		{"rack=r1", []string{"node-1", "node-2"}},
+		{"rack=r1,!project", []string{"node-2"}},
+		{"project", []string{"node-1"}},
+		{"rack!=r1", []string{"node-3"}},
+	}
+	for _, v := range cases {
+		actual := listNodes(v.selector)
+		if strings.Join(actual, " ") != strings.Join(v.expected, " ") {
+			t.Fatalf("Selector %q: wanted %v but got %v", v.selector, v.expected, actual)
+		}
+	}
+	adminRequireStatus(t, handler, http.StatusBadRequest,
+		requestSpec{"GET", "http://localhost/nodes?selector=rack%3D%3Dr1", ""})
+
+	// Metadata shows up when inspecting a node, and can be removed:
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"DELETE", "http://localhost/node/node-1/metadata/project", ""})
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/node/node-1", ""})
+	var info NodeInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal("Decoding node info:", err)
+	}
+	if len(info.Metadata) != 1 || info.Metadata["rack"] != "r1" {
+		t.Fatalf("Unexpected metadata: %v", info.Metadata)
+	}
+}
+
+// Test applying power actions to many nodes at once.
+func TestBulkPower(t *testing.T) {
+	handler := newHandler()
+	for _, label := range []string{"bulk-1", "bulk-2", "bulk-3"} {
+		makeNode(t, handler, label, `{
+			"type": "ipmi",
+			"info": {"addr": "`+label+`"}
+		}`)
+	}
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"PUT", "http://localhost/node/bulk-3/metadata/rack", `{"value": "r9"}`,
+	})
+
+	bulkPower := func(body string) []BulkPowerResult {
+		resp := adminReq(handler, requestSpec{"POST", "http://localhost/nodes/power", body})
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Bulk power request %s: status %d", body, resp.Code)
+		}
+		var respBody BulkPowerResp
+		if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+			t.Fatal("Decoding bulk power response:", err)
+		}
+		return respBody.Results
+	}
+
+	results := bulkPower(`{
+		"nodes": ["bulk-2", "no-such-node", "bulk-1"],
+		"action": "power_off",
+		"concurrency": 1,
+		"stagger_ms": 1
+	}`)
+	expected := []BulkPowerResult{
+		{Node: "bulk-2", Status: http.StatusOK},
+		{Node: "no-such-node", Status: http.StatusNotFound, Error: ErrNoSuchNode.Error()},
+		{Node: "bulk-1", Status: http.StatusOK},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Wanted results %v but got %v", expected, results)
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Fatalf("Wanted results %v but got %v", expected, results)
+		}
+	}
+
+	results = bulkPower(`{"selector": "rack=r9", "action": "power_cycle", "force": true}`)
+	if len(results) != 1 || results[0] != (BulkPowerResult{Node: "bulk-3", Status: http.StatusOK}) {
+		t.Fatalf("Unexpected results for selector: %v", results)
+	}
+
+	for label, action := range map[string]mock.PowerAction{
+		"bulk-1": mock.Off,
+		"bulk-2": mock.Off,
+		"bulk-3": mock.ForceReboot,
+	} {
+		if mock.LastPowerActions[label] != action {
+			t.Fatalf("Wanted last action for %q to be %q, but got %q",
+				label, action, mock.LastPowerActions[label])
+		}
+	}
+
+	for _, body := range []string{
+		`{"nodes": ["bulk-1"], "action": "explode"}`,
+		`{"nodes": ["bulk-1"], "selector": "rack=r9", "action": "power_on"}`,
+		`{"action": "power_on"}`,
+		`{"nodes": ["bulk-1", "bulk-1"], "action": "power_on"}`,
+		`{"nodes": ["bulk-1"], "action": "power_on", "concurrency": 0}`,
+		`{"nodes": ["bulk-1"], "action": "power_on", "stagger_ms": -1}`,
+		`{"selector": "rack==r9", "action": "power_on"}`,
+	} {
+		adminRequireStatus(t, handler, http.StatusBadRequest,
+			requestSpec{"POST", "http://localhost/nodes/power", body})
+	}
+}
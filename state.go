@@ -2,10 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
 )
 
+var errNotStarted = errors.New("Nodes have not been loaded.")
+
 // Persistent store for node info, + ephemeral tracking of live OBM
 // connections.
 //
@@ -14,56 +19,132 @@ import (
 //
 // Note that this is not thread-safe.
 type State struct {
-	db     *sql.DB
-	nodes  map[string]*Node
-	driver driver.Driver
+	db        *sql.DB
+	nodes     map[string]*Node
+	schedules map[string]*Schedule
+	sequences map[string]*Sequence
+	webhooks  map[string]*WebhookSpec
+	driver    driver.Driver
+
+	// Set once all nodes have been loaded and their OBMs started. This
+	// never changes after NewState returns.
+	started bool
+
+	// Set for a State from NewOfflineState, whose nodes' OBMs are never
+	// started.
+	offline bool
 }
 
-// Create a State from a database. This loads existent objects in immediately.
+// Create a State from a database. This loads existent objects in immediately,
+// and starts the nodes' OBMs. The database's schema must be up to date (see
+// migrateSchema).
 func NewState(db *sql.DB, driver driver.Driver) (*State, error) {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS nodes (
-		label VARCHAR(80) PRIMARY KEY,
-		obm_info TEXT NOT NULL
-	)`)
+	s, err := loadState(db, driver)
 	if err != nil {
 		return nil, err
 	}
+	for _, node := range s.nodes {
+		s.startOBM(node)
+	}
+	s.started = true
+	s.check()
+	return s, nil
+}
+
+// Like NewState, but never starts the nodes' OBMs, so nothing talks to them
+// (no health checks, plugin processes etc.). This is for one-shot commands
+// like -export and -import, which only need the database; the State's
+// nodes can't actually be used.
+func NewOfflineState(db *sql.DB, driver driver.Driver) (*State, error) {
+	s, err := loadState(db, driver)
+	if err != nil {
+		return nil, err
+	}
+	s.offline = true
+	s.check()
+	return s, nil
+}
+
+// Load a State's objects from the database, without starting anything.
+func loadState(db *sql.DB, driver driver.Driver) (*State, error) {
+	if err := checkSchema(db); err != nil {
+		return nil, err
+	}
 	ret := &State{
-		nodes:  make(map[string]*Node),
-		db:     db,
-		driver: driver,
+		nodes:     make(map[string]*Node),
+		schedules: make(map[string]*Schedule),
+		sequences: make(map[string]*Sequence),
+		webhooks:  make(map[string]*WebhookSpec),
+		db:        db,
+		driver:    driver,
 	}
-	rows, err := db.Query(`SELECT label, obm_info FROM nodes`)
+	rows, err := db.Query(`SELECT label, obm_info, metadata FROM nodes`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var (
-			label string
-			info  []byte
+			label    string
+			info     []byte
+			metadata []byte
 		)
-		err = rows.Scan(&label, &info)
+		err = rows.Scan(&label, &info, &metadata)
 		if err != nil {
 			return nil, err
 		}
-		node, err := NewNode(driver, info)
+		node, err := NewNode(driver, label, info)
 		if err != nil {
 			return nil, err
 		}
+		if err = json.Unmarshal(metadata, &node.Metadata); err != nil {
+			return nil, err
+		}
 		ret.nodes[label] = node
 	}
 	err = rows.Err()
 	if err != nil {
 		return nil, err
 	}
-	for _, node := range ret.nodes {
-		node.StartOBM()
+	if err = ret.loadSchedules(); err != nil {
+		return nil, err
+	}
+	if err = ret.loadSequences(); err != nil {
+		return nil, err
+	}
+	if err = ret.loadWebhooks(); err != nil {
+		return nil, err
 	}
-	ret.check()
 	return ret, nil
 }
 
+// Start `node`'s OBM, unless the State is offline.
+func (s *State) startOBM(node *Node) {
+	if !s.offline {
+		node.StartOBM()
+	}
+}
+
+// Stop `node`'s OBM, unless the State is offline (so it was never started).
+func (s *State) stopOBM(node *Node) {
+	if !s.offline {
+		node.StopOBM()
+	}
+}
+
+// Check whether the State is ready to serve requests: all nodes have been
+// loaded, and the database is reachable. Returns nil if so, and an error
+// describing the problem otherwise.
+//
+// Unlike the State's other methods, this is safe to call concurrently with
+// anything else.
+func (s *State) Ready() error {
+	if !s.started {
+		return errNotStarted
+	}
+	return s.db.Ping()
+}
+
 func (s *State) check() {
 	for label, node := range s.nodes {
 		if node == nil {
@@ -75,7 +156,7 @@ func (s *State) check() {
 // Clean up resources used by the State. Does not close the database.
 func (s *State) Close() error {
 	for _, node := range s.nodes {
-		node.StopOBM()
+		s.stopOBM(node)
 	}
 	return nil
 }
@@ -94,7 +175,7 @@ func (s *State) NewNode(label string, info []byte) (*Node, error) {
 		return nil, ErrNodeExists
 	}
 	// Node doesn't exist; create it.
-	node, err := NewNode(s.driver, info)
+	node, err := NewNode(s.driver, label, info)
 	if err != nil {
 		return nil, err
 	}
@@ -108,17 +189,489 @@ func (s *State) NewNode(label string, info []byte) (*Node, error) {
 		return nil, err
 	}
 	s.nodes[label] = node
-	node.StartOBM()
+	s.startOBM(node)
 	return node, nil
 }
 
 func (s *State) DeleteNode(label string) error {
-	var err error
 	node, ok := s.nodes[label]
-	if ok {
-		node.StopOBM()
-		delete(s.nodes, label)
-		_, err = s.db.Exec("DELETE FROM nodes WHERE label = $1", label)
+	if !ok {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM nodes WHERE label = $1",
+		"DELETE FROM node_inventory WHERE label = $1",
+	} {
+		if _, err = tx.Exec(query, label); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	s.stopOBM(node)
+	delete(s.nodes, label)
+	return nil
+}
+
+// Set (if `remove` is false) or remove (if it is true) the metadata key `key`
+// on the node with the given label.
+func (s *State) updateNodeMetadata(label, key, value string, remove bool) error {
+	node, err := s.GetNode(label)
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]string, len(node.Metadata)+1)
+	for k, v := range node.Metadata {
+		metadata[k] = v
+	}
+	if remove {
+		delete(metadata, key)
+	} else {
+		metadata[key] = value
+	}
+	return s.ReplaceNodeMetadata(label, metadata)
+}
+
+// Replace all of the metadata on the node with the given label. The State
+// takes ownership of `metadata`, which must not be nil.
+func (s *State) ReplaceNodeMetadata(label string, metadata map[string]string) error {
+	node, err := s.GetNode(label)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE nodes SET metadata = $1 WHERE label = $2", data, label)
+	if err != nil {
+		return err
+	}
+	node.Metadata = metadata
+	return nil
+}
+
+// A change to one node made by ImportNodes.
+type nodeImport struct {
+	label string
+
+	// The node to create or replace the existing one with, or nil to
+	// just replace the existing node's metadata.
+	node *Node
+
+	// The node's new metadata, which must not be nil. The State takes
+	// ownership of this.
+	metadata map[string]string
+}
+
+// Apply the changes in `imports` (see Daemon.Import) in a single transaction,
+// so either all of them are saved or none are. Where a node is replaced, its
+// OBM is restarted, its token changes and its cached inventory is dropped,
+// just as if it had been deleted and re-registered.
+func (s *State) ImportNodes(imports []nodeImport) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, imp := range imports {
+		if err = importNode(tx, imp); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for _, imp := range imports {
+		if imp.node == nil {
+			s.nodes[imp.label].Metadata = imp.metadata
+			continue
+		}
+		if old, ok := s.nodes[imp.label]; ok {
+			s.stopOBM(old)
+		}
+		imp.node.Metadata = imp.metadata
+		s.nodes[imp.label] = imp.node
+		s.startOBM(imp.node)
+	}
+	return nil
+}
+
+// Save one of the changes made by ImportNodes, as part of `tx`.
+func importNode(tx *sql.Tx, imp nodeImport) error {
+	data, err := json.Marshal(imp.metadata)
+	if err != nil {
+		return err
+	}
+	if imp.node == nil {
+		_, err = tx.Exec("UPDATE nodes SET metadata = $1 WHERE label = $2", data, imp.label)
+		return err
+	}
+	stmts := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM nodes WHERE label = $1", []interface{}{imp.label}},
+		{"DELETE FROM node_inventory WHERE label = $1", []interface{}{imp.label}},
+		{`INSERT INTO nodes(label, obm_info, metadata)
+			VALUES ($1, $2, $3)`, []interface{}{imp.label, imp.node.ConnInfo, data}},
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set the metadata key `key` to `value` on the node with the given label.
+func (s *State) SetNodeMetadata(label, key, value string) error {
+	return s.updateNodeMetadata(label, key, value, false)
+}
+
+// Remove the metadata key `key` from the node with the given label. Removing
+// a key which isn't set is not an error.
+func (s *State) RemoveNodeMetadata(label, key string) error {
+	return s.updateNodeMetadata(label, key, "", true)
+}
+
+// Get the cached hardware inventory for a node, and the time at which it was
+// read. `ok` is false if there is nothing cached.
+func (s *State) CachedInventory(label string) (inv driver.Inventory, readAt time.Time, ok bool, err error) {
+	var (
+		data []byte
+		unix int64
+	)
+	err = s.db.QueryRow(
+		"SELECT inventory, read_at FROM node_inventory WHERE label = $1",
+		label,
+	).Scan(&data, &unix)
+	if err == sql.ErrNoRows {
+		return inv, readAt, false, nil
+	}
+	if err != nil {
+		return inv, readAt, false, err
+	}
+	err = json.Unmarshal(data, &inv)
+	return inv, time.Unix(unix, 0), err == nil, err
+}
+
+// Store a node's hardware inventory in the cache, replacing anything already
+// there.
+func (s *State) CacheInventory(label string, inv driver.Inventory, readAt time.Time) error {
+	data, err := json.Marshal(&inv)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM node_inventory WHERE label = $1", label)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO node_inventory(label, inventory, read_at)
+			VALUES ($1, $2, $3)`,
+		label,
+		data,
+		readAt.Unix(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
+	return tx.Commit()
+}
+
+// Convert a nullable unix timestamp from the database to a time.
+func fromNullUnix(t sql.NullInt64) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	ret := time.Unix(t.Int64, 0).UTC()
+	return &ret
+}
+
+// Convert a time to a nullable unix timestamp, for storing in the database.
+func toNullUnix(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+func (s *State) loadSchedules() error {
+	rows, err := s.db.Query("SELECT id, spec, next_run FROM schedules")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			sched   Schedule
+			spec    []byte
+			nextRun sql.NullInt64
+		)
+		if err = rows.Scan(&sched.ID, &spec, &nextRun); err != nil {
+			return err
+		}
+		if err = json.Unmarshal(spec, &sched.ScheduleSpec); err != nil {
+			return err
+		}
+		sched.NextRun = fromNullUnix(nextRun)
+		s.schedules[sched.ID] = &sched
+	}
+	return rows.Err()
+}
+
+func (s *State) CreateSchedule(sched *Schedule) error {
+	spec, err := json.Marshal(&sched.ScheduleSpec)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO schedules(id, spec, next_run) VALUES ($1, $2, $3)",
+		sched.ID, spec, toNullUnix(sched.NextRun),
+	)
+	if err != nil {
+		return err
+	}
+	s.schedules[sched.ID] = sched
+	return nil
+}
+
+// Replace the schedule with the same ID as `sched`.
+func (s *State) UpdateSchedule(sched *Schedule) error {
+	if _, ok := s.schedules[sched.ID]; !ok {
+		return ErrNoSuchSchedule
+	}
+	spec, err := json.Marshal(&sched.ScheduleSpec)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"UPDATE schedules SET spec = $1, next_run = $2 WHERE id = $3",
+		spec, toNullUnix(sched.NextRun), sched.ID,
+	)
+	if err != nil {
+		return err
+	}
+	s.schedules[sched.ID] = sched
+	return nil
+}
+
+func (s *State) SetScheduleNextRun(id string, nextRun *time.Time) error {
+	sched, ok := s.schedules[id]
+	if !ok {
+		return ErrNoSuchSchedule
+	}
+	_, err := s.db.Exec(
+		"UPDATE schedules SET next_run = $1 WHERE id = $2",
+		toNullUnix(nextRun), id,
+	)
+	if err != nil {
+		return err
+	}
+	sched.NextRun = nextRun
+	return nil
+}
+
+// Delete a schedule, and its history.
+func (s *State) DeleteSchedule(id string) error {
+	if _, ok := s.schedules[id]; !ok {
+		return ErrNoSuchSchedule
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM schedule_runs WHERE schedule_id = $1", id)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM schedules WHERE id = $1", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+// Add a run to a schedule's history, discarding the oldest runs if there are
+// more than maxScheduleRuns. Runs are ordered by when they started, and then
+// by the order they were recorded in.
+func (s *State) RecordScheduleRun(id string, run *ScheduleRun) error {
+	results, err := json.Marshal(run.Results)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO schedule_runs(schedule_id, scheduled_for, started_at, status, results)
+			VALUES ($1, $2, $3, $4, $5)`,
+		id, run.ScheduledFor.Unix(), run.StartedAt.Unix(), run.Status, results,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`DELETE FROM schedule_runs WHERE schedule_id = $1 AND id NOT IN (
+			SELECT id FROM schedule_runs WHERE schedule_id = $1
+				ORDER BY started_at DESC, id DESC LIMIT $2
+		)`,
+		id, maxScheduleRuns,
+	)
 	return err
 }
+
+// Get a schedule's history, most recent first.
+func (s *State) ScheduleRuns(id string, offset, limit int) ([]ScheduleRun, error) {
+	rows, err := s.db.Query(
+		`SELECT scheduled_for, started_at, status, results FROM schedule_runs
+			WHERE schedule_id = $1
+			ORDER BY started_at DESC, id DESC
+			LIMIT $2 OFFSET $3`,
+		id, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []ScheduleRun{}
+	for rows.Next() {
+		var (
+			run                     ScheduleRun
+			scheduledFor, startedAt int64
+			results                 []byte
+		)
+		err = rows.Scan(&scheduledFor, &startedAt, &run.Status, &results)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(results, &run.Results); err != nil {
+			return nil, err
+		}
+		run.ScheduledFor = time.Unix(scheduledFor, 0).UTC()
+		run.StartedAt = time.Unix(startedAt, 0).UTC()
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (s *State) loadSequences() error {
+	rows, err := s.db.Query("SELECT spec FROM sequences")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			seq  Sequence
+			spec []byte
+		)
+		if err = rows.Scan(&spec); err != nil {
+			return err
+		}
+		if err = json.Unmarshal(spec, &seq); err != nil {
+			return err
+		}
+		s.sequences[seq.Name] = &seq
+	}
+	return rows.Err()
+}
+
+// Create or replace a sequence.
+func (s *State) SetSequence(seq *Sequence) error {
+	spec, err := json.Marshal(seq)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sequences WHERE name = $1", seq.Name)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO sequences(name, spec) VALUES ($1, $2)", seq.Name, spec)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	s.sequences[seq.Name] = seq
+	return nil
+}
+
+func (s *State) DeleteSequence(name string) error {
+	if _, ok := s.sequences[name]; !ok {
+		return ErrNoSuchSequence
+	}
+	_, err := s.db.Exec("DELETE FROM sequences WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	delete(s.sequences, name)
+	return nil
+}
+
+func (s *State) loadWebhooks() error {
+	rows, err := s.db.Query("SELECT id, spec FROM webhooks")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   string
+			spec []byte
+			hook WebhookSpec
+		)
+		if err = rows.Scan(&id, &spec); err != nil {
+			return err
+		}
+		if err = json.Unmarshal(spec, &hook); err != nil {
+			return err
+		}
+		s.webhooks[id] = &hook
+	}
+	return rows.Err()
+}
+
+func (s *State) CreateWebhook(id string, hook *WebhookSpec) error {
+	spec, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO webhooks(id, spec) VALUES ($1, $2)", id, spec)
+	if err != nil {
+		return err
+	}
+	s.webhooks[id] = hook
+	return nil
+}
+
+func (s *State) DeleteWebhook(id string) error {
+	if _, ok := s.webhooks[id]; !ok {
+		return ErrNoSuchWebhook
+	}
+	_, err := s.db.Exec("DELETE FROM webhooks WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	delete(s.webhooks, id)
+	return nil
+}
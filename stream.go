@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/CCI-MOC/obmd/token"
+)
+
+// The number of events a stream may fall behind by before it is ended.
+const streamBufferSize = 100
+
+// How often to send something down an idle event stream, so that proxies
+// don't time it out.
+const streamKeepaliveInterval = 15 * time.Second
+
+// Subscribe to events about the node `label`, or about all nodes if `label` is
+// empty. Call the returned function to unsubscribe. If the subscriber falls
+// streamBufferSize events behind, the channel is closed rather than events
+// being missed.
+func (d *Daemon) SubscribeEvents(ctx context.Context, label string) (<-chan Event, func(), error) {
+	d.Lock()
+	defer d.Unlock()
+	if label != "" {
+		if _, err := d.state.GetNode(label); err != nil {
+			return nil, nil, err
+		}
+	}
+	events, unsubscribe := d.events.subscribe(streamBufferSize, true, func(ev Event) bool {
+		return label == "" || ev.Node == label
+	})
+	return events, unsubscribe, nil
+}
+
+// Like SubscribeEvents, but for a single node, on behalf of the holder of
+// `tok`.
+//
+// Checking the token and subscribing happen atomically, and the subscription
+// ends if the subscriber falls behind, so the subscriber is guaranteed either
+// to see any event which invalidates the token (see endsTokenStream), or to
+// have its channel closed.
+func (d *Daemon) SubscribeNodeEventsWithToken(ctx context.Context, label string, tok *token.Token) (<-chan Event, func(), error) {
+	d.Lock()
+	defer d.Unlock()
+	if _, err := d.getNodeWithToken(label, tok); err != nil {
+		return nil, nil, err
+	}
+	events, unsubscribe := d.events.subscribe(streamBufferSize, true, func(ev Event) bool {
+		return ev.Node == label
+	})
+	return events, unsubscribe, nil
+}
+
+// Report whether `ev` means the token a node's event stream was opened with is
+// no longer valid, so that the stream should end after it.
+func endsTokenStream(ev Event) bool {
+	switch ev.Type {
+	case EventTokenIssued, EventTokenRevoked, EventNodeDeleted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Open an event stream at `path` on `server`. If `admin` is true, the request
+// is authenticated as admin.
+func openEventStream(t *testing.T, server *httptest.Server, path string, admin bool) *http.Response {
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	if err != nil {
+		t.Fatal("Creating request:", err)
+	}
+	if admin {
+		text, err := theConfig.AdminToken.MarshalText()
+		errpanic(err)
+		req.SetBasicAuth("admin", string(text))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Opening event stream:", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("Opening event stream: got status %d", resp.StatusCode)
+	}
+	return resp
+}
+
+// Read the next event from a stream, skipping comments. Returns false if the
+// stream has ended.
+func readEvent(t *testing.T, r *bufio.Reader) (Event, bool) {
+	var (
+		ev      Event
+		typ, id string
+		gotData bool
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if gotData {
+				t.Fatal("Stream ended mid-event.")
+			}
+			return ev, false
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if !gotData {
+				continue
+			}
+			if ev.Type != typ || ev.ID != id {
+				t.Fatalf("Event fields don't match data: %q, %q, %+v", typ, id, ev)
+			}
+			return ev, true
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+				t.Fatal("Decoding event:", err)
+			}
+			gotData = true
+		default:
+			t.Fatalf("Unexpected line in event stream: %q", line)
+		}
+	}
+}
+
+func TestEventStreams(t *testing.T) {
+	ctx := context.Background()
+	daemon := newDaemon()
+	server := httptest.NewServer(makeHandler(theConfig, daemon))
+	defer server.Close()
+
+	all := openEventStream(t, server, "/events", true)
+	defer all.Body.Close()
+	allReader := bufio.NewReader(all.Body)
+
+	label := "stream-node"
+	err := daemon.SetNode(ctx, label, []byte(`{"type": "ipmi", "info": {"addr": "`+label+`"}}`))
+	if err != nil {
+		t.Fatal("SetNode:", err)
+	}
+	if ev, ok := readEvent(t, allReader); !ok || ev.Type != EventNodeRegistered || ev.Node != label {
+		t.Fatalf("Wanted a %s event, but got %+v", EventNodeRegistered, ev)
+	}
+
+	// A token is needed, and must be valid:
+	resp, err := http.Get(server.URL + "/node/" + label + "/events?token=" + strings.Repeat("0", 32))
+	if err != nil {
+		t.Fatal("Opening event stream:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Opening event stream with a bad token: wanted status %d but got %d",
+			http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	tok, err := daemon.GetNodeToken(ctx, label)
+	if err != nil {
+		t.Fatal("GetNodeToken:", err)
+	}
+	// Start from a known power state:
+	if err = daemon.PowerOffNode(ctx, label, &tok); err != nil {
+		t.Fatal("PowerOffNode:", err)
+	}
+	text, err := tok.MarshalText()
+	errpanic(err)
+	node := openEventStream(t, server, "/node/"+label+"/events?token="+string(text), false)
+	defer node.Body.Close()
+	nodeReader := bufio.NewReader(node.Body)
+
+	last := make(map[*Node]driver.PowerState)
+	daemon.pollPowerStates(ctx, last, 0)
+	if err = daemon.PowerOnNode(ctx, label, &tok); err != nil {
+		t.Fatal("PowerOnNode:", err)
+	}
+	daemon.pollPowerStates(ctx, last, 0)
+	conn, err := daemon.DialNodeConsole(ctx, label, &tok)
+	if err != nil {
+		t.Fatal("DialNodeConsole:", err)
+	}
+	conn.Close()
+	if err = daemon.InvalidateNodeToken(ctx, label); err != nil {
+		t.Fatal("InvalidateNodeToken:", err)
+	}
+
+	for _, typ := range []string{EventPowerAction, EventPowerChanged,
+		EventConsoleConnected, EventConsoleDisconnected, EventTokenRevoked} {
+		ev, ok := readEvent(t, nodeReader)
+		if !ok || ev.Type != typ || ev.Node != label {
+			t.Fatalf("Wanted a %s event, but got %+v", typ, ev)
+		}
+		if typ == EventPowerChanged && ev.Data["state"] != string(driver.PowerOn) {
+			t.Fatalf("Unexpected power state change: %+v", ev)
+		}
+	}
+	// Revoking the token ends the stream:
+	if ev, ok := readEvent(t, nodeReader); ok {
+		t.Fatalf("Wanted the stream to end, but got %+v", ev)
+	}
+
+	// The admin-wide stream sees the same events, plus those from before
+	// the node's stream was opened:
+	for _, typ := range []string{EventTokenIssued, EventPowerAction, EventPowerAction, EventPowerChanged,
+		EventConsoleConnected, EventConsoleDisconnected, EventTokenRevoked} {
+		if ev, ok := readEvent(t, allReader); !ok || ev.Type != typ {
+			t.Fatalf("Wanted a %s event, but got %+v", typ, ev)
+		}
+	}
+
+	// An admin stream for a single node needs the node to exist:
+	req, err := http.NewRequest("GET", server.URL+"/node/no-such-node/events", nil)
+	errpanic(err)
+	text, err = theConfig.AdminToken.MarshalText()
+	errpanic(err)
+	req.SetBasicAuth("admin", string(text))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Opening event stream:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Opening event stream for a missing node: wanted status %d but got %d",
+			http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// A token-authenticated stream which has fallen behind ends, rather than
+// missing the event revoking its token.
+func TestEventStreamFallsBehind(t *testing.T) {
+	ctx := context.Background()
+	daemon := newDaemon()
+	label := "slow-stream-node"
+	err := daemon.SetNode(ctx, label, []byte(`{"type": "ipmi", "info": {"addr": "`+label+`"}}`))
+	if err != nil {
+		t.Fatal("SetNode:", err)
+	}
+	tok, err := daemon.GetNodeToken(ctx, label)
+	if err != nil {
+		t.Fatal("GetNodeToken:", err)
+	}
+	events, unsubscribe, err := daemon.SubscribeNodeEventsWithToken(ctx, label, &tok)
+	if err != nil {
+		t.Fatal("SubscribeNodeEventsWithToken:", err)
+	}
+	defer unsubscribe()
+
+	// Fill the stream's buffer:
+	for i := 0; i < streamBufferSize; i++ {
+		daemon.publish(ctx, EventPowerAction, label)
+	}
+	if err = daemon.InvalidateNodeToken(ctx, label); err != nil {
+		t.Fatal("InvalidateNodeToken:", err)
+	}
+	n := 0
+	for ev := range events {
+		if endsTokenStream(ev) {
+			t.Fatalf("Got %+v, which shouldn't have fit in the buffer", ev)
+		}
+		n++
+	}
+	if n != streamBufferSize {
+		t.Fatalf("Wanted %d events before the stream ended, but got %d", streamBufferSize, n)
+	}
+}
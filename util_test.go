@@ -4,13 +4,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
 	"github.com/CCI-MOC/obmd/internal/driver/dummy"
@@ -26,6 +29,10 @@ func errpanic(err error) {
 }
 
 func init() {
+	// Keep request logs out of the test output; tests which care about
+	// logging install their own logger.
+	slog.SetDefault(slog.New(slog.NewTextHandler(ioutil.Discard, &slog.HandlerOptions{Level: slog.LevelError})))
+
 	theConfig = &Config{}
 	errpanic((&theConfig.AdminToken).
 		UnmarshalText([]byte("44d5ebcb1aae23bfefc8dca8314797eb")))
@@ -53,6 +60,29 @@ func (w responseStreamer) Write(p []byte) (n int, err error) {
 	return w.body.Write(p)
 }
 
+// Stream the console of the given node, authenticating with `token`. The
+// console is read in a separate goroutine; the returned reader will see EOF
+// when the server closes the connection.
+func streamConsole(handler http.Handler, nodeId string, token string) io.ReadCloser {
+	req := httptest.NewRequest(
+		"GET",
+		"http://localhost/node/"+nodeId+"/console?token="+token,
+		bytes.NewBuffer(nil),
+	)
+
+	r, w := io.Pipe()
+	respStreamer := &responseStreamer{
+		header: make(http.Header),
+		body:   w,
+	}
+
+	go func() {
+		handler.ServeHTTP(respStreamer, req)
+		w.Close()
+	}()
+	return r
+}
+
 // handy type for specifying requests in data literals
 type requestSpec struct {
 	method, url, body string
@@ -104,16 +134,37 @@ func makeNode(t *testing.T, handler http.Handler, nodeId string, nodeInfo string
 	}
 }
 
-// Wraps makeHandler, passing testing-appropriate arguments
-func newHandler() http.Handler {
-	db, err := sql.Open("sqlite3", ":memory:")
-	errpanic(err)
-	state, err := NewState(db, driver.Registry{
+// Create a Daemon backed by an in-memory database, with the mock driver
+// standing in for ipmi.
+func newDaemon() *Daemon {
+	return newDaemonWithRegistry(driver.Registry{
 		"ipmi":  mock.Driver,
 		"dummy": dummy.Driver,
 	})
+}
+
+// Like newDaemon, but with the given drivers.
+func newDaemonWithRegistry(registry driver.Registry) *Daemon {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	// Each connection to ":memory:" gets its own database:
+	db.SetMaxOpenConns(1)
+	errpanic(migrateSchema(context.Background(), db, "sqlite3"))
+	state, err := NewState(db, registry)
 	errpanic(err)
-	return makeHandler(theConfig, NewDaemon(state))
+	return NewDaemon(state, testRetryPolicy(), time.Minute)
+}
+
+// Get the default retry policy, but with short enough delays for tests.
+func testRetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	policy.Backoff = time.Millisecond
+	return policy
+}
+
+// Wraps makeHandler, passing testing-appropriate arguments
+func newHandler() http.Handler {
+	return makeHandler(theConfig, newDaemon())
 }
 
 // Make the specified request, and call t.Fatal if the status code is
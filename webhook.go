@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/logging"
+)
+
+var (
+	ErrNoSuchWebhook  = errors.New("No such webhook.")
+	ErrInvalidWebhook = errors.New("Invalid webhook.")
+)
+
+const (
+	// The number of events which may be waiting for delivery to a
+	// webhook; any more are dropped.
+	webhookQueueSize = 1000
+
+	// The number of times we try to deliver each event.
+	webhookMaxAttempts = 5
+
+	// How long we wait for a webhook to respond.
+	webhookTimeout = 10 * time.Second
+
+	// The number of deliveries kept in each webhook's log.
+	maxWebhookDeliveries = 100
+)
+
+// How long to wait before retrying a failed delivery. This doubles after each
+// attempt. It is a variable so tests can shorten it.
+var webhookRetryDelay = time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// All of the event types a webhook may ask for.
+var eventTypes = map[string]bool{
+	EventNodeRegistered:      true,
+	EventNodeDeleted:         true,
+	EventTokenIssued:         true,
+	EventTokenRevoked:        true,
+	EventPowerAction:         true,
+	EventPowerChanged:        true,
+	EventHealthChanged:       true,
+	EventConsoleConnected:    true,
+	EventConsoleDisconnected: true,
+}
+
+// The possible statuses of a WebhookDelivery.
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Where, and how, to send events.
+type WebhookSpec struct {
+	URL string `json:"url"`
+
+	// Used to sign the events; see webhook.deliver.
+	Secret string `json:"secret"`
+
+	// The types of events to send. If empty, all events are sent.
+	Events []string `json:"events,omitempty"`
+}
+
+// A webhook, as reported by the API. The secret is deliberately left out.
+type Webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// The outcome of sending an event to a webhook.
+type WebhookDelivery struct {
+	EventID   string `json:"event_id"`
+	EventType string `json:"event_type"`
+	Node      string `json:"node,omitempty"`
+
+	// When the last attempt finished.
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+	Status   string    `json:"status"`
+
+	// The http status of the last response, if any, and the reason the
+	// last attempt failed, if it did.
+	ResponseStatus int    `json:"response_status,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Check that the spec is well-formed, returning ErrInvalidWebhook if not.
+func (spec *WebhookSpec) validate() error {
+	u, err := url.Parse(spec.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhook
+	}
+	if spec.Secret == "" {
+		return ErrInvalidWebhook
+	}
+	for _, typ := range spec.Events {
+		if !eventTypes[typ] {
+			return ErrInvalidWebhook
+		}
+	}
+	return nil
+}
+
+// Report whether the webhook wants events like `ev`.
+func (spec *WebhookSpec) wants(ev Event) bool {
+	if len(spec.Events) == 0 {
+		return true
+	}
+	for _, typ := range spec.Events {
+		if typ == ev.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// A running webhook: a subscription to the daemon's events, and a goroutine
+// delivering them.
+type webhook struct {
+	id          string
+	spec        WebhookSpec
+	events      <-chan Event
+	unsubscribe func()
+
+	// Canceled to stop the webhook; done is closed once it has.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Most recent first.
+	deliveriesLock sync.Mutex
+	deliveries     []WebhookDelivery
+}
+
+func (w *webhook) info() Webhook {
+	events := w.spec.Events
+	if events == nil {
+		events = []string{}
+	}
+	return Webhook{ID: w.id, URL: w.spec.URL, Events: events}
+}
+
+// Start delivering events to the webhook described by `spec`. Must be called
+// with the daemon's lock held.
+func (d *Daemon) startWebhook(id string, spec WebhookSpec) {
+	ctx := logging.With(context.Background(), "webhook", id)
+	ctx, cancel := context.WithCancel(ctx)
+	w := &webhook{
+		id:     id,
+		spec:   spec,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	w.events, w.unsubscribe = d.events.subscribe(webhookQueueSize, false, spec.wants)
+	d.webhooks[id] = w
+	go w.run()
+}
+
+// Stop the webhook, abandoning any undelivered events.
+func (w *webhook) stop() {
+	w.cancel()
+	w.unsubscribe()
+	<-w.done
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return
+			}
+			w.deliver(ev)
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// Send `ev` to the webhook, retrying with exponential backoff if it fails, and
+// record the outcome in the delivery log.
+//
+// The event is POSTed as JSON. The X-OBMd-Signature header holds
+// "sha256=" followed by the hex-encoded HMAC-SHA256 of the body, keyed by the
+// webhook's secret.
+func (w *webhook) deliver(ev Event) {
+	log := logging.FromContext(w.ctx)
+	body, err := json.Marshal(&ev)
+	if err != nil {
+		log.Error("Encoding event.", "err", err)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(w.spec.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	delivery := WebhookDelivery{
+		EventID:   ev.ID,
+		EventType: ev.Type,
+		Node:      ev.Node,
+		Status:    DeliveryFailed,
+	}
+	delay := webhookRetryDelay
+	for delivery.Attempts < webhookMaxAttempts {
+		if delivery.Attempts > 0 {
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		delivery.Attempts++
+		var retry bool
+		delivery.ResponseStatus, retry, err = w.post(body, ev, signature)
+		if err == nil {
+			delivery.Status = DeliveryDelivered
+			delivery.Error = ""
+			break
+		}
+		delivery.Error = err.Error()
+		log.Debug("Webhook delivery failed.",
+			"event", ev.ID, "attempt", delivery.Attempts, "err", err)
+		if !retry || w.ctx.Err() != nil {
+			break
+		}
+	}
+	if delivery.Status == DeliveryFailed {
+		log.Warn("Giving up on webhook delivery.",
+			"event", ev.ID, "attempts", delivery.Attempts, "err", delivery.Error)
+	}
+	delivery.Time = time.Now().UTC()
+
+	w.deliveriesLock.Lock()
+	defer w.deliveriesLock.Unlock()
+	w.deliveries = append([]WebhookDelivery{delivery}, w.deliveries...)
+	if len(w.deliveries) > maxWebhookDeliveries {
+		w.deliveries = w.deliveries[:maxWebhookDeliveries]
+	}
+}
+
+// Make one attempt to POST `body` to the webhook. Returns the response's
+// status (if there was one), whether it is worth trying again, and an error if
+// the attempt failed.
+func (w *webhook) post(body []byte, ev Event, signature string) (status int, retry bool, err error) {
+	req, err := http.NewRequest("POST", w.spec.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req = req.WithContext(w.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-OBMd-Event", ev.Type)
+	req.Header.Set("X-OBMd-Delivery", ev.ID)
+	req.Header.Set("X-OBMd-Signature", signature)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.StatusCode, false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return resp.StatusCode, true, fmt.Errorf("Webhook returned status %d.", resp.StatusCode)
+	default:
+		return resp.StatusCode, false, fmt.Errorf("Webhook returned status %d.", resp.StatusCode)
+	}
+}
+
+// Register a new webhook.
+func (d *Daemon) CreateWebhook(ctx context.Context, spec WebhookSpec) (Webhook, error) {
+	if err := spec.validate(); err != nil {
+		return Webhook{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return Webhook{}, err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if err = d.state.CreateWebhook(id, &spec); err != nil {
+		return Webhook{}, err
+	}
+	d.startWebhook(id, spec)
+	logging.FromContext(ctx).Info("Created webhook.", "webhook", id, "url", spec.URL)
+	return d.webhooks[id].info(), nil
+}
+
+func (d *Daemon) DeleteWebhook(ctx context.Context, id string) error {
+	d.Lock()
+	defer d.Unlock()
+	w, ok := d.webhooks[id]
+	if !ok {
+		return ErrNoSuchWebhook
+	}
+	if err := d.state.DeleteWebhook(id); err != nil {
+		return err
+	}
+	delete(d.webhooks, id)
+	w.stop()
+	logging.FromContext(ctx).Info("Deleted webhook.", "webhook", id)
+	return nil
+}
+
+func (d *Daemon) GetWebhook(ctx context.Context, id string) (Webhook, error) {
+	d.Lock()
+	defer d.Unlock()
+	w, ok := d.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNoSuchWebhook
+	}
+	return w.info(), nil
+}
+
+// List all webhooks, sorted by ID.
+func (d *Daemon) ListWebhooks(ctx context.Context) []Webhook {
+	d.Lock()
+	defer d.Unlock()
+	ret := []Webhook{}
+	for _, w := range d.webhooks {
+		ret = append(ret, w.info())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
+
+// Get a webhook's delivery log, most recent first.
+func (d *Daemon) GetWebhookDeliveries(ctx context.Context, id string) ([]WebhookDelivery, error) {
+	d.Lock()
+	w, ok := d.webhooks[id]
+	d.Unlock()
+	if !ok {
+		return nil, ErrNoSuchWebhook
+	}
+	w.deliveriesLock.Lock()
+	defer w.deliveriesLock.Unlock()
+	return append([]WebhookDelivery{}, w.deliveries...), nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	webhookRetryDelay = time.Millisecond
+}
+
+// An http server which records the events POSTed to it, checking their
+// signatures. It fails the first request for each event with a 500, to
+// exercise retries.
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+
+	lock     sync.Mutex
+	attempts map[string]int
+	events   []Event
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		r.t.Error("Reading webhook body:", err)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(r.secret))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get("X-OBMd-Signature"); got != want {
+		r.t.Errorf("Bad signature: wanted %q but got %q", want, got)
+	}
+	var ev Event
+	if err = json.Unmarshal(body, &ev); err != nil {
+		r.t.Error("Decoding event:", err)
+		return
+	}
+	if req.Header.Get("X-OBMd-Event") != ev.Type || req.Header.Get("X-OBMd-Delivery") != ev.ID {
+		r.t.Errorf("Headers don't match event %+v: %v", ev, req.Header)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.attempts[ev.ID]++
+	if r.attempts[ev.ID] == 1 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.events = append(r.events, ev)
+}
+
+// Wait until the receiver has seen `n` events, and return them.
+func (r *webhookReceiver) waitFor(n int) []Event {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.lock.Lock()
+		events := append([]Event{}, r.events...)
+		r.lock.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			r.t.Fatalf("Timed out waiting for %d events; got %+v", n, events)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	receiver := &webhookReceiver{t: t, secret: "s3cret", attempts: make(map[string]int)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	daemon := newDaemon()
+	defer daemon.Close()
+	for _, spec := range []WebhookSpec{
+		{URL: "ftp://example.com", Secret: "x"},
+		{URL: server.URL},
+		{URL: server.URL, Secret: "x", Events: []string{"no.such.event"}},
+	} {
+		if _, err := daemon.CreateWebhook(ctx, spec); err != ErrInvalidWebhook {
+			t.Fatalf("CreateWebhook(%+v): wanted %v but got %v", spec, ErrInvalidWebhook, err)
+		}
+	}
+	hook, err := daemon.CreateWebhook(ctx, WebhookSpec{
+		URL:    server.URL,
+		Secret: receiver.secret,
+		Events: []string{EventNodeRegistered, EventTokenIssued, EventPowerAction,
+			EventConsoleConnected, EventConsoleDisconnected, EventTokenRevoked},
+	})
+	if err != nil {
+		t.Fatal("CreateWebhook:", err)
+	}
+
+	label := "webhook-node"
+	err = daemon.SetNode(ctx, label, []byte(`{"type": "ipmi", "info": {"addr": "`+label+`"}}`))
+	if err != nil {
+		t.Fatal("SetNode:", err)
+	}
+	tok, err := daemon.GetNodeToken(ctx, label)
+	if err != nil {
+		t.Fatal("GetNodeToken:", err)
+	}
+	if err = daemon.PowerOnNode(ctx, label, &tok); err != nil {
+		t.Fatal("PowerOnNode:", err)
+	}
+	conn, err := daemon.DialNodeConsole(ctx, label, &tok)
+	if err != nil {
+		t.Fatal("DialNodeConsole:", err)
+	}
+	conn.Close()
+	if err = daemon.InvalidateNodeToken(ctx, label); err != nil {
+		t.Fatal("InvalidateNodeToken:", err)
+	}
+	// Not one the webhook asked for:
+	if err = daemon.DeleteNode(ctx, label); err != nil {
+		t.Fatal("DeleteNode:", err)
+	}
+
+	events := receiver.waitFor(6)
+	wantTypes := []string{EventNodeRegistered, EventTokenIssued, EventPowerAction,
+		EventConsoleConnected, EventConsoleDisconnected, EventTokenRevoked}
+	if len(events) != len(wantTypes) {
+		t.Fatalf("Wanted %d events but got %+v", len(wantTypes), events)
+	}
+	for i, ev := range events {
+		if ev.Type != wantTypes[i] || ev.Node != label {
+			t.Fatalf("Event %d: wanted a %s event for %s, but got %+v",
+				i, wantTypes[i], label, ev)
+		}
+	}
+	if events[2].Data["action"] != string(PowerOn) || events[2].Data["result"] != "ok" {
+		t.Fatalf("Unexpected power action event: %+v", events[2])
+	}
+
+	// The last delivery is recorded just after the receiver sees it, so
+	// we may have to wait for it:
+	var deliveries []WebhookDelivery
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, err = daemon.GetWebhookDeliveries(ctx, hook.ID)
+		if err != nil {
+			t.Fatal("GetWebhookDeliveries:", err)
+		}
+		if len(deliveries) == 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(deliveries) != 6 {
+		t.Fatalf("Wanted 6 deliveries but got %+v", deliveries)
+	}
+	for _, d := range deliveries {
+		if d.Status != DeliveryDelivered || d.Attempts != 2 || d.ResponseStatus != http.StatusOK {
+			t.Fatalf("Unexpected delivery: %+v", d)
+		}
+	}
+	if deliveries[0].EventType != EventTokenRevoked {
+		t.Fatalf("Deliveries are not most recent first: %+v", deliveries)
+	}
+
+	if err = daemon.DeleteWebhook(ctx, hook.ID); err != nil {
+		t.Fatal("DeleteWebhook:", err)
+	}
+	if _, err = daemon.GetWebhook(ctx, hook.ID); err != ErrNoSuchWebhook {
+		t.Fatalf("GetWebhook after delete: wanted %v but got %v", ErrNoSuchWebhook, err)
+	}
+}
+
+// Client errors other than 429 aren't retried.
+func TestWebhookNoRetry(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	daemon := newDaemon()
+	defer daemon.Close()
+	hook, err := daemon.CreateWebhook(ctx, WebhookSpec{URL: server.URL, Secret: "x"})
+	if err != nil {
+		t.Fatal("CreateWebhook:", err)
+	}
+	err = daemon.SetNode(ctx, "webhook-403", []byte(`{"type": "ipmi", "info": {"addr": "webhook-403"}}`))
+	if err != nil {
+		t.Fatal("SetNode:", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, err := daemon.GetWebhookDeliveries(ctx, hook.ID)
+		if err != nil {
+			t.Fatal("GetWebhookDeliveries:", err)
+		}
+		if len(deliveries) > 0 {
+			d := deliveries[0]
+			if d.Status != DeliveryFailed || d.Attempts != 1 || d.ResponseStatus != http.StatusForbidden {
+				t.Fatalf("Unexpected delivery: %+v", d)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for delivery.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	handler := newHandler()
+	for _, body := range []string{
+		`{"url": "not a url", "secret": "x"}`,
+		`{"url": "http://example.com"}`,
+		`{"url": "http://example.com", "secret": "x", "events": ["bogus"]}`,
+	} {
+		adminRequireStatus(t, handler, http.StatusBadRequest,
+			requestSpec{"POST", "http://localhost/webhooks", body})
+	}
+	resp := adminReq(handler, requestSpec{
+		"POST", "http://localhost/webhooks",
+		`{"url": "http://example.com/hook", "secret": "x", "events": ["node.deleted"]}`,
+	}).Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Creating webhook: got status %d", resp.StatusCode)
+	}
+	var hook map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&hook); err != nil {
+		t.Fatal("Decoding webhook:", err)
+	}
+	if _, ok := hook["secret"]; ok {
+		t.Fatalf("Webhook's secret was reported: %v", hook)
+	}
+	id, _ := hook["id"].(string)
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"GET", "http://localhost/webhook/" + id, ""})
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"GET", "http://localhost/webhook/" + id + "/deliveries", ""})
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"DELETE", "http://localhost/webhook/" + id, ""})
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"GET", "http://localhost/webhook/" + id, ""})
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"GET", "http://localhost/webhook/" + id + "/deliveries", ""})
+}